@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"golang.org/x/net/html"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Pages that answer our user agent with a 403 or a bot challenge
+func isBlockedPage(site ExternalPage) bool {
+	return site.Failure == failureHttpStatus && isBlockedStatus(site.StatusCode)
+}
+
+func isBlockedStatus(statusCode int) bool {
+	return statusCode == http.StatusForbidden
+}
+
+// Find the AMP version advertised by a <link rel="amphtml"> in the page
+func getAmpUrl(body []byte, pageUrl *url.URL) string {
+	tokenizer := html.NewTokenizer(bytes.NewReader(body))
+
+	for {
+		tokenType := tokenizer.Next()
+
+		if tokenType == html.ErrorToken {
+			return ""
+		}
+
+		if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+			continue
+		}
+
+		token := tokenizer.Token()
+
+		if token.Data == "body" {
+			return ""
+		}
+
+		if token.Data != "link" || !strings.EqualFold(getAttr(token, "rel"), "amphtml") {
+			continue
+		}
+
+		ampUrl, err := pageUrl.Parse(strings.TrimSpace(getAttr(token, "href")))
+
+		if err != nil {
+			return ""
+		}
+
+		return ampUrl.String()
+	}
+}
+
+// The AMP page, if the blocked page advertised one, then the m. mobile site
+func getAlternateUrls(site ExternalPage) []string {
+	var alternates []string
+
+	if site.AmpUrl != "" {
+		alternates = append(alternates, site.AmpUrl)
+	}
+
+	host := strings.TrimPrefix(site.Url.Url.Host, "www.")
+
+	if !strings.HasPrefix(host, "m.") {
+		mobileUrl := *site.Url.Url
+		mobileUrl.Host = "m." + host
+		alternates = append(alternates, mobileUrl.String())
+	}
+
+	return alternates
+}
+
+// Try the alternate versions of a blocked page, which often carry the same feed and metadata. A fetched alternate
+// keeps its own URL, so its links resolve against it, and records the blocked link so the prospect is still queued
+// under the canonical host
+func (d *Discoverer) fetchAlternatePage(ctx context.Context, blockedPage ExternalPage) (ExternalPage, bool) {
+	for _, alternate := range getAlternateUrls(blockedPage) {
+		alternateUrl, err := url.Parse(alternate)
+
+		if err != nil {
+			continue
+		}
+
+		alternatePages := d.fetchExternalPageBatch(ctx, []ExternalUrl{{
+			Link:       alternate,
+			Url:        alternateUrl,
+			PostId:     blockedPage.Url.PostId,
+			AnchorText: blockedPage.Url.AnchorText,
+		}})
+
+		if len(alternatePages) == 1 && alternatePages[0].Fetched {
+			slog.Info("fetched alternate of blocked page", "url", blockedPage.Url.Link, "alternate", alternate)
+
+			alternatePage := alternatePages[0]
+			alternatePage.AlternateOf = blockedPage.Url.Link
+
+			return alternatePage, true
+		}
+	}
+
+	return blockedPage, false
+}
+
+// The URL a page is queued under before any canonical link: the blocked page's for an alternate
+func queueUrl(site ExternalPage) *url.URL {
+	if site.AlternateOf != "" {
+		if blockedUrl, err := url.Parse(site.AlternateOf); err == nil {
+			return blockedUrl
+		}
+	}
+
+	return site.Url.Url
+}
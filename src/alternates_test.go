@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestGetAmpUrl(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{name: "relative", html: `<html><head><link rel="amphtml" href="/post/amp"></head>`, want: "https://blog.example/post/amp"},
+		{name: "absolute", html: `<head><link rel="AMPHTML" href=" https://amp.blog.example/post "></head>`, want: "https://amp.blog.example/post"},
+		{name: "none", html: `<head><link rel="canonical" href="/post"></head>`, want: ""},
+		{name: "in the body", html: `<head></head><body><link rel="amphtml" href="/post/amp"></body>`, want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pageUrl, _ := url.Parse("https://blog.example/post")
+
+			if got := getAmpUrl([]byte(test.html), pageUrl); got != test.want {
+				t.Errorf("getAmpUrl() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetAlternateUrls(t *testing.T) {
+	tests := []struct {
+		name   string
+		rawUrl string
+		ampUrl string
+		want   []string
+	}{
+		{name: "amp then mobile", rawUrl: "https://blog.example/post", ampUrl: "https://blog.example/post/amp", want: []string{"https://blog.example/post/amp", "https://m.blog.example/post"}},
+		{name: "www replaced", rawUrl: "https://www.blog.example/", want: []string{"https://m.blog.example/"}},
+		{name: "already mobile", rawUrl: "https://m.blog.example/", want: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			page := testPage(test.rawUrl, 1)
+			page.AmpUrl = test.ampUrl
+
+			if got := getAlternateUrls(page); strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("getAlternateUrls() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRunFetchesAlternates(t *testing.T) {
+	content := `<html><head><title>Anime</title><link rel="alternate" type="application/rss+xml" href="feed"></head><body>anime</body></html>`
+
+	doer := handlerDoer{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Host == "amp.example" && r.URL.Path == "/amp/":
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(content))
+		case r.Host == "amp.example":
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`<html><head><link rel="amphtml" href="/amp/"></head><body>Checking your browser</body></html>`))
+		case r.Host == "m.mobile.example":
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(content))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	})}
+
+	post := Post{
+		Id:   1,
+		Url:  "https://aggregator.example/post",
+		Body: `<a href="https://amp.example/">amp</a> <a href="https://www.mobile.example/">mobile</a> <a href="https://blocked.example/">blocked</a>`,
+	}
+
+	tests := []struct {
+		name       string
+		alternates bool
+		// Feeds by host, resolved against the alternate that linked them
+		wantFeeds map[string]string
+	}{
+		{name: "alternates fetched", alternates: true, wantFeeds: map[string]string{
+			"amp.example":    "https://amp.example/amp/feed",
+			"mobile.example": "https://m.mobile.example/feed",
+		}},
+		{name: "alternates off", alternates: false, wantFeeds: map[string]string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testDiscovererConfig()
+			config.Crawler.FetchAlternates = test.alternates
+			config.Crawler.MaxRetries = 0
+
+			result, err := NewDiscoverer(config, &fakeStore{posts: []Post{post}}, doer).Run(context.Background())
+
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			feeds := make(map[string]string)
+
+			for _, discovery := range result.Queued {
+				feeds[discovery.Host] = discovery.FeedUrl
+			}
+
+			if fmt.Sprint(feeds) != fmt.Sprint(test.wantFeeds) {
+				t.Errorf("queued %v, want %v", feeds, test.wantFeeds)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+)
+
+// Candidates left over when a run reaches crawler.maxCandidatesPerRun, fetched by the next run when
+// crawler.carryOverCandidates is set
+type candidateBacklog struct {
+	mutex      sync.Mutex
+	candidates []ExternalUrl
+}
+
+// Empty the backlog, returning what was in it
+func (backlog *candidateBacklog) take() []ExternalUrl {
+	backlog.mutex.Lock()
+	defer backlog.mutex.Unlock()
+
+	candidates := backlog.candidates
+	backlog.candidates = nil
+
+	return candidates
+}
+
+// Replace the backlog. Carried candidates are scheduled again alongside the next run's, so whatever is still left
+// over then replaces them rather than piling up
+func (backlog *candidateBacklog) keep(candidates []ExternalUrl) {
+	backlog.mutex.Lock()
+	defer backlog.mutex.Unlock()
+
+	backlog.candidates = candidates
+}
+
+// Split candidates into those that fit in what's left of a budget of max once scheduled have been taken, and the
+// rest. All of them fit when max is 0
+func capCandidates(candidates []ExternalUrl, max int, scheduled int) ([]ExternalUrl, []ExternalUrl) {
+	if max <= 0 {
+		return candidates, nil
+	}
+
+	remaining := max - scheduled
+
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	if len(candidates) <= remaining {
+		return candidates, nil
+	}
+
+	return candidates[:remaining], candidates[remaining:]
+}
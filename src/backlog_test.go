@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestCapCandidates(t *testing.T) {
+	candidates := []ExternalUrl{{Link: "https://a.example"}, {Link: "https://b.example"}, {Link: "https://c.example"}}
+
+	tests := []struct {
+		name         string
+		max          int
+		scheduled    int
+		wantKept     int
+		wantDeferred int
+	}{
+		{name: "no limit", max: 0, scheduled: 10, wantKept: 3},
+		{name: "under the limit", max: 5, wantKept: 3},
+		{name: "over the limit", max: 2, wantKept: 2, wantDeferred: 1},
+		{name: "part of the budget spent", max: 4, scheduled: 2, wantKept: 2, wantDeferred: 1},
+		{name: "budget spent", max: 2, scheduled: 2, wantDeferred: 3},
+		{name: "budget overspent", max: 2, scheduled: 5, wantDeferred: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kept, deferred := capCandidates(candidates, test.max, test.scheduled)
+
+			if len(kept) != test.wantKept || len(deferred) != test.wantDeferred {
+				t.Errorf("kept %d and deferred %d, want %d and %d", len(kept), len(deferred), test.wantKept, test.wantDeferred)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// What the last fetch of a page answered with, for making the next fetch of it conditional
+type PriorFetch struct {
+	Url          string
+	ETag         string
+	LastModified time.Time
+	// The prospect host, score and feed the page was queued with, reused when it hasn't changed
+	Host        string
+	Score       int
+	ScoreDetail map[string]int
+	FeedUrl     string
+}
+
+// Ask the server to answer 304 Not Modified when the page is unchanged since its last fetch
+func addConditionalHeaders(req *http.Request, candidate ExternalUrl) {
+	if candidate.Prior == nil {
+		return
+	}
+
+	if candidate.Prior.ETag != "" {
+		req.Header.Add("If-None-Match", candidate.Prior.ETag)
+	}
+
+	if !candidate.Prior.LastModified.IsZero() {
+		req.Header.Add("If-Modified-Since", candidate.Prior.LastModified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// Validators are kept for the last page fetched from each host, and only used when a candidate links the same page
+func attachPriorFetches(candidates []ExternalUrl, priorFetches map[string]PriorFetch) {
+	for i, candidate := range candidates {
+		prior, ok := priorFetches[normalizeHost(candidate.Url.Host)]
+
+		if ok && prior.Url == candidate.Link {
+			candidates[i].Prior = &prior
+		}
+	}
+}
+
+// The hosts validators are looked up by
+func candidateHosts(candidates []ExternalUrl) []string {
+	var hosts []string
+
+	for _, candidate := range candidates {
+		hosts = append(hosts, normalizeHost(candidate.Url.Host))
+	}
+
+	return hosts
+}
+
+// The link the page was requested with, before any redirects
+func requestedLink(site ExternalPage) string {
+	if site.RedirectedFrom != "" {
+		return site.RedirectedFrom
+	}
+
+	return site.Url.Link
+}
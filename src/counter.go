@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Counts weighted keyword hits in text. Words are split on whitespace and stripped of surrounding punctuation, so
+// "anime," and "(anime)" match anime, and with scoring.stemming "animes" does too. Keywords of several words, such
+// as "light novel", are phrases matched where their words appear consecutively
+type KeywordCounter struct {
+	keywords map[string]int
+	matcher  keywordMatcher
+	phrases  map[string][]string
+	// Phrases are compared by stem, except those in scoring.exactKeywords
+	stemming      bool
+	exactKeywords map[string]bool
+}
+
+func NewKeywordCounter(keywords map[string]int, scoring ScoringConfig) *KeywordCounter {
+	counter := &KeywordCounter{
+		keywords:      keywords,
+		phrases:       make(map[string][]string),
+		stemming:      scoring.Stemming,
+		exactKeywords: make(map[string]bool),
+	}
+
+	for _, keyword := range scoring.ExactKeywords {
+		counter.exactKeywords[strings.ToLower(keyword)] = true
+	}
+
+	words := make(map[string]int)
+
+	for keyword, weight := range keywords {
+		if phrase := tokenizeWords(keyword); len(phrase) > 1 {
+			counter.phrases[keyword] = phrase
+		} else {
+			words[keyword] = weight
+		}
+	}
+
+	counter.matcher = newKeywordMatcher(words, scoring)
+
+	return counter
+}
+
+// The weighted score of the keywords in text, adding each hit to counts when it isn't nil
+func (counter *KeywordCounter) Count(text string, counts map[string]int) int {
+	score := 0
+	words := tokenizeWords(text)
+
+	for i, word := range words {
+		matched := counter.match(word)
+
+		for keyword, phrase := range counter.phrases {
+			if counter.matchPhrase(words[i:], keyword, phrase) {
+				matched = append(matched, keyword)
+			}
+		}
+
+		for _, keyword := range matched {
+			if counts != nil {
+				counts[keyword]++
+			}
+
+			score = score + counter.keywords[keyword]
+		}
+	}
+
+	return score
+}
+
+// Whether words open with the phrase
+func (counter *KeywordCounter) matchPhrase(words []string, keyword string, phrase []string) bool {
+	if len(words) < len(phrase) {
+		return false
+	}
+
+	stemmed := counter.stemming && !counter.exactKeywords[keyword]
+
+	for i, phraseWord := range phrase {
+		word := trimPunctuation(words[i])
+		phraseWord = trimPunctuation(phraseWord)
+
+		if stemmed {
+			word = stemWord(word)
+			phraseWord = stemWord(phraseWord)
+		}
+
+		if word != phraseWord {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Keywords that themselves contain punctuation, such as "c++", are matched against the word as written first
+func (counter *KeywordCounter) match(word string) []string {
+	if matched := counter.matcher.match(word); len(matched) > 0 {
+		return matched
+	}
+
+	trimmed := trimPunctuation(word)
+
+	if trimmed == word || trimmed == "" {
+		return nil
+	}
+
+	return counter.matcher.match(trimmed)
+}
+
+// The lowercased, whitespace separated words of text
+func tokenizeWords(text string) []string {
+	return strings.Fields(strings.ToLower(text))
+}
+
+func trimPunctuation(word string) string {
+	return strings.TrimFunc(word, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import "testing"
+
+func TestKeywordCounterWords(t *testing.T) {
+	keywords := map[string]int{"anime": 2, "manga": 1, "c++": 3, "series": 1}
+
+	tests := []struct {
+		name          string
+		text          string
+		stemming      bool
+		exactKeywords []string
+		want          int
+	}{
+		{name: "plain words", text: "anime and manga", want: 3},
+		{name: "trailing punctuation", text: "anime, manga.", want: 3},
+		{name: "surrounding punctuation", text: `("anime") [manga]!`, want: 3},
+		{name: "case", text: "ANIME Manga", want: 3},
+		{name: "punctuation in the keyword", text: "learn c++ today", want: 3},
+		{name: "only punctuation", text: "... --- !!!", want: 0},
+		{name: "inside a longer word", text: "animeland mangaka", want: 0},
+		{name: "plural without stemming", text: "animes", want: 0},
+		{name: "plural with stemming", text: "animes mangas", stemming: true, want: 3},
+		{name: "possessive with stemming", text: "anime's", stemming: true, want: 2},
+		{name: "plural next to punctuation", text: "(animes),", stemming: true, want: 2},
+		{name: "keyword and text share a stem", text: "series", stemming: true, want: 1},
+		{name: "exact keyword ignores plurals", text: "animes anime", stemming: true, exactKeywords: []string{"anime"}, want: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scoring := defaultConfig().Scoring
+			scoring.Stemming = test.stemming
+			scoring.ExactKeywords = test.exactKeywords
+
+			if got := NewKeywordCounter(keywords, scoring).Count(test.text, nil); got != test.want {
+				t.Errorf("Count(%q) = %d, want %d", test.text, got, test.want)
+			}
+		})
+	}
+}
+
+func TestStemWord(t *testing.T) {
+	tests := []struct {
+		word string
+		want string
+	}{
+		{word: "animes", want: "anime"},
+		{word: "stories", want: "story"},
+		{word: "boxes", want: "box"},
+		{word: "watches", want: "watch"},
+		{word: "anime's", want: "anime"},
+		{word: "class", want: "class"},
+		{word: "anime", want: "anime"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.word, func(t *testing.T) {
+			if got := stemWord(test.word); got != test.want {
+				t.Errorf("stemWord(%q) = %q, want %q", test.word, got, test.want)
+			}
+		})
+	}
+}
+
+func TestKeywordCounterPhrases(t *testing.T) {
+	keywords := map[string]int{"light novel": 5, "visual novel": 4, "novel": 1}
+
+	tests := []struct {
+		name       string
+		text       string
+		stemming   bool
+		want       int
+		wantCounts map[string]int
+	}{
+		{name: "phrase", text: "a light novel adaptation", want: 6, wantCounts: map[string]int{"light novel": 1, "novel": 1}},
+		{name: "phrase next to punctuation", text: "(Light Novel),", want: 6, wantCounts: map[string]int{"light novel": 1, "novel": 1}},
+		{name: "two phrases", text: "light novel or visual novel", want: 11, wantCounts: map[string]int{"light novel": 1, "visual novel": 1, "novel": 2}},
+		{name: "words apart", text: "a light read, not a novel", want: 1, wantCounts: map[string]int{"novel": 1}},
+		{name: "words reversed", text: "novel light", want: 1, wantCounts: map[string]int{"novel": 1}},
+		{name: "first word only", text: "light", want: 0, wantCounts: map[string]int{}},
+		{name: "plural phrase with stemming", text: "light novels", stemming: true, want: 6, wantCounts: map[string]int{"light novel": 1, "novel": 1}},
+		{name: "plural phrase without stemming", text: "light novels", want: 0, wantCounts: map[string]int{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scoring := defaultConfig().Scoring
+			scoring.Stemming = test.stemming
+
+			counts := make(map[string]int)
+
+			if got := NewKeywordCounter(keywords, scoring).Count(test.text, counts); got != test.want {
+				t.Errorf("Count(%q) = %d, want %d", test.text, got, test.want)
+			}
+
+			if len(counts) != len(test.wantCounts) {
+				t.Fatalf("counts = %v, want %v", counts, test.wantCounts)
+			}
+
+			for keyword, want := range test.wantCounts {
+				if counts[keyword] != want {
+					t.Errorf("counts[%q] = %d, want %d", keyword, counts[keyword], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,844 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"time"
+)
+
+// The persistence a Discoverer reads posts from and writes prospects to
+type Store interface {
+	GetPosts(ctx context.Context, postsConfig PostsConfig, afterPostId int64) ([]Post, error)
+	GetWatermark(ctx context.Context) (int64, error)
+	SetWatermark(ctx context.Context, postId int64) error
+	IsInBlacklist(ctx context.Context, host string) (bool, error)
+	GetBlacklistedHosts(ctx context.Context) (map[string]bool, error)
+	AddSiteToReviewQueue(ctx context.Context, site ExternalPage, score int, scoreDetail map[string]int, rssFeedUrl string, scoreDecay float64) (bool, error)
+	SetThumbnailUrl(ctx context.Context, host string, thumbnailUrl string) error
+	SetMixedContent(ctx context.Context, host string, mixedContent bool) error
+	SetBrokenTls(ctx context.Context, host string, brokenTls bool) error
+	RecordRejected(ctx context.Context, site ExternalPage, score int, scoreDetail map[string]int) error
+	LogFetchFailures(ctx context.Context, runAt time.Time, failedPages []ExternalPage) error
+	StorePageHtml(ctx context.Context, site ExternalPage) error
+	GetPriorFetches(ctx context.Context, hosts []string) (map[string]PriorFetch, error)
+	SetPriorFetch(ctx context.Context, host string, prior PriorFetch) error
+	FeedMarker
+}
+
+// Store backed by the rss_aggregator MySQL database
+type mysqlStore struct {
+	db *sql.DB
+	// How long each query may take, none when 0
+	timeout time.Duration
+}
+
+func (store mysqlStore) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if store.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, store.timeout)
+}
+
+func (store mysqlStore) CheckTables(ctx context.Context, config AppConfig) error {
+	ctx, cancel := store.queryContext(ctx)
+	defer cancel()
+
+	return checkTables(ctx, store.db, config)
+}
+
+func (store mysqlStore) GetPosts(ctx context.Context, postsConfig PostsConfig, afterPostId int64) ([]Post, error) {
+	ctx, cancel := store.queryContext(ctx)
+	defer cancel()
+
+	return getPosts(ctx, store.db, postsConfig, afterPostId)
+}
+
+func (store mysqlStore) GetWatermark(ctx context.Context) (int64, error) {
+	ctx, cancel := store.queryContext(ctx)
+	defer cancel()
+
+	return getWatermark(ctx, store.db)
+}
+
+func (store mysqlStore) SetWatermark(ctx context.Context, postId int64) error {
+	ctx, cancel := store.queryContext(ctx)
+	defer cancel()
+
+	return setWatermark(ctx, store.db, postId)
+}
+
+func (store mysqlStore) IsInBlacklist(ctx context.Context, host string) (bool, error) {
+	ctx, cancel := store.queryContext(ctx)
+	defer cancel()
+
+	return isInBlacklist(ctx, store.db, host)
+}
+
+func (store mysqlStore) GetBlacklistedHosts(ctx context.Context) (map[string]bool, error) {
+	ctx, cancel := store.queryContext(ctx)
+	defer cancel()
+
+	return getBlacklistedHosts(ctx, store.db)
+}
+
+func (store mysqlStore) BlacklistHost(ctx context.Context, host string, reason string) (bool, error) {
+	ctx, cancel := store.queryContext(ctx)
+	defer cancel()
+
+	return blacklistHost(ctx, store.db, host, reason)
+}
+
+func (store mysqlStore) AddSiteToReviewQueue(ctx context.Context, site ExternalPage, score int, scoreDetail map[string]int, rssFeedUrl string, scoreDecay float64) (bool, error) {
+	ctx, cancel := store.queryContext(ctx)
+	defer cancel()
+
+	return addSiteToReviewQueue(ctx, store.db, site, score, scoreDetail, rssFeedUrl, scoreDecay)
+}
+
+func (store mysqlStore) RecordRejected(ctx context.Context, site ExternalPage, score int, scoreDetail map[string]int) error {
+	ctx, cancel := store.queryContext(ctx)
+	defer cancel()
+
+	return recordRejected(ctx, store.db, site, score, scoreDetail)
+}
+
+func (store mysqlStore) LogFetchFailures(ctx context.Context, runAt time.Time, failedPages []ExternalPage) error {
+	ctx, cancel := store.queryContext(ctx)
+	defer cancel()
+
+	return logFetchFailures(ctx, store.db, runAt, failedPages)
+}
+
+func (store mysqlStore) StorePageHtml(ctx context.Context, site ExternalPage) error {
+	ctx, cancel := store.queryContext(ctx)
+	defer cancel()
+
+	return storePageHtml(ctx, store.db, site)
+}
+
+func (store mysqlStore) GetPriorFetches(ctx context.Context, hosts []string) (map[string]PriorFetch, error) {
+	ctx, cancel := store.queryContext(ctx)
+	defer cancel()
+
+	return getPriorFetches(ctx, store.db, hosts)
+}
+
+func (store mysqlStore) SetPriorFetch(ctx context.Context, host string, prior PriorFetch) error {
+	ctx, cancel := store.queryContext(ctx)
+	defer cancel()
+
+	return setPriorFetch(ctx, store.db, host, prior)
+}
+
+func (store mysqlStore) GetStoredPages(ctx context.Context) ([]StoredPage, error) {
+	ctx, cancel := store.queryContext(ctx)
+	defer cancel()
+
+	return getStoredPages(ctx, store.db)
+}
+
+func (store mysqlStore) SetRescored(ctx context.Context, host string, score int, scoreDetail map[string]int) error {
+	ctx, cancel := store.queryContext(ctx)
+	defer cancel()
+
+	return setRescored(ctx, store.db, host, score, scoreDetail)
+}
+
+func (store mysqlStore) SetThumbnailUrl(ctx context.Context, host string, thumbnailUrl string) error {
+	ctx, cancel := store.queryContext(ctx)
+	defer cancel()
+
+	return setThumbnailUrl(ctx, store.db, host, thumbnailUrl)
+}
+
+func (store mysqlStore) GetQueuedFeeds(ctx context.Context) ([]QueuedFeed, error) {
+	ctx, cancel := store.queryContext(ctx)
+	defer cancel()
+
+	return getQueuedFeeds(ctx, store.db)
+}
+
+func (store mysqlStore) SetFeedVerified(ctx context.Context, host string, verified bool) error {
+	ctx, cancel := store.queryContext(ctx)
+	defer cancel()
+
+	return setFeedVerified(ctx, store.db, host, verified)
+}
+
+func (store mysqlStore) SetMixedContent(ctx context.Context, host string, mixedContent bool) error {
+	ctx, cancel := store.queryContext(ctx)
+	defer cancel()
+
+	return setMixedContent(ctx, store.db, host, mixedContent)
+}
+
+func (store mysqlStore) SetBrokenTls(ctx context.Context, host string, brokenTls bool) error {
+	ctx, cancel := store.queryContext(ctx)
+	defer cancel()
+
+	return setBrokenTls(ctx, store.db, host, brokenTls)
+}
+
+// Store that reads through to another but only logs the writes it would make, for tuning scoring against live
+// posts without touching the queue
+type dryRunStore struct {
+	Store
+}
+
+func (store dryRunStore) AddSiteToReviewQueue(ctx context.Context, site ExternalPage, score int, scoreDetail map[string]int, rssFeedUrl string, scoreDecay float64) (bool, error) {
+	slog.Info("dry run, would queue", "host", site.queueHost(), "url", site.Url.Link, "score", score, "feed_url", rssFeedUrl)
+	return true, nil
+}
+
+func (store dryRunStore) RecordRejected(ctx context.Context, site ExternalPage, score int, scoreDetail map[string]int) error {
+	slog.Info("dry run, would record rejected page", "host", site.queueHost(), "url", site.Url.Link, "score", score)
+	return nil
+}
+
+func (store dryRunStore) LogFetchFailures(ctx context.Context, runAt time.Time, failedPages []ExternalPage) error {
+	slog.Info("dry run, would log fetch failures", "failed", len(failedPages))
+	return nil
+}
+
+func (store dryRunStore) StorePageHtml(ctx context.Context, site ExternalPage) error {
+	slog.Info("dry run, would store page html", "host", site.queueHost(), "url", site.Url.Link, "bytes", len(site.Html))
+	return nil
+}
+
+func (store dryRunStore) SetPriorFetch(ctx context.Context, host string, prior PriorFetch) error {
+	slog.Info("dry run, would store validators", "host", host, "url", prior.Url, "etag", prior.ETag)
+	return nil
+}
+
+func (store dryRunStore) SetThumbnailUrl(ctx context.Context, host string, thumbnailUrl string) error {
+	slog.Info("dry run, would store thumbnail", "host", host, "thumbnail_url", thumbnailUrl)
+	return nil
+}
+
+func (store dryRunStore) SetMixedContent(ctx context.Context, host string, mixedContent bool) error {
+	slog.Info("dry run, would store mixed content flag", "host", host, "mixed_content", mixedContent)
+	return nil
+}
+
+func (store dryRunStore) SetBrokenTls(ctx context.Context, host string, brokenTls bool) error {
+	slog.Info("dry run, would store broken tls flag", "host", host, "broken_tls", brokenTls)
+	return nil
+}
+
+func (store dryRunStore) SetWatermark(ctx context.Context, postId int64) error {
+	slog.Info("dry run, would move watermark", "post_id", postId)
+	return nil
+}
+
+func (store dryRunStore) SetFeedVerified(ctx context.Context, host string, verified bool) error {
+	slog.Info("dry run, would mark feed", "host", host, "verified", verified)
+	return nil
+}
+
+// Discovers new sites from the links in recent posts, so it can be run by this service's ticker or embedded.
+// Create one with NewDiscoverer and keep it between runs, as it remembers slow hosts, request rates and carried
+// candidates
+type Discoverer struct {
+	Config AppConfig
+	Store  Store
+	Client Doer
+	// Sends requests to the blocklist service and thumbnail lookup, which may be on private hosts Client refuses
+	ServiceClient Doer
+
+	slowHosts         *slowHostTracker
+	hostConcurrency   *hostConcurrencyLimiter
+	hostRates         *hostRateLimiter
+	carriedCandidates *candidateBacklog
+	// Set for a run with scoring.detectBrokenTls, to fetch pages whose certificates don't verify
+	insecureClient Doer
+	// Where output.jsonl prints discoveries, stdout outside tests
+	output io.Writer
+}
+
+type RunResult struct {
+	Posts      int
+	Candidates int
+	Scheduled  int
+	Fetched    int
+	Failed     int
+	// Candidates over crawler.maxCandidatesPerRun, carried over to the next run or dropped
+	Deferred int
+	// Pages that scored below scoring.minScore
+	Rejected int
+	// Pages a conditional request found unchanged, queued again with their previous score
+	Unchanged int
+	// Error pages served as if they were found, see isSoft404
+	Soft404s int
+	Queued   []Discovery
+}
+
+// How long the writes that record a fetched page may take once shutdown has cancelled the run
+const finalWriteTimeout = 10 * time.Second
+
+// A context for recording work already done, which outlives the run's so a page fetched before shutdown is still
+// queued, but not by long
+func writeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), finalWriteTimeout)
+}
+
+func NewDiscoverer(config AppConfig, store Store, client Doer) *Discoverer {
+	return &Discoverer{
+		Config:            config,
+		Store:             store,
+		Client:            client,
+		ServiceClient:     newServiceClient(),
+		slowHosts:         newSlowHostTracker(),
+		hostConcurrency:   newHostConcurrencyLimiter(),
+		hostRates:         newHostRateLimiter(),
+		carriedCandidates: &candidateBacklog{},
+		output:            os.Stdout,
+	}
+}
+
+// Run a single discovery pass over the latest posts
+func (d *Discoverer) Run(ctx context.Context) (result RunResult, err error) {
+	ctx, span := tracer.Start(ctx, "discovery.run")
+
+	defer func() {
+		span.SetAttributes(
+			attribute.Int("posts", result.Posts),
+			attribute.Int("candidates", result.Candidates),
+			attribute.Int("scheduled", result.Scheduled),
+			attribute.Int("fetched", result.Fetched),
+			attribute.Int("queued", len(result.Queued)),
+		)
+
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+
+		span.End()
+	}()
+
+	config := d.Config
+	runAt := time.Now()
+
+	keywords, err := loadKeywords(config.Scoring)
+
+	if err != nil {
+		return result, err
+	}
+
+	scorer, err := newScorer(keywords, config.Scoring)
+
+	if err != nil {
+		return result, err
+	}
+
+	d.insecureClient = nil
+
+	if config.Scoring.DetectBrokenTls {
+		insecureClient := newInsecureCrawlerClient(config.Crawler)
+		defer insecureClient.CloseIdleConnections()
+
+		d.insecureClient = insecureClient
+	}
+
+	// Reuse the Crawl-delays earlier runs read, and keep this run's for the next
+	if config.Crawler.RespectCrawlDelay && config.Crawler.RobotsCacheFile != "" {
+		if err := d.hostRates.loadRobotsCache(config.Crawler); err != nil {
+			slog.Warn("could not load robots cache, fetching robots.txt again", "error", err)
+		}
+
+		defer func() {
+			if err := d.hostRates.saveRobotsCache(config.Crawler); err != nil {
+				slog.Warn("could not save robots cache", "error", err)
+			}
+		}()
+	}
+
+	postsConfig := config.Posts
+
+	if postsConfig.LookbackHours <= 0 {
+		postsConfig.LookbackHours = config.Service.IntervalHours
+	}
+
+	var watermark int64
+
+	if postsConfig.Watermark {
+		watermark, err = d.Store.GetWatermark(ctx)
+
+		if err != nil {
+			return result, fmt.Errorf("error getting watermark: %w", err)
+		}
+	}
+
+	posts, err := d.Store.GetPosts(ctx, postsConfig, watermark)
+
+	if err != nil {
+		return result, fmt.Errorf("error getting posts: %w", err)
+	}
+
+	result.Posts = len(posts)
+
+	var candidates []ExternalUrl
+
+	if len(posts) > 0 {
+		for _, post := range posts {
+			urls, err := getUrlsFromPost(post, config.Filter)
+
+			if err != nil {
+				slog.Error("error getting urls from post", "post_id", post.Id, "error", err)
+			}
+
+			if len(urls) > 0 {
+				candidates = append(candidates, urls...)
+			}
+		}
+	}
+
+	result.Candidates = len(candidates)
+	candidatesExtracted.Add(float64(len(candidates)))
+
+	// Carried candidates come from older posts, so they go after this run's
+	if config.Crawler.CarryOverCandidates {
+		candidates = append(candidates, d.carriedCandidates.take()...)
+	}
+
+	policy, err := buildHostPolicy(ctx, config.Filter, d.Store, d.ServiceClient, time.Duration(config.Crawler.Timeout)*time.Second)
+
+	if err != nil {
+		return result, err
+	}
+
+	// Prospect hosts already scheduled, so each is fetched once however many posts link to it
+	scheduledHosts := make(map[string]struct{})
+
+	scheduledCandidates := d.schedule(ctx, candidates, policy, scheduledHosts)
+
+	if config.Scoring.PreScoreOrder {
+		orderByPreScore(scheduledCandidates, candidates, keywords, config.Filter)
+	}
+
+	var deferredCandidates []ExternalUrl
+	var failedPages []ExternalPage
+	var queuedFeeds []QueuedFeed
+
+	// Hosts queued this run, by canonical host where pages declare one
+	queuedHosts := make(map[string]struct{})
+
+	// Depth 0 is the candidates linked from posts, each later depth the links followed from relevant pages
+	for depth := 0; len(scheduledCandidates) > 0; depth++ {
+		// Followed links come out of the same budget as the posts' links
+		var deferred []ExternalUrl
+		scheduledCandidates, deferred = capCandidates(scheduledCandidates, config.Crawler.MaxCandidatesPerRun, result.Scheduled)
+
+		if len(deferred) > 0 {
+			result.Deferred += len(deferred)
+			deferredCandidates = append(deferredCandidates, deferred...)
+			slog.Warn("reached the most candidates per run", "max_candidates", config.Crawler.MaxCandidatesPerRun, "depth", depth, "deferred", len(deferred), "carried_over", config.Crawler.CarryOverCandidates)
+		}
+
+		if len(scheduledCandidates) == 0 {
+			break
+		}
+
+		result.Scheduled += len(scheduledCandidates)
+
+		if config.Crawler.ConditionalRequests {
+			priorFetches, err := d.Store.GetPriorFetches(ctx, candidateHosts(scheduledCandidates))
+
+			if err != nil {
+				slog.Error("could not read validators, fetching every page in full", "error", err)
+			} else {
+				attachPriorFetches(scheduledCandidates, priorFetches)
+			}
+		}
+
+		fetchedPages, failed, err := d.fetchExternalPages(ctx, scheduledCandidates)
+
+		if err != nil {
+			slog.Error("there was an error fetching external pages", "error", err)
+		}
+
+		result.Fetched += len(fetchedPages)
+		result.Failed += len(failed)
+		failedPages = append(failedPages, failed...)
+
+		var followCandidates []ExternalUrl
+
+		for _, fetchedPage := range fetchedPages {
+			if fetchedPage.NotModified {
+				if discovery, queued := d.queueUnchanged(ctx, fetchedPage, policy, queuedHosts); queued {
+					result.Unchanged++
+					result.Queued = append(result.Queued, discovery)
+				}
+
+				continue
+			}
+
+			fetchedPage.Host = prospectHost(queueUrl(fetchedPage), config.Filter)
+
+			// A redirect can land on a host the policy would never have scheduled
+			if fetchedPage.RedirectedFrom != "" && !isAllowedHost(ctx, policy, fetchedPage) {
+				continue
+			}
+
+			if canonicalUrl := getCanonicalUrl(fetchedPage); canonicalUrl != "" {
+				parsedCanonicalUrl, _ := url.Parse(canonicalUrl)
+				fetchedPage.Host = prospectHost(parsedCanonicalUrl, config.Filter)
+
+				// The page names the host itself, which could be any host
+				if !isAllowedHost(ctx, policy, fetchedPage) {
+					continue
+				}
+			}
+
+			if _, queued := queuedHosts[fetchedPage.Host]; queued {
+				continue
+			}
+
+			queuedHosts[fetchedPage.Host] = struct{}{}
+
+			if isSoft404(fetchedPage, config.Filter) {
+				slog.Debug("page looks like a soft 404, not queueing", "host", fetchedPage.queueHost(), "url", fetchedPage.Url.Link)
+				result.Soft404s++
+				continue
+			}
+
+			relevancy, scoreDetail, err := scorePage(scorer, fetchedPage)
+
+			if err != nil {
+				slog.Error("could not score page", "host", fetchedPage.queueHost(), "url", fetchedPage.Url.Link, "error", err)
+				continue
+			}
+
+			if depth < config.Crawler.FollowDepth && relevancy >= config.Crawler.FollowMinRelevancy {
+				followCandidates = append(followCandidates, getFollowCandidates(fetchedPage, config)...)
+			}
+
+			keywordScore := relevancy + getUrlKeywordScore(fetchedPage, config.Scoring)
+			rssFeedUrl := getRssFeedUrl(fetchedPage)
+
+			if rssFeedUrl == "" && config.Crawler.ProbeFeedPaths {
+				rssFeedUrl = d.probeFeedUrl(ctx, fetchedPage)
+			}
+
+			relevancyScore := getCompositeScore(ScoreComponents{
+				Keywords: keywordScore,
+				HasFeed:  rssFeedUrl != "",
+				Fresh:    isFreshPage(fetchedPage, config.Scoring.FreshnessDays),
+				Articles: getArticleCount(fetchedPage),
+			}, config.Scoring)
+
+			if relevancyScore < config.Scoring.MinScore {
+				slog.Debug("score below minimum, not queueing", "host", fetchedPage.queueHost(), "url", fetchedPage.Url.Link, "score", relevancyScore, "min_score", config.Scoring.MinScore)
+				result.Rejected++
+
+				if config.Output.RecordRejected {
+					writeCtx, cancel := writeContext(ctx)
+					err := d.Store.RecordRejected(writeCtx, fetchedPage, relevancyScore, scoreDetail)
+					cancel()
+
+					if err != nil {
+						slog.Error("could not record rejected page", "host", fetchedPage.queueHost(), "url", fetchedPage.Url.Link, "error", err)
+					}
+				}
+
+				continue
+			}
+
+			discovery := Discovery{
+				Host:             fetchedPage.queueHost(),
+				Score:            relevancyScore,
+				Breakdown:        scoreDetail,
+				FeedUrl:          rssFeedUrl,
+				Title:            getPageTitle(fetchedPage),
+				InsecureRedirect: fetchedPage.InsecureRedirect,
+				BrokenTls:        fetchedPage.BrokenTls,
+			}
+
+			if config.Scoring.DetectMixedContent {
+				discovery.MixedContent = hasMixedContent(fetchedPage)
+			}
+
+			writeCtx, cancel := writeContext(ctx)
+			_, err = d.Store.AddSiteToReviewQueue(writeCtx, fetchedPage, relevancyScore, scoreDetail, rssFeedUrl, config.Scoring.ScoreDecay)
+
+			if err != nil {
+				slog.Error("there was an error adding site to queue", "host", fetchedPage.queueHost(), "url", fetchedPage.Url.Link, "post_id", fetchedPage.Url.PostId, "score", relevancyScore, "error", err)
+				cancel()
+				d.emitDiscovery(discovery, fetchedPage)
+				continue
+			}
+
+			if config.Crawler.ConditionalRequests && (fetchedPage.ETag != "" || !fetchedPage.LastModified.IsZero()) {
+				d.storePriorFetch(writeCtx, fetchedPage, discovery)
+			}
+
+			if config.Output.StoreHtml {
+				err = d.Store.StorePageHtml(writeCtx, fetchedPage)
+
+				if err != nil {
+					slog.Error("could not store page html", "host", discovery.Host, "url", fetchedPage.Url.Link, "error", err)
+				}
+			}
+
+			if config.Scoring.DetectMixedContent {
+				err = d.Store.SetMixedContent(writeCtx, discovery.Host, discovery.MixedContent)
+
+				if err != nil {
+					slog.Error("could not store mixed content flag", "host", discovery.Host, "url", fetchedPage.Url.Link, "error", err)
+				}
+			}
+
+			if fetchedPage.BrokenTls {
+				err = d.Store.SetBrokenTls(writeCtx, discovery.Host, true)
+
+				if err != nil {
+					slog.Error("could not store broken tls flag", "host", discovery.Host, "url", fetchedPage.Url.Link, "error", err)
+				}
+			}
+
+			cancel()
+
+			if config.Thumbnail.Endpoint != "" {
+				discovery.Thumbnail = d.storeThumbnail(ctx, fetchedPage)
+			}
+
+			result.Queued = append(result.Queued, discovery)
+
+			if discovery.FeedUrl != "" {
+				queuedFeeds = append(queuedFeeds, QueuedFeed{Host: discovery.Host, FeedUrl: discovery.FeedUrl})
+			}
+
+			d.emitDiscovery(discovery, fetchedPage)
+		}
+
+		scheduledCandidates = d.schedule(ctx, followCandidates, policy, scheduledHosts)
+
+		if len(scheduledCandidates) > 0 {
+			slog.Info("following links from relevant pages", "depth", depth+1, "scheduled", len(scheduledCandidates))
+		}
+	}
+
+	if config.Crawler.CarryOverCandidates {
+		d.carriedCandidates.keep(deferredCandidates)
+	}
+
+	if config.Output.FailureReportDir != "" && len(failedPages) > 0 {
+		reportPath, err := writeFailureReport(config.Output.FailureReportDir, buildFailureReport(runAt, failedPages))
+
+		if err != nil {
+			slog.Error("could not write failure report", "error", err)
+		} else {
+			slog.Info("wrote failure report", "path", reportPath)
+		}
+	}
+
+	if config.Output.FetchLog && len(failedPages) > 0 {
+		writeCtx, cancel := writeContext(ctx)
+		err := d.Store.LogFetchFailures(writeCtx, runAt, failedPages)
+		cancel()
+
+		if err != nil {
+			slog.Error("could not log fetch failures", "error", err)
+		}
+	}
+
+	if config.Feeds.VerifyOnDiscovery && len(queuedFeeds) > 0 {
+		alive, dead := d.verifyFeeds(ctx, d.Store, queuedFeeds, config.Feeds.MaxConcurrency, config.Crawler.MaxPerHostConcurrency)
+		slog.Info("verified discovered feeds", "alive", alive, "dead", dead)
+	}
+
+	// A run cut short by shutdown leaves the watermark, so its posts are read again by the next one
+	if postsConfig.Watermark && len(posts) > 0 && ctx.Err() == nil {
+		err := d.Store.SetWatermark(ctx, latestPostId(posts))
+
+		if err != nil {
+			slog.Error("could not store watermark", "error", err)
+		}
+	}
+
+	return result, nil
+}
+
+// Whether the policy allows the host a page is queued under, which is checked again once it differs from the
+// candidate's
+func isAllowedHost(ctx context.Context, policy HostPolicy, page ExternalPage) bool {
+	allowed, reason := policy.Allowed(ctx, normalizeHost(page.Host))
+
+	if !allowed {
+		slog.Debug("page is on a host the policy refuses, not queueing", "host", page.Host, "url", page.Url.Link, "reason", reason)
+	}
+
+	return allowed
+}
+
+// The highest post id, 0 when there are no posts
+func latestPostId(posts []Post) int64 {
+	var latest int64
+
+	for _, post := range posts {
+		if post.Id > latest {
+			latest = post.Id
+		}
+	}
+
+	return latest
+}
+
+// Queue a page found unchanged since its last fetch again, with the score and feed it was queued with then
+func (d *Discoverer) queueUnchanged(ctx context.Context, page ExternalPage, policy HostPolicy, queuedHosts map[string]struct{}) (Discovery, bool) {
+	prior := page.Url.Prior
+	page.Host = prior.Host
+
+	if _, queued := queuedHosts[page.Host]; queued {
+		return Discovery{}, false
+	}
+
+	// The host was queued under last time, which may have been blacklisted since
+	if !isAllowedHost(ctx, policy, page) {
+		return Discovery{}, false
+	}
+
+	queuedHosts[page.Host] = struct{}{}
+
+	slog.Debug("page unchanged since last fetch, reusing its score", "host", page.Host, "url", page.Url.Link, "score", prior.Score)
+
+	writeCtx, cancel := writeContext(ctx)
+	defer cancel()
+
+	_, err := d.Store.AddSiteToReviewQueue(writeCtx, page, prior.Score, prior.ScoreDetail, prior.FeedUrl, d.Config.Scoring.ScoreDecay)
+
+	if err != nil {
+		slog.Error("there was an error adding site to queue", "host", page.Host, "url", page.Url.Link, "post_id", page.Url.PostId, "score", prior.Score, "error", err)
+		return Discovery{}, false
+	}
+
+	discovery := Discovery{
+		Host:      page.Host,
+		Score:     prior.Score,
+		Breakdown: prior.ScoreDetail,
+		FeedUrl:   prior.FeedUrl,
+	}
+
+	d.emitDiscovery(discovery, page)
+
+	return discovery, true
+}
+
+// Keep the validators of a queued page, keyed by the host it was linked on, for fetching it conditionally next time
+func (d *Discoverer) storePriorFetch(ctx context.Context, page ExternalPage, discovery Discovery) {
+	link := requestedLink(page)
+	linkUrl, err := url.Parse(link)
+
+	if err != nil {
+		return
+	}
+
+	err = d.Store.SetPriorFetch(ctx, normalizeHost(linkUrl.Host), PriorFetch{
+		Url:          link,
+		ETag:         page.ETag,
+		LastModified: page.LastModified,
+		Host:         discovery.Host,
+		Score:        discovery.Score,
+		ScoreDetail:  discovery.Breakdown,
+		FeedUrl:      discovery.FeedUrl,
+	})
+
+	if err != nil {
+		slog.Error("could not store validators", "host", discovery.Host, "url", link, "error", err)
+	}
+}
+
+// The candidates worth fetching: allowed by the host policy, not on a host that has been too slow, and not on a
+// prospect host already scheduled this run
+func (d *Discoverer) schedule(ctx context.Context, candidates []ExternalUrl, policy HostPolicy, scheduledHosts map[string]struct{}) []ExternalUrl {
+	config := d.Config
+
+	var scheduledCandidates []ExternalUrl
+
+	for _, candidate := range candidates {
+		if config.Crawler.SlowResponseMs > 0 {
+			tooSlow, timing := d.slowHosts.isTooSlow(candidate.Url.Host, config.Crawler.SlowResponseStrikes)
+
+			if tooSlow {
+				slog.Info("skipping slow host", "host", candidate.Url.Host, "last", timing.Last, "average", timing.Average)
+				continue
+			}
+		}
+
+		allowed, _ := policy.Allowed(ctx, normalizeHost(candidate.Url.Host))
+
+		if allowed {
+			scheduledHost := prospectHost(candidate.Url, config.Filter)
+
+			if _, scheduled := scheduledHosts[scheduledHost]; scheduled {
+				continue
+			}
+
+			scheduledHosts[scheduledHost] = struct{}{}
+			scheduledCandidates = append(scheduledCandidates, candidate)
+		}
+	}
+
+	return scheduledCandidates
+}
+
+// The outbound links of a relevant page, extracted as if it were a post, credited to the post that led to it
+func getFollowCandidates(site ExternalPage, config AppConfig) []ExternalUrl {
+	links, err := getUrlsFromPost(Post{Id: site.Url.PostId, Url: site.Url.Link, Body: string(site.Html)}, config.Filter)
+
+	if err != nil {
+		slog.Warn("could not get links to follow", "host", site.queueHost(), "url", site.Url.Link, "error", err)
+		return nil
+	}
+
+	if config.Crawler.FollowMaxLinks > 0 && len(links) > config.Crawler.FollowMaxLinks {
+		links = links[:config.Crawler.FollowMaxLinks]
+	}
+
+	return links
+}
+
+// Print the discovery as a JSON line when output.jsonl is set. The output doesn't depend on the database, so
+// discoveries that couldn't be queued are printed too
+func (d *Discoverer) emitDiscovery(discovery Discovery, page ExternalPage) {
+	if !d.Config.Output.Jsonl {
+		return
+	}
+
+	err := emitDiscovery(d.output, discovery)
+
+	if err != nil {
+		slog.Error("could not write discovery to stdout", "host", discovery.Host, "url", page.Url.Link, "error", err)
+	}
+}
+
+// Thumbnails are best-effort: failures are logged and never stop a prospect being queued
+func (d *Discoverer) storeThumbnail(ctx context.Context, site ExternalPage) string {
+	thumbnailUrl, err := fetchThumbnailUrl(ctx, d.ServiceClient, d.Config.Thumbnail, site.Url.Link)
+
+	if err != nil {
+		slog.Warn("could not get thumbnail", "host", site.queueHost(), "url", site.Url.Link, "error", err)
+		return ""
+	}
+
+	if thumbnailUrl == "" {
+		return ""
+	}
+
+	err = d.Store.SetThumbnailUrl(ctx, site.queueHost(), thumbnailUrl)
+
+	if err != nil {
+		slog.Error("could not store thumbnail", "host", site.queueHost(), "url", site.Url.Link, "error", err)
+		return ""
+	}
+
+	return thumbnailUrl
+}
@@ -0,0 +1,767 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An in-memory Store, which records what was written and whether the run's context was already cancelled by then
+type fakeStore struct {
+	mu sync.Mutex
+
+	posts       []Post
+	blacklisted map[string]bool
+	priors      map[string]PriorFetch
+
+	queued       []string
+	decays       []float64
+	rejected     []string
+	loggedFails  int
+	watermark    int64
+	cancelledOn  []string
+	onQueue      func()
+	queueFailure error
+	brokenTls    map[string]bool
+	thumbnails   map[string]string
+}
+
+func (store *fakeStore) write(ctx context.Context, name string) {
+	if ctx.Err() != nil {
+		store.cancelledOn = append(store.cancelledOn, name)
+	}
+}
+
+func (store *fakeStore) GetPosts(ctx context.Context, postsConfig PostsConfig, afterPostId int64) ([]Post, error) {
+	return store.posts, nil
+}
+
+func (store *fakeStore) GetWatermark(ctx context.Context) (int64, error) {
+	return store.watermark, nil
+}
+
+func (store *fakeStore) SetWatermark(ctx context.Context, postId int64) error {
+	store.watermark = postId
+	return nil
+}
+
+func (store *fakeStore) IsInBlacklist(ctx context.Context, host string) (bool, error) {
+	return store.blacklisted[normalizeHost(host)], nil
+}
+
+func (store *fakeStore) GetBlacklistedHosts(ctx context.Context) (map[string]bool, error) {
+	return store.blacklisted, nil
+}
+
+func (store *fakeStore) AddSiteToReviewQueue(ctx context.Context, site ExternalPage, score int, scoreDetail map[string]int, rssFeedUrl string, scoreDecay float64) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.write(ctx, "queue")
+
+	if store.queueFailure != nil {
+		return false, store.queueFailure
+	}
+
+	store.queued = append(store.queued, site.queueHost())
+	store.decays = append(store.decays, scoreDecay)
+
+	if store.onQueue != nil {
+		store.onQueue()
+	}
+
+	return true, nil
+}
+
+func (store *fakeStore) SetThumbnailUrl(ctx context.Context, host string, thumbnailUrl string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.thumbnails == nil {
+		store.thumbnails = make(map[string]string)
+	}
+
+	store.thumbnails[host] = thumbnailUrl
+
+	return nil
+}
+
+func (store *fakeStore) SetMixedContent(ctx context.Context, host string, mixedContent bool) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.write(ctx, "mixed content")
+
+	return nil
+}
+
+func (store *fakeStore) SetBrokenTls(ctx context.Context, host string, brokenTls bool) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.write(ctx, "broken tls")
+
+	if store.brokenTls == nil {
+		store.brokenTls = make(map[string]bool)
+	}
+
+	store.brokenTls[host] = brokenTls
+
+	return nil
+}
+
+func (store *fakeStore) RecordRejected(ctx context.Context, site ExternalPage, score int, scoreDetail map[string]int) error {
+	store.write(ctx, "rejected")
+	store.rejected = append(store.rejected, site.queueHost())
+	return nil
+}
+
+func (store *fakeStore) LogFetchFailures(ctx context.Context, runAt time.Time, failedPages []ExternalPage) error {
+	store.write(ctx, "fetch log")
+	store.loggedFails += len(failedPages)
+	return nil
+}
+
+func (store *fakeStore) StorePageHtml(ctx context.Context, site ExternalPage) error {
+	store.write(ctx, "html")
+	return nil
+}
+
+func (store *fakeStore) GetPriorFetches(ctx context.Context, hosts []string) (map[string]PriorFetch, error) {
+	return store.priors, nil
+}
+
+func (store *fakeStore) SetPriorFetch(ctx context.Context, host string, prior PriorFetch) error {
+	store.write(ctx, "validators")
+
+	if store.priors == nil {
+		store.priors = make(map[string]PriorFetch)
+	}
+
+	store.priors[host] = prior
+	return nil
+}
+
+func (store *fakeStore) SetFeedVerified(ctx context.Context, host string, verified bool) error {
+	return nil
+}
+
+// Settings for running a Discoverer against httptest servers
+func testDiscovererConfig() AppConfig {
+	config := defaultConfig()
+	config.Crawler = testCrawlerConfig()
+	config.Filter.SkipIpHosts = false
+	config.Scoring.MinScore = 0
+
+	return config
+}
+
+// A Discoverer for calling the fetch functions directly
+func testDiscoverer(client Doer, crawler CrawlerConfig) *Discoverer {
+	config := testDiscovererConfig()
+	config.Crawler = crawler
+
+	return NewDiscoverer(config, &fakeStore{}, client)
+}
+
+// A post linking to each path, all on the server's host
+func testPost(id int64, serverUrl string, paths ...string) Post {
+	body := ""
+
+	for _, path := range paths {
+		body += fmt.Sprintf(`<a href="%s%s">link</a> `, serverUrl, path)
+	}
+
+	return Post{Id: id, Url: "https://aggregator.example/post", Body: body}
+}
+
+// Serves every request from handler whatever its host, for runs over hosts that don't resolve
+type handlerDoer struct {
+	handler http.Handler
+}
+
+func (doer handlerDoer) Do(req *http.Request) (*http.Response, error) {
+	recorder := httptest.NewRecorder()
+	doer.handler.ServeHTTP(recorder, req)
+
+	response := recorder.Result()
+	response.Request = req
+
+	return response, nil
+}
+
+func TestRunWritesAfterShutdown(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = fmt.Fprint(w, `<html><head><title>Anime</title></head><body>anime manga</body></html>`)
+	}))
+	defer server.Close()
+
+	// On a host of its own, as the scheduler fetches one page per host
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+
+	missingUrl := strings.Replace(missing.URL, "127.0.0.1", "localhost", 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Shutdown arrives while the first page is being queued
+	store := &fakeStore{onQueue: cancel}
+	store.posts = []Post{testPost(5, server.URL, "/page"), testPost(4, missingUrl, "/gone")}
+
+	config := testDiscovererConfig()
+	config.Crawler.ConditionalRequests = true
+	config.Output.StoreHtml = true
+	config.Output.FetchLog = true
+	config.Posts.Watermark = true
+	config.Scoring.DetectMixedContent = true
+
+	result, err := NewDiscoverer(config, store, server.Client()).Run(ctx)
+
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	if len(result.Queued) != 1 {
+		t.Fatalf("queued %d pages, want 1", len(result.Queued))
+	}
+
+	if len(store.cancelledOn) > 0 {
+		t.Errorf("writes made with a cancelled context: %v", store.cancelledOn)
+	}
+
+	if store.priors == nil || store.loggedFails != 1 {
+		t.Errorf("validators stored = %v, failures logged = %d", store.priors != nil, store.loggedFails)
+	}
+
+	if store.watermark != 0 {
+		t.Errorf("watermark moved to %d by a cancelled run", store.watermark)
+	}
+}
+
+func TestFetchCancelledInFlight(t *testing.T) {
+	started := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	candidate := testPage(server.URL+"/slow", 1).Url
+	pages := testDiscoverer(server.Client(), testCrawlerConfig()).fetchExternalPageBatch(ctx, []ExternalUrl{candidate})
+
+	if pages[0].Failure != failureCancelled || pages[0].Unreachable {
+		t.Errorf("failure = %q, unreachable = %v, want %q", pages[0].Failure, pages[0].Unreachable, failureCancelled)
+	}
+}
+
+func TestRunChecksRedirectedHost(t *testing.T) {
+	page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = fmt.Fprint(w, `<html><head><title>Anime</title></head><body>anime</body></html>`)
+	}))
+	defer page.Close()
+
+	// Redirects from 127.0.0.1 to the page on localhost, so the page ends up on another host
+	pageUrl := strings.Replace(page.URL, "127.0.0.1", "localhost", 1)
+
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, pageUrl+"/landing", http.StatusFound)
+	}))
+	defer redirect.Close()
+
+	tests := []struct {
+		name      string
+		skipHosts []string
+		want      int
+	}{
+		{name: "redirect to an allowed host", want: 1},
+		{name: "redirect to a skipped host", skipHosts: []string{"localhost"}, want: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := &fakeStore{posts: []Post{testPost(1, redirect.URL, "/start")}}
+
+			config := testDiscovererConfig()
+			config.Filter.SkipHosts = test.skipHosts
+
+			result, err := NewDiscoverer(config, store, newCrawlerClient(config.Crawler)).Run(context.Background())
+
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			if len(store.queued) != test.want {
+				t.Errorf("queued %v, want %d hosts", store.queued, test.want)
+			}
+
+			if result.Fetched != 1 {
+				t.Errorf("fetched %d pages, want 1", result.Fetched)
+			}
+		})
+	}
+}
+
+func TestRunChecksCanonicalHost(t *testing.T) {
+	tests := []struct {
+		name        string
+		canonical   string
+		blacklisted map[string]bool
+		want        []string
+	}{
+		{name: "no canonical", want: []string{"127.0.0.1"}},
+		{name: "canonical host", canonical: "https://www.blog.example/", want: []string{"blog.example"}},
+		{name: "blacklisted canonical host", canonical: "https://blog.example/", blacklisted: map[string]bool{"blog.example": true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				_, _ = fmt.Fprintf(w, `<html><head><link rel="canonical" href="%s"></head><body>anime</body></html>`, test.canonical)
+			}))
+			defer server.Close()
+
+			store := &fakeStore{posts: []Post{testPost(1, server.URL, "/page")}, blacklisted: test.blacklisted}
+
+			_, err := NewDiscoverer(testDiscovererConfig(), store, server.Client()).Run(context.Background())
+
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			if fmt.Sprint(store.queued) != fmt.Sprint(test.want) {
+				t.Errorf("queued %v, want %v", store.queued, test.want)
+			}
+		})
+	}
+}
+
+func TestRunChecksUnchangedHost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		blacklisted map[string]bool
+		want        []string
+	}{
+		{name: "prior host allowed", want: []string{"blog.example"}},
+		{name: "prior host blacklisted since", blacklisted: map[string]bool{"blog.example": true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			link := server.URL + "/page"
+			store := &fakeStore{
+				posts:       []Post{testPost(1, server.URL, "/page")},
+				blacklisted: test.blacklisted,
+				priors: map[string]PriorFetch{
+					"127.0.0.1": {Url: link, ETag: `"v1"`, Host: "blog.example", Score: 12},
+				},
+			}
+
+			config := testDiscovererConfig()
+			config.Crawler.ConditionalRequests = true
+			config.Output.Jsonl = true
+
+			var output bytes.Buffer
+
+			discoverer := NewDiscoverer(config, store, server.Client())
+			discoverer.output = &output
+
+			_, err := discoverer.Run(context.Background())
+
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			if fmt.Sprint(store.queued) != fmt.Sprint(test.want) {
+				t.Errorf("queued %v, want %v", store.queued, test.want)
+			}
+
+			// Unchanged prospects are written out like any other discovery
+			var emitted []string
+
+			for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+				var discovery Discovery
+
+				if line != "" && json.Unmarshal([]byte(line), &discovery) == nil && discovery.Score == 12 {
+					emitted = append(emitted, discovery.Host)
+				}
+			}
+
+			if fmt.Sprint(emitted) != fmt.Sprint(test.want) {
+				t.Errorf("emitted %v, want %v", emitted, test.want)
+			}
+		})
+	}
+}
+
+func TestDiscoverersKeepTheirOwnState(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = fmt.Fprint(w, `<html><head><title>Anime</title></head><body>anime</body></html>`)
+	}))
+	defer server.Close()
+
+	otherHost := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+	config := testDiscovererConfig()
+	config.Crawler.MaxCandidatesPerRun = 1
+	config.Crawler.CarryOverCandidates = true
+
+	first := NewDiscoverer(config, &fakeStore{posts: []Post{testPost(1, server.URL, "/a"), testPost(2, otherHost, "/b")}}, server.Client())
+
+	result, err := first.Run(context.Background())
+
+	if err != nil || result.Deferred != 1 {
+		t.Fatalf("first Run() deferred %d, error = %v, want 1 deferred", result.Deferred, err)
+	}
+
+	tests := []struct {
+		name       string
+		discoverer *Discoverer
+		want       int
+	}{
+		{name: "another discoverer starts empty", discoverer: NewDiscoverer(config, &fakeStore{}, server.Client()), want: 0},
+		{name: "the same discoverer carries its candidates", discoverer: first, want: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.discoverer.Store = &fakeStore{}
+
+			result, err := test.discoverer.Run(context.Background())
+
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			if result.Scheduled != test.want {
+				t.Errorf("scheduled %d carried candidates, want %d", result.Scheduled, test.want)
+			}
+		})
+	}
+}
+
+func TestRunCapsFollowedLinks(t *testing.T) {
+	var otherHost string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = fmt.Fprintf(w, `<html><head><title>Anime</title></head><body>anime <a href="%s/b">more</a></body></html>`, otherHost)
+	}))
+	defer server.Close()
+
+	otherHost = strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+	tests := []struct {
+		name          string
+		maxCandidates int
+		wantScheduled int
+		wantDeferred  int
+	}{
+		{name: "no limit", maxCandidates: 0, wantScheduled: 2},
+		{name: "budget spent on the posts' links", maxCandidates: 1, wantScheduled: 1, wantDeferred: 1},
+		{name: "budget left for followed links", maxCandidates: 2, wantScheduled: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testDiscovererConfig()
+			config.Crawler.FollowDepth = 1
+			config.Crawler.FollowMinRelevancy = 0
+			config.Crawler.MaxCandidatesPerRun = test.maxCandidates
+
+			store := &fakeStore{posts: []Post{testPost(1, server.URL, "/a")}}
+			result, err := NewDiscoverer(config, store, server.Client()).Run(context.Background())
+
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			if result.Scheduled != test.wantScheduled || result.Deferred != test.wantDeferred {
+				t.Errorf("scheduled %d and deferred %d, want %d and %d", result.Scheduled, result.Deferred, test.wantScheduled, test.wantDeferred)
+			}
+		})
+	}
+}
+
+func TestRunFlagsBrokenTls(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = fmt.Fprint(w, `<html><head><title>Anime</title></head><body>anime</body></html>`)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name          string
+		detect        bool
+		wantQueued    int
+		wantBrokenTls bool
+	}{
+		{name: "skipped without detection", detect: false, wantQueued: 0},
+		{name: "fetched without verifying and flagged", detect: true, wantQueued: 1, wantBrokenTls: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testDiscovererConfig()
+			config.Scoring.DetectBrokenTls = test.detect
+
+			store := &fakeStore{posts: []Post{testPost(1, server.URL, "/a")}}
+			result, err := NewDiscoverer(config, store, newCrawlerClient(config.Crawler)).Run(context.Background())
+
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			if len(store.queued) != test.wantQueued {
+				t.Fatalf("queued %v, want %d", store.queued, test.wantQueued)
+			}
+
+			if test.wantQueued > 0 && (store.brokenTls[store.queued[0]] != test.wantBrokenTls || result.Queued[0].BrokenTls != test.wantBrokenTls) {
+				t.Errorf("broken tls stored %v, discovery %v, want %v", store.brokenTls, result.Queued[0].BrokenTls, test.wantBrokenTls)
+			}
+		})
+	}
+}
+
+func TestRunEmitsJsonl(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = fmt.Fprint(w, `<html><head><title>Anime</title><link rel="alternate" type="application/rss+xml" href="/feed"></head><body>anime</body></html>`)
+	}))
+	defer server.Close()
+
+	otherHost := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+	tests := []struct {
+		name         string
+		queueFailure error
+		wantQueued   int
+	}{
+		{name: "queued", wantQueued: 2},
+		{name: "database write fails", queueFailure: errors.New("database gone"), wantQueued: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testDiscovererConfig()
+			config.Output.Jsonl = true
+
+			store := &fakeStore{
+				posts:        []Post{testPost(1, server.URL, "/a"), testPost(2, otherHost, "/b")},
+				queueFailure: test.queueFailure,
+			}
+
+			var output bytes.Buffer
+			discoverer := NewDiscoverer(config, store, server.Client())
+			discoverer.output = &output
+
+			result, err := discoverer.Run(context.Background())
+
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			if len(result.Queued) != test.wantQueued {
+				t.Errorf("queued %d, want %d", len(result.Queued), test.wantQueued)
+			}
+
+			lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+
+			if len(lines) != 2 {
+				t.Fatalf("printed %d lines, want one per discovery: %q", len(lines), output.String())
+			}
+
+			for _, line := range lines {
+				var discovery Discovery
+
+				if err := json.Unmarshal([]byte(line), &discovery); err != nil {
+					t.Fatalf("line %q is not json: %v", line, err)
+				}
+
+				if discovery.Host == "" || discovery.Title != "Anime" || !strings.HasSuffix(discovery.FeedUrl, "/feed") || discovery.Breakdown == nil {
+					t.Errorf("discovery = %+v, want host, title, feed and breakdown", discovery)
+				}
+			}
+		})
+	}
+}
+
+func TestRunScoresUrlKeywords(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = fmt.Fprint(w, `<html><head><title>Blog</title></head><body>Hello</body></html>`)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		urlKeywords []string
+		wantScore   int
+	}{
+		{name: "keyword in the path", urlKeywords: []string{"anime"}, wantScore: 3},
+		{name: "keyword elsewhere", urlKeywords: []string{"manga"}, wantScore: 0},
+		{name: "no url keywords", wantScore: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testDiscovererConfig()
+			config.Output.Jsonl = true
+			config.Scoring.UrlKeywords = test.urlKeywords
+			config.Scoring.UrlKeywordWeight = 3
+
+			var output bytes.Buffer
+			discoverer := NewDiscoverer(config, &fakeStore{posts: []Post{testPost(1, server.URL, "/anime-reviews/")}}, server.Client())
+			discoverer.output = &output
+
+			if _, err := discoverer.Run(context.Background()); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			var discovery Discovery
+
+			if err := json.Unmarshal(output.Bytes(), &discovery); err != nil {
+				t.Fatalf("output %q is not one discovery: %v", output.String(), err)
+			}
+
+			if discovery.Score != test.wantScore {
+				t.Errorf("score = %d, want %d", discovery.Score, test.wantScore)
+			}
+		})
+	}
+}
+
+func TestRunCollapsesSubdomains(t *testing.T) {
+	doer := handlerDoer{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = fmt.Fprint(w, `<html><head><title>Anime</title></head><body>anime</body></html>`)
+	})}
+
+	post := Post{
+		Id:   1,
+		Url:  "https://aggregator.example/post",
+		Body: `<a href="https://blog.example.com/">blog</a> <a href="https://www.example.com/">www</a> <a href="https://example.com/about">bare</a>`,
+	}
+
+	tests := []struct {
+		name      string
+		collapse  bool
+		wantHosts []string
+	}{
+		{name: "collapsed", collapse: true, wantHosts: []string{"example.com"}},
+		{name: "subdomains kept", collapse: false, wantHosts: []string{"blog.example.com", "example.com"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testDiscovererConfig()
+			config.Filter.CollapseSubdomains = test.collapse
+
+			store := &fakeStore{posts: []Post{post}}
+			result, err := NewDiscoverer(config, store, doer).Run(context.Background())
+
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			var hosts []string
+
+			for _, discovery := range result.Queued {
+				hosts = append(hosts, discovery.Host)
+			}
+
+			sort.Strings(hosts)
+
+			if strings.Join(hosts, " ") != strings.Join(test.wantHosts, " ") {
+				t.Errorf("queued %v, want %v", hosts, test.wantHosts)
+			}
+		})
+	}
+}
+
+func TestRunReachesPrivateServiceEndpoints(t *testing.T) {
+	// Both services listen on loopback, which the crawler refuses
+	policyService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed := r.URL.Query().Get("host") != "spam.example"
+		_ = json.NewEncoder(w).Encode(map[string]any{"allowed": allowed, "reason": "known spam"})
+	}))
+	defer policyService.Close()
+
+	thumbnailService, _ := stubThumbnailService(t, http.StatusOK, `{"url": "https://thumbs.example/blog.png"}`)
+
+	pages := handlerDoer{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = fmt.Fprint(w, `<html><head><title>Anime</title></head><body>anime</body></html>`)
+	})}
+
+	tests := []struct {
+		name          string
+		thumbnail     bool
+		policy        bool
+		wantQueued    []string
+		wantThumbnail string
+	}{
+		{name: "blocklist service", policy: true, wantQueued: []string{"blog.example"}},
+		{name: "thumbnail service", thumbnail: true, wantQueued: []string{"blog.example", "spam.example"}, wantThumbnail: "https://thumbs.example/blog.png"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testDiscovererConfig()
+			config.Crawler.AllowPrivateHosts = false
+
+			if test.policy {
+				config.Filter.HostPolicies = []string{"http"}
+				config.Filter.BlocklistEndpoint = policyService.URL + "/check"
+			}
+
+			if test.thumbnail {
+				config.Thumbnail = ThumbnailConfig{Endpoint: thumbnailService.URL, Timeout: 5}
+			}
+
+			body := `<a href="https://blog.example/">a</a> <a href="https://spam.example/">b</a>`
+			store := &fakeStore{posts: []Post{{Id: 1, Url: "https://aggregator.example/post", Body: body}}}
+
+			if _, err := NewDiscoverer(config, store, pages).Run(context.Background()); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			sort.Strings(store.queued)
+
+			if strings.Join(store.queued, " ") != strings.Join(test.wantQueued, " ") {
+				t.Errorf("queued %v, want %v", store.queued, test.wantQueued)
+			}
+
+			if got := store.thumbnails["blog.example"]; got != test.wantThumbnail {
+				t.Errorf("thumbnail = %q, want %q", got, test.wantThumbnail)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"io"
+	"log/slog"
+	"strings"
+	"unicode/utf8"
+)
+
+// Unwrap a gzip or deflate compressed response body. We ask for gzip, which turns off the transport's own
+// decompression, but servers may also ignore that, answer with deflate, or send gzip without saying so
+func decompressBody(body io.Reader, contentEncoding string) (io.Reader, error) {
+	buffered := bufio.NewReader(body)
+
+	// An empty body labelled gzip has no header to read, which gzip.NewReader would report as io.EOF
+	if _, err := buffered.Peek(1); err == io.EOF {
+		return buffered, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(buffered)
+	case "deflate":
+		// Deflate is meant to be zlib wrapped, but plenty of servers send the raw stream
+		header, err := buffered.Peek(2)
+
+		if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			return zlib.NewReader(buffered)
+		}
+
+		return flate.NewReader(buffered), nil
+	}
+
+	magic, err := buffered.Peek(2)
+
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(buffered)
+	}
+
+	return buffered, nil
+}
+
+// Convert a fetched page body to UTF-8. A charset declared by a BOM, the Content-Type header or a <meta> tag is
+// always honoured; when none is declared and the bytes aren't recognisably UTF-8, the first of the detect charsets
+// the page decodes cleanly in is used, then the configured default
+func decodeToUtf8(body []byte, contentType string, crawler CrawlerConfig, link string) []byte {
+	e, name, certain := charset.DetermineEncoding(body, contentType)
+
+	// The prescan only reads the first 1024 bytes, so a <meta> charset further into a long head is found here instead
+	if !certain {
+		if declared := metaCharset(body); declared != "" {
+			if declaredEncoding, declaredName := charset.Lookup(declared); declaredEncoding != nil {
+				return decodeWith(declaredEncoding, declaredName, body, link)
+			}
+
+			return decodeWith(e, name, body, link)
+		}
+	}
+
+	if !certain && name != "utf-8" {
+		if detected, detectedName := detectCharset(body, crawler.DetectCharsets); detected != nil {
+			slog.Debug("no charset declared, detected one", "charset", detectedName, "url", link)
+			return decodeWith(detected, detectedName, body, link)
+		}
+
+		defaultCharset := crawler.DefaultCharset
+		fallback, fallbackName := charset.Lookup(defaultCharset)
+
+		if fallback == nil {
+			slog.Warn("unknown default charset, leaving page undecoded", "charset", defaultCharset, "url", link)
+			return body
+		}
+
+		slog.Debug("no charset declared, falling back to default", "charset", fallbackName, "url", link)
+		e = fallback
+	}
+
+	return decodeWith(e, name, body, link)
+}
+
+func decodeWith(e encoding.Encoding, name string, body []byte, link string) []byte {
+	decoded, err := e.NewDecoder().Bytes(body)
+
+	if err != nil {
+		slog.Warn("could not decode page body", "charset", name, "url", link, "error", err)
+		return body
+	}
+
+	return decoded
+}
+
+// The first of the candidate charsets that decodes the page without any invalid sequences
+func detectCharset(body []byte, candidates []string) (encoding.Encoding, string) {
+	for _, candidate := range candidates {
+		e, name := charset.Lookup(candidate)
+
+		if e == nil {
+			continue
+		}
+
+		decoded, err := e.NewDecoder().Bytes(body)
+
+		if err == nil && !bytes.ContainsRune(decoded, utf8.RuneError) {
+			return e, name
+		}
+	}
+
+	return nil, ""
+}
+
+// Find a charset declared by <meta charset> or <meta http-equiv="Content-Type"> in the document head
+func metaCharset(body []byte) string {
+	tokenizer := html.NewTokenizer(bytes.NewReader(body))
+
+	for {
+		tokenType := tokenizer.Next()
+
+		if tokenType == html.ErrorToken {
+			return ""
+		}
+
+		if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+			continue
+		}
+
+		token := tokenizer.Token()
+
+		if token.Data == "body" {
+			return ""
+		}
+
+		if token.Data != "meta" {
+			continue
+		}
+
+		isContentType := false
+		content := ""
+
+		for _, attr := range token.Attr {
+			switch strings.ToLower(attr.Key) {
+			case "charset":
+				return strings.TrimSpace(attr.Val)
+			case "http-equiv":
+				isContentType = strings.EqualFold(attr.Val, "content-type")
+			case "content":
+				content = attr.Val
+			}
+		}
+
+		if isContentType {
+			if i := strings.Index(strings.ToLower(content), "charset="); i >= 0 {
+				return strings.Trim(strings.TrimSpace(content[i+len("charset="):]), `"'`)
+			}
+		}
+	}
+}
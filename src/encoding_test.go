@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"io"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/japanese"
+)
+
+func TestDecodeToUtf8(t *testing.T) {
+	// Pushes a <meta> charset past the 1024 bytes charset.DetermineEncoding prescans
+	longHead := "<!--" + strings.Repeat(" ", 1100) + "-->"
+
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		want        string
+	}{
+		{name: "utf-8 unchanged", body: "<p>café</p>", contentType: "text/html; charset=utf-8", want: "<p>café</p>"},
+		{name: "header charset", body: "<p>caf\xe9</p>", contentType: "text/html; charset=iso-8859-1", want: "<p>café</p>"},
+		{name: "meta charset", body: `<meta charset="iso-8859-7"><p>` + "\xe1</p>", contentType: "text/html", want: `<meta charset="iso-8859-7"><p>α</p>`},
+		{
+			name:        "meta charset after the prescan",
+			body:        "<html><head>" + longHead + `<meta charset="iso-8859-7"></head><p>` + "\xe1</p>",
+			contentType: "text/html",
+			want:        "<html><head>" + longHead + `<meta charset="iso-8859-7"></head><p>` + "α</p>",
+		},
+		{name: "header wins over meta", body: `<meta charset="iso-8859-7"><p>caf` + "\xe9</p>", contentType: "text/html; charset=iso-8859-1", want: `<meta charset="iso-8859-7"><p>caf` + "é</p>"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := decodeToUtf8([]byte(test.body), test.contentType, defaultConfig().Crawler, "https://blog.example/")
+
+			if string(got) != test.want {
+				t.Errorf("decodeToUtf8() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeToUtf8DefaultCharset(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		defaultCharset string
+		want           string
+	}{
+		{name: "windows-1252", body: "<p>caf\xe9</p>", defaultCharset: "windows-1252", want: "<p>café</p>"},
+		{name: "iso-8859-7", body: "<p>\xe1\xe2</p>", defaultCharset: "iso-8859-7", want: "<p>αβ</p>"},
+		{name: "valid utf-8 ignores the default", body: "<p>café</p>", defaultCharset: "iso-8859-7", want: "<p>café</p>"},
+		{name: "unknown default", body: "<p>caf\xe9</p>", defaultCharset: "no-such-charset", want: "<p>caf\xe9</p>"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			crawler := defaultConfig().Crawler
+			crawler.DetectCharsets = nil
+			crawler.DefaultCharset = test.defaultCharset
+
+			got := decodeToUtf8([]byte(test.body), "text/html", crawler, "https://blog.example/")
+
+			if string(got) != test.want {
+				t.Errorf("decodeToUtf8() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestShiftJisPages(t *testing.T) {
+	text := "アニメのレビュー"
+	shiftJis, err := japanese.ShiftJIS.NewEncoder().String(text)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crawler := defaultConfig().Crawler
+	crawler.DetectCharsets = []string{"shift_jis", "euc-jp"}
+
+	t.Run("detectCharset", func(t *testing.T) {
+		if _, name := detectCharset([]byte(shiftJis), crawler.DetectCharsets); name != "shift_jis" {
+			t.Errorf("detectCharset() = %q, want shift_jis", name)
+		}
+	})
+
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		detect      []string
+		want        string
+	}{
+		{name: "header charset", body: "<p>" + shiftJis + "</p>", contentType: "text/html; charset=Shift_JIS", want: "<p>" + text + "</p>"},
+		{name: "meta charset", body: `<meta charset="shift_jis"><p>` + shiftJis + "</p>", contentType: "text/html", want: `<meta charset="shift_jis"><p>` + text + "</p>"},
+		{name: "detected", body: "<p>" + shiftJis + "</p>", contentType: "text/html", detect: crawler.DetectCharsets, want: "<p>" + text + "</p>"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			detectCrawler := crawler
+			detectCrawler.DetectCharsets = test.detect
+
+			got := decodeToUtf8([]byte(test.body), test.contentType, detectCrawler, "https://blog.example.jp/")
+
+			if string(got) != test.want {
+				t.Errorf("decodeToUtf8() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDecompressBody(t *testing.T) {
+	page := []byte("<html><head><title>Anime</title></head><body>anime</body></html>")
+
+	var zlibBody, flateBody bytes.Buffer
+	zlibWriter := zlib.NewWriter(&zlibBody)
+	_, _ = zlibWriter.Write(page)
+	_ = zlibWriter.Close()
+	flateWriter, _ := flate.NewWriter(&flateBody, flate.DefaultCompression)
+	_, _ = flateWriter.Write(page)
+	_ = flateWriter.Close()
+
+	tests := []struct {
+		name            string
+		body            []byte
+		contentEncoding string
+		want            []byte
+	}{
+		{name: "gzip", body: gzipBytes(t, page), contentEncoding: "gzip", want: page},
+		{name: "x-gzip", body: gzipBytes(t, page), contentEncoding: "x-gzip", want: page},
+		{name: "encoding in upper case", body: gzipBytes(t, page), contentEncoding: " GZIP ", want: page},
+		{name: "unlabelled gzip", body: gzipBytes(t, page), want: page},
+		{name: "zlib deflate", body: zlibBody.Bytes(), contentEncoding: "deflate", want: page},
+		{name: "raw deflate", body: flateBody.Bytes(), contentEncoding: "deflate", want: page},
+		{name: "uncompressed", body: page, want: page},
+		{name: "uncompressed despite asking for gzip", body: page, contentEncoding: "identity", want: page},
+		{name: "empty gzip", body: nil, contentEncoding: "gzip", want: []byte{}},
+		{name: "empty deflate", body: nil, contentEncoding: "deflate", want: []byte{}},
+		{name: "empty uncompressed", body: nil, want: []byte{}},
+		{name: "one byte", body: []byte("a"), want: []byte("a")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader, err := decompressBody(bytes.NewReader(test.body), test.contentEncoding)
+
+			if err != nil {
+				t.Fatalf("decompressBody() error = %v", err)
+			}
+
+			got, err := io.ReadAll(reader)
+
+			if err != nil {
+				t.Fatalf("reading the body: %v", err)
+			}
+
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("decompressBody() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
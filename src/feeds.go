@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type QueuedFeed struct {
+	Host    string
+	FeedUrl string
+}
+
+// Records the outcome of a feed check
+type FeedMarker interface {
+	SetFeedVerified(ctx context.Context, host string, verified bool) error
+}
+
+// The persistence needed to re-check the feeds of queued prospects
+type FeedStore interface {
+	FeedMarker
+	GetQueuedFeeds(ctx context.Context) ([]QueuedFeed, error)
+}
+
+// Check that a feed URL answers with something that looks like an RSS, Atom or JSON feed. The request is made like a
+// page fetch, rate limited and with the crawler's user agent and timeout, through a client that refuses private hosts
+func (d *Discoverer) verifyFeed(ctx context.Context, feedUrl string) error {
+	crawler := d.Config.Crawler
+
+	parsedUrl, err := url.Parse(feedUrl)
+
+	if err != nil {
+		return err
+	}
+
+	// Time spent waiting for the host's turn doesn't count against the timeout, or a feed on a host with a
+	// Crawl-delay would be marked dead
+	err = d.hostRates.wait(ctx, d.Client, parsedUrl, crawler)
+
+	if err != nil {
+		return err
+	}
+
+	feedCtx, cancel := context.WithTimeout(ctx, time.Duration(crawler.Timeout)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(feedCtx, "GET", feedUrl, nil)
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("User-Agent", getUserAgent(feedUrl, crawler))
+
+	resp, err := d.Client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer func(resp *http.Response) {
+		_ = resp.Body.Close()
+	}(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("feed responded with %d", resp.StatusCode)
+	}
+
+	contentType := strings.ToLower(resp.Header.Get("Content-Type"))
+
+	if strings.Contains(contentType, "text/html") {
+		return fmt.Errorf("feed responded with an html page")
+	}
+
+	// The opening of the document is enough to tell a feed apart
+	head, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	if err != nil {
+		return err
+	}
+
+	if !looksLikeFeed(head) {
+		return fmt.Errorf("feed response is not rss, atom or json feed")
+	}
+
+	return nil
+}
+
+func looksLikeFeed(head []byte) bool {
+	head = bytes.ToLower(bytes.TrimSpace(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf"))))
+
+	if bytes.HasPrefix(head, []byte("{")) {
+		return bytes.Contains(head, []byte("jsonfeed.org"))
+	}
+
+	return bytes.Contains(head, []byte("<rss")) ||
+		bytes.Contains(head, []byte("<feed")) ||
+		bytes.Contains(head, []byte("<rdf:rdf"))
+}
+
+// The first of crawler.FeedProbePaths on the page's host that answers a HEAD request with a feed content type, or
+// an empty string when none does
+func (d *Discoverer) probeFeedUrl(ctx context.Context, site ExternalPage) string {
+	crawler := d.Config.Crawler
+
+	for _, probePath := range crawler.FeedProbePaths {
+		probeUrl := site.Url.Url.ResolveReference(&url.URL{Path: probePath})
+
+		if err := d.hostRates.wait(ctx, d.Client, probeUrl, crawler); err != nil {
+			return ""
+		}
+
+		if isFeedResponse(ctx, d.Client, probeUrl.String(), crawler) {
+			slog.Debug("found feed by probing", "host", site.queueHost(), "url", probeUrl.String())
+			return probeUrl.String()
+		}
+	}
+
+	return ""
+}
+
+func isFeedResponse(ctx context.Context, client Doer, feedUrl string, crawler CrawlerConfig) bool {
+	probeCtx, cancel := context.WithTimeout(ctx, time.Duration(crawler.Timeout)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(probeCtx, "HEAD", feedUrl, nil)
+
+	if err != nil {
+		return false
+	}
+
+	req.Header.Add("User-Agent", getUserAgent(feedUrl, crawler))
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return false
+	}
+
+	_ = resp.Body.Close()
+
+	return resp.StatusCode == http.StatusOK && isFeedContentType(resp.Header.Get("Content-Type"))
+}
+
+// RSS, Atom and JSON feeds, including the generic XML types many servers send feeds with
+func isFeedContentType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+	mediaType = strings.TrimSpace(mediaType)
+
+	switch mediaType {
+	case "application/rss+xml", "application/atom+xml", "application/rdf+xml", "application/feed+json",
+		"application/xml", "text/xml":
+		return true
+	}
+
+	return false
+}
+
+// Re-check every stored feed URL, marking each as alive or dead. Returns the number of alive and dead feeds
+func (d *Discoverer) verifyQueuedFeeds(ctx context.Context, store FeedStore, concurrency int, perHostLimit int) (int, int, error) {
+	feeds, err := store.GetQueuedFeeds(ctx)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	alive, dead := d.verifyFeeds(ctx, store, feeds, concurrency, perHostLimit)
+
+	return alive, dead, nil
+}
+
+// Check feeds through a pool of at most concurrency requests, no more than perHostLimit of them to one host
+func (d *Discoverer) verifyFeeds(ctx context.Context, store FeedMarker, feeds []QueuedFeed, concurrency int, perHostLimit int) (int, int) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	alive := 0
+	dead := 0
+	slots := make(chan struct{}, concurrency)
+
+	for _, feed := range feeds {
+		wg.Add(1)
+		slots <- struct{}{}
+
+		go func(feed QueuedFeed) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			feedHost := feed.Host
+			feedUrl, err := url.Parse(feed.FeedUrl)
+
+			if err == nil && feedUrl.Host != "" {
+				feedHost = feedUrl.Host
+			}
+
+			release, err := d.hostConcurrency.acquire(ctx, feedHost, perHostLimit)
+
+			if err != nil {
+				return
+			}
+
+			err = d.verifyFeed(ctx, feed.FeedUrl)
+			release()
+
+			verified := err == nil
+
+			if !verified {
+				slog.Info("dead feed", "host", feed.Host, "url", feed.FeedUrl, "error", err)
+			}
+
+			err = store.SetFeedVerified(ctx, feed.Host, verified)
+
+			if err != nil {
+				slog.Error("could not mark feed", "host", feed.Host, "error", err)
+				return
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if verified {
+				alive++
+			} else {
+				dead++
+			}
+		}(feed)
+	}
+
+	wg.Wait()
+
+	return alive, dead
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Records which feeds were marked alive or dead
+type fakeFeedStore struct {
+	mu       sync.Mutex
+	feeds    []QueuedFeed
+	verified map[string]bool
+}
+
+func (store *fakeFeedStore) GetQueuedFeeds(ctx context.Context) ([]QueuedFeed, error) {
+	return store.feeds, nil
+}
+
+func (store *fakeFeedStore) SetFeedVerified(ctx context.Context, host string, verified bool) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.verified[host] = verified
+
+	return nil
+}
+
+func TestVerifyQueuedFeeds(t *testing.T) {
+	var agentMu sync.Mutex
+	userAgents := make(map[string]string)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rss", func(w http.ResponseWriter, r *http.Request) {
+		agentMu.Lock()
+		userAgents[r.URL.Path] = r.Header.Get("User-Agent")
+		agentMu.Unlock()
+
+		w.Header().Set("Content-Type", "application/rss+xml")
+		_, _ = w.Write([]byte(`<?xml version="1.0"?><rss version="2.0"><channel></channel></rss>`))
+	})
+	mux.HandleFunc("/atom", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		_, _ = w.Write([]byte(`<feed xmlns="http://www.w3.org/2005/Atom"></feed>`))
+	})
+	mux.HandleFunc("/html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html></html>"))
+	})
+	mux.HandleFunc("/gone", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		name         string
+		path         string
+		allowPrivate bool
+		want         bool
+	}{
+		{name: "rss", path: "/rss", allowPrivate: true, want: true},
+		{name: "atom", path: "/atom", allowPrivate: true, want: true},
+		{name: "html page", path: "/html", allowPrivate: true, want: false},
+		{name: "not found", path: "/gone", allowPrivate: true, want: false},
+		{name: "private host", path: "/rss", allowPrivate: false, want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			crawler := testCrawlerConfig()
+			crawler.AllowPrivateHosts = test.allowPrivate
+			crawler.UserAgent = "test-agent"
+
+			store := &fakeFeedStore{
+				feeds:    []QueuedFeed{{Host: "example.com", FeedUrl: server.URL + test.path}},
+				verified: make(map[string]bool),
+			}
+
+			discoverer := testDiscoverer(newCrawlerClient(crawler), crawler)
+			alive, dead, err := discoverer.verifyQueuedFeeds(context.Background(), store, 2, 1)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			verified, marked := store.verified["example.com"]
+
+			if !marked || verified != test.want {
+				t.Errorf("verified = %v (marked %v), want %v", verified, marked, test.want)
+			}
+
+			if (alive == 1) != test.want || alive+dead != 1 {
+				t.Errorf("alive = %d, dead = %d", alive, dead)
+			}
+		})
+	}
+
+	if got := userAgents["/rss"]; got != "test-agent" {
+		t.Errorf("user agent = %q, want the crawler's", got)
+	}
+}
+
+func TestVerifyFeedsConcurrency(t *testing.T) {
+	tests := []struct {
+		name         string
+		hosts        int
+		concurrency  int
+		perHostLimit int
+		wantMax      int32
+	}{
+		{name: "one at a time", hosts: 8, concurrency: 1, perHostLimit: 0, wantMax: 1},
+		{name: "pool bound", hosts: 8, concurrency: 3, perHostLimit: 0, wantMax: 3},
+		{name: "per host bound", hosts: 1, concurrency: 5, perHostLimit: 2, wantMax: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var inFlight, maxInFlight atomic.Int32
+
+			doer := handlerDoer{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				current := inFlight.Add(1)
+				defer inFlight.Add(-1)
+
+				for {
+					seen := maxInFlight.Load()
+
+					if current <= seen || maxInFlight.CompareAndSwap(seen, current) {
+						break
+					}
+				}
+
+				time.Sleep(30 * time.Millisecond)
+				w.Header().Set("Content-Type", "application/rss+xml")
+				_, _ = w.Write([]byte(`<rss version="2.0"></rss>`))
+			})}
+
+			var feeds []QueuedFeed
+
+			for i := 0; i < 8; i++ {
+				host := fmt.Sprintf("feeds%d.example", i%test.hosts)
+				feeds = append(feeds, QueuedFeed{Host: host, FeedUrl: fmt.Sprintf("https://%s/feed/%d", host, i)})
+			}
+
+			store := &fakeFeedStore{verified: make(map[string]bool)}
+			alive, dead := testDiscoverer(doer, testCrawlerConfig()).verifyFeeds(context.Background(), store, feeds, test.concurrency, test.perHostLimit)
+
+			if alive != len(feeds) || dead != 0 {
+				t.Errorf("alive = %d, dead = %d, want all %d alive", alive, dead, len(feeds))
+			}
+
+			if got := maxInFlight.Load(); got != test.wantMax {
+				t.Errorf("at most %d feeds checked at once, want %d", got, test.wantMax)
+			}
+		})
+	}
+}
+
+func TestVerifyFeedsWaitsOutCrawlDelay(t *testing.T) {
+	tests := []struct {
+		name       string
+		crawlDelay string
+		feeds      int
+	}{
+		{name: "delay longer than the timeout", crawlDelay: "1.5", feeds: 2},
+		{name: "no delay", crawlDelay: "0", feeds: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/robots.txt" {
+					_, _ = w.Write([]byte("User-agent: *\nCrawl-delay: " + test.crawlDelay + "\n"))
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/rss+xml")
+				_, _ = w.Write([]byte(`<rss version="2.0"></rss>`))
+			}))
+			defer server.Close()
+
+			crawler := testCrawlerConfig()
+			crawler.RespectCrawlDelay = true
+			crawler.Timeout = 1
+
+			// Every feed is on the server's host, so each waits its turn behind the last
+			var feeds []QueuedFeed
+
+			for i := 0; i < test.feeds; i++ {
+				feeds = append(feeds, QueuedFeed{Host: fmt.Sprintf("feeds%d.example", i), FeedUrl: fmt.Sprintf("%s/feed/%d", server.URL, i)})
+			}
+
+			store := &fakeFeedStore{verified: make(map[string]bool)}
+			alive, dead := testDiscoverer(server.Client(), crawler).verifyFeeds(context.Background(), store, feeds, len(feeds), 0)
+
+			if alive != len(feeds) || dead != 0 {
+				t.Errorf("alive = %d, dead = %d, want all %d alive", alive, dead, len(feeds))
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"golang.org/x/net/html"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+	"log/slog"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Elements that never have children, so never appear as an ancestor
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "param": true, "source": true, "track": true, "wbr": true,
+}
+
+type ancestor struct {
+	Tag      string
+	Excluded bool
+}
+
+// Tracks the open elements around the current token while tokenizing a post
+type ancestorStack []ancestor
+
+func (stack ancestorStack) update(token html.Token, filter FilterConfig) ancestorStack {
+	switch token.Type {
+	case html.StartTagToken:
+		if !voidElements[token.Data] {
+			stack = append(stack, ancestor{
+				Tag: token.Data,
+				Excluded: matchesAnySelector(token, filter.ExcludedContainers) ||
+					(filter.SkipHiddenLinks && isHiddenElement(token)),
+			})
+		}
+	case html.EndTagToken:
+		// Pop back to the matching open element, tolerating unclosed children; stray end tags are ignored
+		for i := len(stack) - 1; i >= 0; i-- {
+			if stack[i].Tag == token.Data {
+				return stack[:i]
+			}
+		}
+	}
+
+	return stack
+}
+
+func (stack ancestorStack) insideExcluded() bool {
+	for _, element := range stack {
+		if element.Excluded {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchesAnySelector(token html.Token, selectors []string) bool {
+	for _, selector := range selectors {
+		if matchesSelector(token, selector) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Supports the simple selectors needed to describe containers: "#id", ".class" and "tag"
+func matchesSelector(token html.Token, selector string) bool {
+	selector = strings.TrimSpace(selector)
+
+	switch {
+	case strings.HasPrefix(selector, "#"):
+		return getAttr(token, "id") == selector[1:]
+	case strings.HasPrefix(selector, "."):
+		for _, class := range strings.Fields(getAttr(token, "class")) {
+			if class == selector[1:] {
+				return true
+			}
+		}
+
+		return false
+	default:
+		return selector != "" && strings.EqualFold(token.Data, selector)
+	}
+}
+
+func getAttr(token html.Token, key string) string {
+	for _, attr := range token.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+
+	return ""
+}
+
+// Links hidden from human readers exist only to catch bots
+func isHiddenElement(token html.Token) bool {
+	for _, attr := range token.Attr {
+		switch attr.Key {
+		case "hidden":
+			return true
+		case "aria-hidden":
+			if strings.EqualFold(attr.Val, "true") {
+				return true
+			}
+		case "style":
+			style := strings.ReplaceAll(strings.ToLower(attr.Val), " ", "")
+
+			if strings.Contains(style, "display:none") || strings.Contains(style, "visibility:hidden") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func isNofollowTrap(token html.Token, filter FilterConfig) bool {
+	if !filter.SkipNofollowLinks {
+		return false
+	}
+
+	for _, rel := range strings.Fields(strings.ToLower(getAttr(token, "rel"))) {
+		if rel == "nofollow" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func compileTrapPatterns(patterns []string) []*regexp.Regexp {
+	var compiled []*regexp.Regexp
+
+	for _, pattern := range patterns {
+		trapPattern, err := regexp.Compile(pattern)
+
+		if err != nil {
+			slog.Error("could not compile trap path pattern", "pattern", pattern, "error", err)
+			continue
+		}
+
+		compiled = append(compiled, trapPattern)
+	}
+
+	return compiled
+}
+
+func isTrapPath(u *url.URL, trapPatterns []*regexp.Regexp) bool {
+	for _, trapPattern := range trapPatterns {
+		if trapPattern.MatchString(u.Path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The host a candidate is deduplicated and queued under. With CollapseSubdomains, blog.example.com,
+// www.example.com and example.com are all one prospect, example.com
+func prospectHost(u *url.URL, filter FilterConfig) string {
+	host := normalizeHost(u.Host)
+
+	if !filter.CollapseSubdomains {
+		return host
+	}
+
+	registrableDomain, err := publicsuffix.EffectiveTLDPlusOne(host)
+
+	if err != nil {
+		return host
+	}
+
+	return registrableDomain
+}
+
+// The form hosts are compared and stored in, so Example.com, www.example.com and example.com:443 are one site.
+// Internationalised hosts are converted to punycode, matching however they were written in the link
+func normalizeHost(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+
+	if asciiHost, err := idna.Lookup.ToASCII(host); err == nil {
+		host = asciiHost
+	}
+
+	return strings.TrimPrefix(host, "www.")
+}
+
+// Posts republished from an aggregator carry the aggregator's host, so links back to it aren't self-references
+func isAggregatorHost(host string, aggregatorHosts []string) bool {
+	for _, aggregatorHost := range aggregatorHosts {
+		if normalizeHost(host) == normalizeHost(aggregatorHost) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		name string
+		host string
+		want string
+	}{
+		{name: "lowercase", host: "Example.COM", want: "example.com"},
+		{name: "www stripped", host: "www.example.com", want: "example.com"},
+		{name: "port stripped", host: "www.example.com:443", want: "example.com"},
+		{name: "trailing dot", host: "example.com.", want: "example.com"},
+		{name: "unicode host", host: "bücher.example", want: "xn--bcher-kva.example"},
+		{name: "unicode host uppercase", host: "www.BÜCHER.example", want: "xn--bcher-kva.example"},
+		{name: "punycode host", host: "xn--bcher-kva.example", want: "xn--bcher-kva.example"},
+		{name: "unicode tld", host: "例え.テスト", want: "xn--r8jz45g.xn--zckzah"},
+		{name: "only www subdomain stripped", host: "www2.example.com", want: "www2.example.com"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := normalizeHost(test.host); got != test.want {
+				t.Errorf("normalizeHost(%q) = %q, want %q", test.host, got, test.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeHostMatchesPolicy(t *testing.T) {
+	policy := blacklistHostPolicy{hosts: map[string]bool{normalizeHost("www.Bücher.example"): true}}
+
+	for _, host := range []string{"bücher.example", "xn--bcher-kva.example", "WWW.BÜCHER.EXAMPLE"} {
+		if allowed, _ := policy.Allowed(context.Background(), host); allowed {
+			t.Errorf("Allowed(%q) = true, want the blacklisted host refused however it is written", host)
+		}
+	}
+}
+
+func TestGetUrlsFromPostExcludedContainers(t *testing.T) {
+	body := `<div class="entry"><a href="https://kept.example/">post link</a></div>` +
+		`<section id="comments"><div class="comment-body"><a href="https://spam.example/">comment link</a><p><a href="https://nested.example/">nested</a></p></div></section>` +
+		`<div class="comment-body"><a href="https://reply.example/">reply link</a></div>` +
+		`<a href="https://after.example/">after</a>`
+
+	tests := []struct {
+		name       string
+		containers []string
+		want       []string
+	}{
+		{name: "nothing excluded", want: []string{"https://kept.example/", "https://spam.example/", "https://nested.example/", "https://reply.example/", "https://after.example/"}},
+		{name: "by id", containers: []string{"#comments"}, want: []string{"https://kept.example/", "https://reply.example/", "https://after.example/"}},
+		{name: "by class", containers: []string{".comment-body"}, want: []string{"https://kept.example/", "https://after.example/"}},
+		{name: "by tag", containers: []string{"section"}, want: []string{"https://kept.example/", "https://reply.example/", "https://after.example/"}},
+		{name: "unmatched", containers: []string{"#replies", ".comment"}, want: []string{"https://kept.example/", "https://spam.example/", "https://nested.example/", "https://reply.example/", "https://after.example/"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter := defaultConfig().Filter
+			filter.ExcludedContainers = test.containers
+
+			if got := postLinks(t, body, filter); strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("getUrlsFromPost() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetUrlsFromPostSkipsTraps(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		nofollow bool
+		hidden   bool
+		patterns []string
+		want     []string
+	}{
+		{name: "display none", body: `<a href="https://a.example/">a</a><div style="display: none"><a href="https://trap.example/">trap</a></div>`, hidden: true, want: []string{"https://a.example/"}},
+		{name: "visibility hidden anchor", body: `<a style="visibility:hidden" href="https://trap.example/">trap</a><a href="https://a.example/">a</a>`, hidden: true, want: []string{"https://a.example/"}},
+		{name: "hidden attribute", body: `<p hidden><a href="https://trap.example/">trap</a></p><a href="https://a.example/">a</a>`, hidden: true, want: []string{"https://a.example/"}},
+		{name: "aria hidden", body: `<span aria-hidden="true"><a href="https://trap.example/">trap</a></span><a href="https://a.example/">a</a>`, hidden: true, want: []string{"https://a.example/"}},
+		{name: "hidden links kept when off", body: `<div style="display:none"><a href="https://trap.example/">trap</a></div>`, want: []string{"https://trap.example/"}},
+		{name: "nofollow", body: `<a rel="external NoFollow" href="https://trap.example/">trap</a><a rel="external" href="https://a.example/">a</a>`, nofollow: true, want: []string{"https://a.example/"}},
+		{name: "nofollow kept when off", body: `<a rel="nofollow" href="https://a.example/">a</a>`, want: []string{"https://a.example/"}},
+		{name: "trap path", body: `<a href="https://a.example/calendar/2031/01/">trap</a><a href="https://a.example/blog/">a</a>`, patterns: []string{`^/calendar/`}, want: []string{"https://a.example/blog/"}},
+		{name: "invalid pattern ignored", body: `<a href="https://a.example/blog/">a</a>`, patterns: []string{`(`}, want: []string{"https://a.example/blog/"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter := defaultConfig().Filter
+			filter.SkipHiddenLinks = test.hidden
+			filter.SkipNofollowLinks = test.nofollow
+			filter.TrapPathPatterns = test.patterns
+
+			if got := postLinks(t, test.body, filter); strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("getUrlsFromPost() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestProspectHost(t *testing.T) {
+	tests := []struct {
+		rawUrl   string
+		collapse bool
+		want     string
+	}{
+		{rawUrl: "https://blog.example.com/", collapse: true, want: "example.com"},
+		{rawUrl: "https://www.example.com/", collapse: true, want: "example.com"},
+		{rawUrl: "https://Example.com:8443/", collapse: true, want: "example.com"},
+		{rawUrl: "https://a.b.example.co.uk/", collapse: true, want: "example.co.uk"},
+		{rawUrl: "https://someone.github.io/", collapse: true, want: "someone.github.io"},
+		{rawUrl: "https://blog.example.com/", collapse: false, want: "blog.example.com"},
+		{rawUrl: "https://www.example.com/", collapse: false, want: "example.com"},
+		{rawUrl: "http://localhost:8080/", collapse: true, want: "localhost"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.rawUrl, func(t *testing.T) {
+			parsed, err := url.Parse(test.rawUrl)
+
+			if err != nil {
+				t.Fatalf("could not parse %s: %v", test.rawUrl, err)
+			}
+
+			filter := defaultConfig().Filter
+			filter.CollapseSubdomains = test.collapse
+
+			if got := prospectHost(parsed, filter); got != test.want {
+				t.Errorf("prospectHost(%s) = %q, want %q", test.rawUrl, got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetUrlsFromPostAggregatorHosts(t *testing.T) {
+	body := `<a href="https://blog.example/sources/anime-weekly">source</a><a href="/tags/anime">tag</a><a href="https://other.example/">other</a>`
+
+	tests := []struct {
+		name            string
+		aggregatorHosts []string
+		want            []string
+	}{
+		{name: "own host dropped", want: []string{"https://other.example/"}},
+		{name: "aggregator host kept", aggregatorHosts: []string{"blog.example"}, want: []string{"https://blog.example/sources/anime-weekly", "https://blog.example/tags/anime", "https://other.example/"}},
+		{name: "matched however it's written", aggregatorHosts: []string{"WWW.Blog.Example"}, want: []string{"https://blog.example/sources/anime-weekly", "https://blog.example/tags/anime", "https://other.example/"}},
+		{name: "another aggregator", aggregatorHosts: []string{"aggregator.example"}, want: []string{"https://other.example/"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter := defaultConfig().Filter
+			filter.AggregatorHosts = test.aggregatorHosts
+
+			if got := postLinks(t, body, filter); strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("getUrlsFromPost() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The outcome of the latest discovery runs, reported by /healthz
+type runHealth struct {
+	mutex       sync.Mutex
+	lastRun     time.Time
+	lastSuccess time.Time
+	lastError   string
+}
+
+var serviceHealth = &runHealth{}
+
+// Record a finished run, which failed when err isn't nil. A run that couldn't reach the database fails too
+func (health *runHealth) record(err error) {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	health.lastRun = time.Now()
+	health.lastError = ""
+
+	if err != nil {
+		health.lastError = err.Error()
+		return
+	}
+
+	health.lastSuccess = health.lastRun
+}
+
+type healthStatus struct {
+	Healthy     bool      `json:"healthy"`
+	Reason      string    `json:"reason,omitempty"`
+	LastRun     time.Time `json:"lastRun"`
+	LastSuccess time.Time `json:"lastSuccess"`
+}
+
+// Healthy when the latest run succeeded and it finished within maxAge
+func (health *runHealth) status(maxAge time.Duration) healthStatus {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	status := healthStatus{
+		LastRun:     health.lastRun,
+		LastSuccess: health.lastSuccess,
+	}
+
+	switch {
+	case health.lastRun.IsZero():
+		status.Reason = "no run has finished yet"
+	case health.lastError != "":
+		status.Reason = "last run failed: " + health.lastError
+	case time.Since(health.lastSuccess) > maxAge:
+		status.Reason = "no successful run within " + maxAge.String()
+	default:
+		status.Healthy = true
+	}
+
+	return status
+}
+
+// The part of *sql.DB /healthz checks the database with
+type Pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// How long /healthz waits for the database, kept short so probes don't time out first
+const healthPingTimeout = 2 * time.Second
+
+// Answers 200 while runs are succeeding and the database answers, and 503 otherwise. Runs are expected at least
+// every two service intervals
+func newHealthHandler(db Pinger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		maxAge := 2 * time.Duration(activeConfig.get().Service.IntervalHours) * time.Hour
+		status := serviceHealth.status(maxAge)
+
+		if status.Healthy {
+			err := pingDb(r.Context(), db)
+
+			if err != nil {
+				status.Healthy = false
+				status.Reason = "database unreachable: " + err.Error()
+			}
+		}
+
+		writeHealthStatus(w, status)
+	}
+}
+
+func pingDb(ctx context.Context, db Pinger) error {
+	if db == nil {
+		return errors.New("no connection")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthPingTimeout)
+	defer cancel()
+
+	return db.PingContext(ctx)
+}
+
+func writeHealthStatus(w http.ResponseWriter, status healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !status.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	_ = json.NewEncoder(w).Encode(status)
+}
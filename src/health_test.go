@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestHealthHandler(t *testing.T) {
+	config := defaultConfig()
+	config.Service.IntervalHours = 1
+	previous := activeConfig.set(config)
+	t.Cleanup(func() {
+		activeConfig.set(previous)
+	})
+
+	tests := []struct {
+		name       string
+		runErr     error
+		noRun      bool
+		pingErr    error
+		noDb       bool
+		wantStatus int
+		wantReason string
+	}{
+		{name: "healthy", wantStatus: http.StatusOK},
+		{name: "database down", pingErr: errors.New("connection refused"), wantStatus: http.StatusServiceUnavailable, wantReason: "database unreachable: connection refused"},
+		{name: "no database", noDb: true, wantStatus: http.StatusServiceUnavailable, wantReason: "database unreachable: no connection"},
+		{name: "run failed", runErr: errors.New("boom"), wantStatus: http.StatusServiceUnavailable, wantReason: "last run failed: boom"},
+		{name: "no run yet", noRun: true, wantStatus: http.StatusServiceUnavailable, wantReason: "no run has finished yet"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			previousHealth := serviceHealth
+			serviceHealth = &runHealth{}
+			t.Cleanup(func() {
+				serviceHealth = previousHealth
+			})
+
+			if !test.noRun {
+				serviceHealth.record(test.runErr)
+			}
+
+			var pinger Pinger
+
+			if !test.noDb {
+				db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+
+				if err != nil {
+					t.Fatalf("could not create mock db: %v", err)
+				}
+
+				t.Cleanup(func() {
+					_ = db.Close()
+				})
+
+				// A failed run is unhealthy without asking the database
+				if test.runErr == nil && !test.noRun {
+					mock.ExpectPing().WillReturnError(test.pingErr)
+				}
+
+				pinger = db
+			}
+
+			recorder := httptest.NewRecorder()
+			newHealthHandler(pinger)(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+			if recorder.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", recorder.Code, test.wantStatus)
+			}
+
+			if test.wantReason != "" && !strings.Contains(recorder.Body.String(), test.wantReason) {
+				t.Errorf("body = %s, want reason %q", recorder.Body.String(), test.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// Caps the number of requests in flight to any single host, on top of the batch-wide concurrency
+type hostConcurrencyLimiter struct {
+	mutex sync.Mutex
+	hosts map[string]*hostSlots
+}
+
+// A host's slots and the fetches holding or waiting for one, which is dropped when the last of them is done
+type hostSlots struct {
+	slots chan struct{}
+	users int
+}
+
+func newHostConcurrencyLimiter() *hostConcurrencyLimiter {
+	return &hostConcurrencyLimiter{
+		hosts: make(map[string]*hostSlots),
+	}
+}
+
+// Wait for one of the host's limit slots, returning the function that frees it. A limit below 1 is unlimited. A
+// changed limit applies once the host's fetches under the old one are done
+func (limiter *hostConcurrencyLimiter) acquire(ctx context.Context, host string, limit int) (func(), error) {
+	if limit < 1 {
+		return func() {}, nil
+	}
+
+	limiter.mutex.Lock()
+	entry, ok := limiter.hosts[host]
+
+	if !ok {
+		entry = &hostSlots{slots: make(chan struct{}, limit)}
+		limiter.hosts[host] = entry
+	}
+
+	entry.users++
+	limiter.mutex.Unlock()
+
+	select {
+	case entry.slots <- struct{}{}:
+		return func() {
+			<-entry.slots
+			limiter.done(host, entry)
+		}, nil
+	case <-ctx.Done():
+		limiter.done(host, entry)
+		return nil, ctx.Err()
+	}
+}
+
+func (limiter *hostConcurrencyLimiter) done(host string, entry *hostSlots) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	entry.users--
+
+	if entry.users == 0 {
+		delete(limiter.hosts, host)
+	}
+}
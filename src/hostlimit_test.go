@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHostConcurrencyLimiter(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     int
+		held      int
+		wantBlock bool
+	}{
+		{name: "unlimited", limit: 0, held: 3},
+		{name: "under the limit", limit: 2, held: 1},
+		{name: "at the limit", limit: 2, held: 2, wantBlock: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := newHostConcurrencyLimiter()
+
+			var releases []func()
+
+			for i := 0; i < test.held; i++ {
+				release, err := limiter.acquire(context.Background(), "example.com", test.limit)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				releases = append(releases, release)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			release, err := limiter.acquire(ctx, "example.com", test.limit)
+
+			if blocked := err != nil; blocked != test.wantBlock {
+				t.Fatalf("blocked = %v, want %v", blocked, test.wantBlock)
+			}
+
+			if release != nil {
+				releases = append(releases, release)
+			}
+
+			for _, release := range releases {
+				release()
+			}
+
+			// Neither finished fetches nor ones that gave up waiting keep their host around
+			if len(limiter.hosts) != 0 {
+				t.Errorf("%d hosts kept after every slot was freed", len(limiter.hosts))
+			}
+		})
+	}
+}
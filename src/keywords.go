@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The keywords scored when no keywords file is configured
+func defaultKeywords() map[string]int {
+	return map[string]int{
+		"anime": 1,
+		"manga": 1,
+	}
+}
+
+// Inline keyword weights in config.json, either an object of weights ({"anime": 2}) or a list of keywords that
+// are each weighted 1 (["anime", "manga"])
+type KeywordWeights map[string]int
+
+func (weights *KeywordWeights) UnmarshalJSON(data []byte) error {
+	var keywords []string
+
+	if json.Unmarshal(data, &keywords) == nil {
+		*weights = make(KeywordWeights)
+
+		for _, keyword := range keywords {
+			(*weights)[keyword] = 1
+		}
+
+		return nil
+	}
+
+	var weighted map[string]int
+
+	err := json.Unmarshal(data, &weighted)
+
+	if err != nil {
+		return fmt.Errorf("keywords must be a list of keywords or an object of keyword weights: %w", err)
+	}
+
+	*weights = weighted
+
+	return nil
+}
+
+// The keywords a run scores with: the keywords file if one is configured, then the inline keywords, then the
+// defaults
+func loadKeywords(scoring ScoringConfig) (map[string]int, error) {
+	if scoring.KeywordsFile != "" {
+		return loadKeywordsFile(scoring.KeywordsFile)
+	}
+
+	if len(scoring.Keywords) > 0 {
+		return normalizeKeywords(scoring.Keywords)
+	}
+
+	return defaultKeywords(), nil
+}
+
+// Load keyword weights from a JSON object ({"anime": 2}), a YAML mapping (anime: 2) or a CSV file of keyword,weight
+// rows. The file is read at the start of every run, so edits apply from the next run without a restart
+func loadKeywordsFile(keywordsPath string) (map[string]int, error) {
+	contents, err := ioutil.ReadFile(keywordsPath)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not read keywords file: %w", err)
+	}
+
+	keywords := make(map[string]int)
+
+	switch strings.ToLower(filepath.Ext(keywordsPath)) {
+	case ".json":
+		err = json.Unmarshal(contents, &keywords)
+
+		if err != nil {
+			return nil, fmt.Errorf("could not parse keywords file %s: %w", keywordsPath, err)
+		}
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(contents, &keywords)
+
+		if err != nil {
+			return nil, fmt.Errorf("could not parse keywords file %s: %w", keywordsPath, err)
+		}
+	case ".csv":
+		reader := csv.NewReader(strings.NewReader(string(contents)))
+		reader.FieldsPerRecord = 2
+		reader.TrimLeadingSpace = true
+
+		rows, err := reader.ReadAll()
+
+		if err != nil {
+			return nil, fmt.Errorf("could not parse keywords file %s: %w", keywordsPath, err)
+		}
+
+		for _, row := range rows {
+			weight, err := strconv.Atoi(strings.TrimSpace(row[1]))
+
+			if err != nil {
+				return nil, fmt.Errorf("invalid weight for keyword %q in %s: %w", row[0], keywordsPath, err)
+			}
+
+			if _, listed := keywords[row[0]]; listed {
+				return nil, fmt.Errorf("keyword %q is listed twice in %s", row[0], keywordsPath)
+			}
+
+			keywords[row[0]] = weight
+		}
+	default:
+		return nil, fmt.Errorf("unsupported keywords file type %s, expected .json, .yaml, .yml or .csv", keywordsPath)
+	}
+
+	return normalizeKeywords(keywords)
+}
+
+// Keywords are matched against lowercased words, so they are lowercased here too. Two keywords that differ only in
+// case or spacing would be the same keyword with two weights, so they are refused
+func normalizeKeywords(keywords map[string]int) (map[string]int, error) {
+	normalized := make(map[string]int)
+	written := make(map[string]string)
+
+	for original, weight := range keywords {
+		// Phrases are matched word by word, so however they're spaced is the same phrase
+		keyword := strings.Join(strings.Fields(strings.ToLower(original)), " ")
+
+		if other, seen := written[keyword]; seen {
+			first, second := other, original
+
+			// Map order is random, so the error names them the same way every time
+			if second < first {
+				first, second = second, first
+			}
+
+			return nil, fmt.Errorf("keywords %q and %q are the same keyword", first, second)
+		}
+
+		written[keyword] = original
+
+		if keyword == "" {
+			return nil, fmt.Errorf("keywords must not be empty")
+		}
+
+		if weight <= 0 {
+			return nil, fmt.Errorf("keyword %q must have a positive weight, got %d", keyword, weight)
+		}
+
+		normalized[keyword] = weight
+	}
+
+	if len(normalized) == 0 {
+		return nil, fmt.Errorf("no keywords configured")
+	}
+
+	return normalized, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Write a keywords file with the given name to a temporary directory, returning its path
+func writeKeywordsFile(t *testing.T, name string, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadKeywordsFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		contents string
+		want     map[string]int
+		wantErr  string
+	}{
+		{name: "json", file: "keywords.json", contents: `{"Anime": 2, "visual  novel": 3}`, want: map[string]int{"anime": 2, "visual novel": 3}},
+		{name: "csv", file: "keywords.CSV", contents: "anime,2\nmanga, 1\n", want: map[string]int{"anime": 2, "manga": 1}},
+		{name: "zero weight", file: "keywords.json", contents: `{"anime": 0}`, wantErr: "positive weight"},
+		{name: "negative weight", file: "keywords.csv", contents: "anime,-1\n", wantErr: "positive weight"},
+		{name: "weight not a number", file: "keywords.csv", contents: "anime,lots\n", wantErr: "invalid weight"},
+		{name: "missing weight", file: "keywords.csv", contents: "anime\n", wantErr: "could not parse"},
+		{name: "malformed json", file: "keywords.json", contents: `{"anime": `, wantErr: "could not parse"},
+		{name: "empty keyword", file: "keywords.json", contents: `{" ": 1}`, wantErr: "must not be empty"},
+		{name: "no keywords", file: "keywords.json", contents: `{}`, wantErr: "no keywords"},
+		{name: "yaml", file: "keywords.yaml", contents: "Anime: 2\n\"visual novel\": 3\n# comment\nmanga: 1\n", want: map[string]int{"anime": 2, "visual novel": 3, "manga": 1}},
+		{name: "yml", file: "keywords.YML", contents: "anime: 4\n", want: map[string]int{"anime": 4}},
+		{name: "yaml weight not a number", file: "keywords.yaml", contents: "anime: lots\n", wantErr: "could not parse"},
+		{name: "yaml list", file: "keywords.yaml", contents: "- anime\n- manga\n", wantErr: "could not parse"},
+		{name: "yaml zero weight", file: "keywords.yaml", contents: "anime: 0\n", wantErr: "positive weight"},
+		{name: "yaml repeated keyword", file: "keywords.yaml", contents: "anime: 1\nanime: 2\n", wantErr: "could not parse"},
+		{name: "json keywords differing in case", file: "keywords.json", contents: `{"anime": 1, "Anime": 2}`, wantErr: `keywords "Anime" and "anime" are the same keyword`},
+		{name: "yaml keywords differing in spacing", file: "keywords.yaml", contents: "light novel: 1\n\"light  novel\": 2\n", wantErr: "are the same keyword"},
+		{name: "csv repeated keyword", file: "keywords.csv", contents: "anime,1\nanime,2\n", wantErr: "listed twice"},
+		{name: "csv keywords differing in case", file: "keywords.csv", contents: "anime,1\nANIME,2\n", wantErr: `keywords "ANIME" and "anime" are the same keyword`},
+		{name: "unsupported type", file: "keywords.toml", contents: "anime = 1\n", wantErr: "unsupported keywords file type"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := loadKeywordsFile(writeKeywordsFile(t, test.file, test.contents))
+
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("loadKeywordsFile() error = %v, want %q", err, test.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("loadKeywordsFile() error = %v", err)
+			}
+
+			if len(got) != len(test.want) {
+				t.Fatalf("loadKeywordsFile() = %v, want %v", got, test.want)
+			}
+
+			for keyword, weight := range test.want {
+				if got[keyword] != weight {
+					t.Errorf("loadKeywordsFile() = %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadKeywordsFileMissing(t *testing.T) {
+	if _, err := loadKeywordsFile(filepath.Join(t.TempDir(), "missing.json")); err == nil || !strings.Contains(err.Error(), "could not read") {
+		t.Errorf("loadKeywordsFile() error = %v, want a read error", err)
+	}
+}
+
+func TestLoadKeywords(t *testing.T) {
+	keywordsFile := writeKeywordsFile(t, "keywords.json", `{"isekai": 4}`)
+
+	tests := []struct {
+		name    string
+		scoring ScoringConfig
+		want    map[string]int
+	}{
+		{name: "file first", scoring: ScoringConfig{KeywordsFile: keywordsFile, Keywords: KeywordWeights{"manga": 2}}, want: map[string]int{"isekai": 4}},
+		{name: "inline", scoring: ScoringConfig{Keywords: KeywordWeights{"Manga": 2}}, want: map[string]int{"manga": 2}},
+		{name: "defaults", want: defaultKeywords()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := loadKeywords(test.scoring)
+
+			if err != nil {
+				t.Fatalf("loadKeywords() error = %v", err)
+			}
+
+			if len(got) != len(test.want) {
+				t.Fatalf("loadKeywords() = %v, want %v", got, test.want)
+			}
+
+			for keyword, weight := range test.want {
+				if got[keyword] != weight {
+					t.Errorf("loadKeywords() = %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestKeywordWeightsUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		want    KeywordWeights
+		wantErr bool
+	}{
+		{name: "list", json: `["anime", "manga"]`, want: KeywordWeights{"anime": 1, "manga": 1}},
+		{name: "weights", json: `{"anime": 3}`, want: KeywordWeights{"anime": 3}},
+		{name: "neither", json: `"anime"`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got KeywordWeights
+
+			err := json.Unmarshal([]byte(test.json), &got)
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Unmarshal() error = %v, want error %v", err, test.wantErr)
+			}
+
+			if len(got) != len(test.want) {
+				t.Fatalf("Unmarshal() = %v, want %v", got, test.want)
+			}
+
+			for keyword, weight := range test.want {
+				if got[keyword] != weight {
+					t.Errorf("Unmarshal() = %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestKeywordsFileScoring(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		contents string
+		want     int
+	}{
+		{name: "json weights", file: "keywords.json", contents: `{"anime": 3, "manga": 2}`, want: 3*2 + 2},
+		{name: "csv weights", file: "keywords.csv", contents: "anime,1\nmanga,5\n", want: 1*2 + 5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scoring := defaultConfig().Scoring
+			scoring.KeywordsFile = writeKeywordsFile(t, test.file, test.contents)
+
+			keywords, err := loadKeywords(scoring)
+
+			if err != nil {
+				t.Fatalf("loadKeywords() error = %v", err)
+			}
+
+			page := testPage("https://blog.example/", 1)
+			page.Html = []byte(`<html><body><p>anime reviews, anime news and manga</p></body></html>`)
+
+			if got := getRelevancyScore(page, keywords, scoring); got.Total != test.want {
+				t.Errorf("getRelevancyScore() = %d with %v, want %d", got.Total, got.Counts, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// Install the default logger. Logs go to stderr so the JSONL output on stdout can be piped on its own
+func setupLogging(logging LoggingConfig) error {
+	var level slog.Level
+
+	err := level.UnmarshalText([]byte(logging.Level))
+
+	if err != nil {
+		return fmt.Errorf("logging.level: %w", err)
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+
+	switch logging.Format {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, options)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, options)))
+	default:
+		return fmt.Errorf("logging.format must be text or json, got %q", logging.Format)
+	}
+
+	return nil
+}
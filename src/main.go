@@ -1,35 +1,35 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/go-sql-driver/mysql"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/html"
 	"io"
 	"io/ioutil"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"path"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode"
 )
 
-type AppConfig struct {
-	Db DbConfig `json:"db"`
-}
-
-type DbConfig struct {
-	User     string `json:"user"`
-	Password string `json:"pass"`
-	Server   string `json:"server"`
-	DbName   string `json:"dbName"`
-}
-
 type Post struct {
 	Id    int64
 	Url   string
@@ -41,65 +41,255 @@ type ExternalUrl struct {
 	Link   string
 	Url    *url.URL
 	PostId int64
+	// Text of the link in the post
+	AnchorText string
+	// The page's last fetch, when crawler.conditionalRequests is set and it has been fetched before
+	Prior *PriorFetch
 }
 
 type ExternalPage struct {
 	Url     ExternalUrl
 	Html    []byte
 	Fetched bool
+	// The request failed before any response was received (DNS, connection or timeout errors)
+	Unreachable bool
+	// From the Last-Modified response header, zero when absent
+	LastModified time.Time
+	// Only the start of the page was fetched with a range request
+	Partial bool
+	// The host the site is queued under, see prospectHost
+	Host string
+	// Why the page wasn't fetched, one of the failure constants, with the status and content type of the last
+	// response received and any error
+	Failure     string
+	StatusCode  int
+	ContentType string
+	Error       string
+	// AMP version advertised by a blocked page
+	AmpUrl string
+	// The blocked link when this page is its AMP or mobile alternate, see fetchAlternatePage
+	AlternateOf string
+	// The link in the post when the page was reached through redirects, and whether they went from https to http
+	RedirectedFrom   string
+	InsecureRedirect bool
+	// How long a 429 or 503 response asked us to wait before trying again
+	RetryAfter time.Duration
+	// From the ETag response header, and whether a conditional request found the page unchanged since Url.Prior,
+	// in which case it has no Html
+	ETag        string
+	NotModified bool
+	// The page was only fetched by skipping certificate verification, see scoring.detectBrokenTls
+	BrokenTls bool
+}
+
+type Discovery struct {
+	Host      string         `json:"host"`
+	Score     int            `json:"score"`
+	Breakdown map[string]int `json:"breakdown"`
+	FeedUrl   string         `json:"feed"`
+	Title     string         `json:"title"`
+	Thumbnail string         `json:"thumbnail,omitempty"`
+	// Quality flags
+	MixedContent     bool `json:"mixedContent,omitempty"`
+	InsecureRedirect bool `json:"insecureRedirect,omitempty"`
+	BrokenTls        bool `json:"brokenTls,omitempty"`
+}
+
+// The subset of *sql.DB the queries use, so they can run against a transaction or a mock in tests
+type Querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
 }
 
-var externalPagesWg sync.WaitGroup
+// The part of *sql.DB that starts transactions, so writes can run against a mock in tests
+type TxBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+func makeDbConnection(ctx context.Context, config AppConfig) (*sql.DB, error) {
+	db, err := openDb(config)
+
+	if err != nil {
+		return db, err
+	}
 
-func makeDbConnection() (*sql.DB, error) {
-	encodedJson, err := ioutil.ReadFile("config/config.json")
+	err = pingWithRetry(ctx, db, config.Db)
 	if err != nil {
-		panic(err)
+		_ = db.Close()
+		return db, err
 	}
 
-	config := AppConfig{}
+	slog.Debug("opened database connection")
+
+	return db, nil
+}
 
-	err = json.Unmarshal(encodedJson, &config)
+// A connection pool for config.Db, which only connects once it's first used
+func openDb(config AppConfig) (*sql.DB, error) {
+	db, err := sql.Open("mysql", formatDsn(config.Db))
 	if err != nil {
-		panic(err)
+		return db, err
 	}
 
+	db.SetMaxOpenConns(config.Db.MaxOpenConns)
+	db.SetMaxIdleConns(config.Db.MaxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(config.Db.ConnMaxLifetime) * time.Second)
+
+	return db, nil
+}
+
+// The driver DSN for dbConfig, with its params passed through and charset defaulting to utf8mb4
+func formatDsn(dbConfig DbConfig) string {
 	dbParams := make(map[string]string)
 	dbParams["charset"] = "utf8mb4"
 
-	dbConfig := mysql.Config{
-		User:   config.Db.User,
-		Passwd: config.Db.Password,
+	for key, value := range dbConfig.Params {
+		dbParams[key] = value
+	}
+
+	mysqlConfig := mysql.Config{
+		User:   dbConfig.User,
+		Passwd: dbConfig.Password,
 		Net:    "tcp",
-		Addr:   config.Db.Server,
-		DBName: config.Db.DbName,
+		Addr:   dbConfig.Server,
+		DBName: dbConfig.DbName,
 		Params: dbParams,
 	}
 
-	db, err := sql.Open("mysql", dbConfig.FormatDSN())
-	if err != nil {
-		return db, err
+	return mysqlConfig.FormatDSN()
+}
+
+// Ping the database until it answers, backing off between attempts, for when the service starts before MySQL
+func pingWithRetry(ctx context.Context, db *sql.DB, dbConfig DbConfig) error {
+	backoff := time.Duration(dbConfig.ConnectBackoff) * time.Second
+
+	for attempt := 1; ; attempt++ {
+		err := db.PingContext(ctx)
+
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= dbConfig.ConnectAttempts || ctx.Err() != nil {
+			return fmt.Errorf("could not reach database after %d attempts: %w", attempt, err)
+		}
+
+		slog.Warn("could not reach database, retrying", "backoff", backoff, "attempt", attempt, "attempts", dbConfig.ConnectAttempts, "error", err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		backoff = backoff * 2
 	}
+}
 
-	err = db.Ping()
-	if err != nil {
-		return db, err
+// A table name, prefixed by its schema when it lives outside the connection's database
+func qualifiedTable(schema string, table string) string {
+	if schema == "" {
+		return "`" + table + "`"
 	}
 
-	fmt.Println("opened database connection")
+	return "`" + schema + "`.`" + table + "`"
+}
 
-	return db, nil
+// Fail fast with a clear error when a table the run needs is missing, rather than partway through a run
+func checkTables(ctx context.Context, db Querier, config AppConfig) error {
+	type requiredTable struct {
+		schema string
+		table  string
+	}
+
+	tables := []requiredTable{
+		{config.Posts.Schema, "posts"},
+		{"", "discovered_sites_queue"},
+	}
+
+	for _, name := range config.Filter.HostPolicies {
+		if name == "blacklist" {
+			tables = append(tables, requiredTable{"", "discovered_sites_blacklist"})
+		}
+	}
+
+	if config.Output.RecordRejected && !config.Output.DryRun {
+		tables = append(tables, requiredTable{"", "discovered_sites_rejected"})
+	}
+
+	if config.Output.FetchLog && !config.Output.DryRun {
+		tables = append(tables, requiredTable{"", "discovery_fetch_log"})
+	}
+
+	if config.Output.StoreHtml && !config.Output.DryRun {
+		tables = append(tables, requiredTable{"", "discovered_sites_html"})
+	}
+
+	// Dry runs make conditional requests too
+	if config.Crawler.ConditionalRequests {
+		tables = append(tables, requiredTable{"", "discovery_validators"})
+	}
+
+	// Dry runs read the watermark too
+	if config.Posts.Watermark {
+		tables = append(tables, requiredTable{"", "discovery_state"})
+	}
+
+	for _, required := range tables {
+		found := 0
+
+		err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM information_schema.tables "+
+			"WHERE table_schema = COALESCE(NULLIF(?, ''), DATABASE()) AND table_name = ?",
+			required.schema, required.table).Scan(&found)
+
+		if err != nil {
+			return err
+		}
+
+		if found == 0 {
+			return fmt.Errorf("table %s does not exist", qualifiedTable(required.schema, required.table))
+		}
+	}
+
+	return nil
 }
 
-// Get the latest posts added to the posts table that have some content/HTML saved
-func getPosts(db *sql.DB) ([]Post, error) {
+// Get the latest posts added to the posts table that have some content/HTML saved, only those after afterPostId
+// when it isn't 0
+func getPosts(ctx context.Context, db Querier, postsConfig PostsConfig, afterPostId int64) ([]Post, error) {
 	var posts []Post
 
-	getPostRows, err := db.Query(
-		"SELECT pk_post_id, post_title, link, content " +
-			"FROM rss_aggregator.posts " +
-			"WHERE created >= now() - INTERVAL 2 hour " +
+	ingestedColumn := postsConfig.IngestedColumn
+
+	if ingestedColumn == "" {
+		ingestedColumn = "created"
+	}
+
+	// Posts backdated by their source or backfilled from an old feed can be recently ingested yet long published
+	pubDateFilter := ""
+
+	if postsConfig.MaxAgeHours > 0 {
+		pubDateFilter = fmt.Sprintf("AND pub_date >= now() - INTERVAL %d hour ", postsConfig.MaxAgeHours)
+	}
+
+	args := []interface{}{postsConfig.LookbackHours}
+	watermarkFilter := ""
+
+	if afterPostId > 0 {
+		watermarkFilter = "AND pk_post_id > ? "
+		args = append(args, afterPostId)
+	}
+
+	getPostRows, err := db.QueryContext(
+		ctx,
+		"SELECT pk_post_id, post_title, link, content "+
+			"FROM "+qualifiedTable(postsConfig.Schema, "posts")+" "+
+			"WHERE `"+ingestedColumn+"` >= now() - INTERVAL ? hour "+
+			pubDateFilter+
+			watermarkFilter+
 			"ORDER BY pub_date DESC",
+		args...,
 	)
 
 	if err != nil {
@@ -109,7 +299,7 @@ func getPosts(db *sql.DB) ([]Post, error) {
 	defer func(getRows *sql.Rows) {
 		err := getRows.Close()
 		if err != nil {
-			panic(err)
+			slog.Error("could not close posts query", "error", err)
 		}
 	}(getPostRows)
 
@@ -127,7 +317,7 @@ func getPosts(db *sql.DB) ([]Post, error) {
 		)
 
 		if err != nil {
-			return posts, nil
+			return posts, fmt.Errorf("could not read post: %w", err)
 		}
 
 		if len(body) > 0 {
@@ -140,12 +330,77 @@ func getPosts(db *sql.DB) ([]Post, error) {
 		}
 	}
 
+	// A connection dropped mid-result ends the loop early rather than failing a Scan
+	err = getPostRows.Err()
+
+	if err != nil {
+		return posts, fmt.Errorf("could not read posts: %w", err)
+	}
+
+	postsProcessed.Add(float64(len(posts)))
+
 	return posts, nil
 }
 
+// Links to other pages: <a> and <area> links, and <link> tags pointing at a page rather than a stylesheet or icon
+func isPostLink(token html.Token) bool {
+	switch token.Data {
+	case "a", "area":
+		return true
+	case "link":
+		for _, rel := range strings.Fields(strings.ToLower(getAttr(token, "rel"))) {
+			if rel == "canonical" || rel == "alternate" || rel == "bookmark" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Feed content is often escaped twice and hand-edited, so hrefs can carry leftover entities (&amp;) and stray
+// whitespace or line breaks, which browsers ignore
+func cleanHref(href string) string {
+	href = html.UnescapeString(href)
+
+	return strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' {
+			return -1
+		}
+
+		return r
+	}, strings.TrimSpace(href))
+}
+
+// Schemes of links that never lead to a page, skipped before they're parsed
+var nonNavigableSchemes = []string{"mailto:", "tel:", "javascript:", "data:"}
+
+// Whether a cleaned href could lead to another page, rather than being empty, an in-page anchor or a mailto:, tel:,
+// javascript: or data: link
+func isNavigableHref(href string) bool {
+	if href == "" || strings.HasPrefix(href, "#") {
+		return false
+	}
+
+	lowerHref := strings.ToLower(href)
+
+	for _, scheme := range nonNavigableSchemes {
+		if strings.HasPrefix(lowerHref, scheme) {
+			return false
+		}
+	}
+
+	return true
+}
+
 // Parse a post for external links
-func getUrlsFromPost(post Post) ([]ExternalUrl, error) {
+func getUrlsFromPost(post Post, filter FilterConfig) ([]ExternalUrl, error) {
 	var provisionalUrls []string
+	var anchorTexts []string
+
+	var ancestors ancestorStack
+
+	insideAnchor := false
 
 	r := strings.NewReader(post.Body)
 	tokenizer := html.NewTokenizer(r)
@@ -162,11 +417,30 @@ func getUrlsFromPost(post Post) ([]ExternalUrl, error) {
 		}
 
 		token := tokenizer.Token()
+		ancestors = ancestors.update(token, filter)
 
-		if token.Data == "a" {
+		if token.Type == html.EndTagToken && token.Data == "a" {
+			insideAnchor = false
+		}
+
+		if insideAnchor && token.Type == html.TextToken {
+			anchorTexts[len(anchorTexts)-1] = anchorTexts[len(anchorTexts)-1] + token.Data
+		}
+
+		isLinkTag := (token.Type == html.StartTagToken || token.Type == html.SelfClosingTagToken) && isPostLink(token)
+
+		if isLinkTag && !ancestors.insideExcluded() && !isNofollowTrap(token, filter) {
 			for i := range token.Attr {
 				if token.Attr[i].Key == "href" {
-					provisionalUrls = append(provisionalUrls, token.Attr[i].Val)
+					href := cleanHref(token.Attr[i].Val)
+
+					if !isNavigableHref(href) {
+						continue
+					}
+
+					provisionalUrls = append(provisionalUrls, href)
+					anchorTexts = append(anchorTexts, "")
+					insideAnchor = token.Data == "a" && token.Type == html.StartTagToken
 				}
 			}
 		}
@@ -175,21 +449,31 @@ func getUrlsFromPost(post Post) ([]ExternalUrl, error) {
 	var externalUrls []ExternalUrl
 
 	if len(provisionalUrls) > 0 {
+		trapPatterns := compileTrapPatterns(filter.TrapPathPatterns)
+
 		postUrl, err := url.Parse(post.Url)
 
 		if err != nil {
-			fmt.Println("could not parse parent post url", post.Url, err)
+			slog.Error("could not parse parent post url", "post_id", post.Id, "url", post.Url, "error", err)
 			return nil, err
 		}
 
+		// Links already taken from this post, so the same page linked twice is only a candidate once
+		seenLinks := make(map[string]struct{})
+
 		for key, provisionalUrl := range provisionalUrls {
 			parsedUrl, err := url.Parse(provisionalUrl)
 
 			if err != nil {
-				fmt.Println("could not parse url", provisionalUrl, err, key)
+				slog.Debug("could not parse url", "post_id", post.Id, "url", provisionalUrl, "error", err)
 				continue
 			}
 
+			// Relative, root-relative and protocol-relative links point at the post's own site or scheme
+			parsedUrl = postUrl.ResolveReference(parsedUrl)
+			parsedUrl.Fragment = ""
+			parsedUrl.RawFragment = ""
+
 			fileExt := strings.ToLower(path.Ext(parsedUrl.Path))
 
 			if fileExt == ".png" || fileExt == ".jpg" || fileExt == ".gif" || fileExt == ".mp4" {
@@ -200,11 +484,28 @@ func getUrlsFromPost(post Post) ([]ExternalUrl, error) {
 				continue
 			}
 
-			if postUrl.Host != parsedUrl.Host {
+			if filter.SkipIpHosts && isIpHost(parsedUrl) {
+				continue
+			}
+
+			if isTrapPath(parsedUrl, trapPatterns) {
+				continue
+			}
+
+			link := parsedUrl.String()
+
+			if _, seen := seenLinks[link]; seen {
+				continue
+			}
+
+			if normalizeHost(postUrl.Host) != normalizeHost(parsedUrl.Host) || isAggregatorHost(parsedUrl.Host, filter.AggregatorHosts) {
+				seenLinks[link] = struct{}{}
+
 				externalUrls = append(externalUrls, ExternalUrl{
-					Link:   provisionalUrl,
-					Url:    parsedUrl,
-					PostId: post.Id,
+					Link:       link,
+					Url:        parsedUrl,
+					PostId:     post.Id,
+					AnchorText: strings.TrimSpace(anchorTexts[key]),
 				})
 			}
 		}
@@ -213,13 +514,21 @@ func getUrlsFromPost(post Post) ([]ExternalUrl, error) {
 	return externalUrls, nil
 }
 
+// Bare IP address links (v4 or v6) are almost never legitimate feed sites
+func isIpHost(u *url.URL) bool {
+	return net.ParseIP(u.Hostname()) != nil
+}
+
 // The external site may have already been queued, so before we try to fetch it, let's check
-func isInBlacklist(db *sql.DB, candidate ExternalUrl) (bool, error) {
+func isInBlacklist(ctx context.Context, db Querier, host string) (bool, error) {
 	var hostInBlacklist int
 
-	err := db.QueryRow("SELECT COUNT(*) AS ttl "+
+	host = normalizeHost(host)
+
+	// Older entries were stored as written, some with their www
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) AS ttl "+
 		"FROM discovered_sites_blacklist "+
-		"WHERE host = ?", candidate.Url.Host).Scan(&hostInBlacklist)
+		"WHERE host IN (?, ?)", host, "www."+host).Scan(&hostInBlacklist)
 
 	if err != nil {
 		return false, err
@@ -232,381 +541,1773 @@ func isInBlacklist(db *sql.DB, candidate ExternalUrl) (bool, error) {
 	return false, nil
 }
 
-// Fetch the HTML of the external site/page
-func fetchExternalPages(candidates []ExternalUrl) ([]ExternalPage, error) {
-	var externalPages []ExternalPage
-
-	externalPageChannel := make(chan ExternalPage, len(candidates))
+// Every blacklisted host, normalized, so a run checks its candidates in memory rather than with a query each
+func getBlacklistedHosts(ctx context.Context, db Querier) (map[string]bool, error) {
+	hosts := make(map[string]bool)
 
-	ttlSitesToFetch := len(candidates)
-	step := 100
+	rows, err := db.QueryContext(ctx, "SELECT host FROM discovered_sites_blacklist")
 
-	if step >= ttlSitesToFetch {
-		step = ttlSitesToFetch
+	if err != nil {
+		return hosts, err
 	}
 
-	for i := 0; i < ttlSitesToFetch; i++ {
-		fetchExternalPageBatch(candidates[i:step], externalPageChannel)
-
-		i += 99
-		step += 100
-
-		if step >= ttlSitesToFetch {
-			step = ttlSitesToFetch
-		}
-	}
+	defer func(rows *sql.Rows) {
+		_ = rows.Close()
+	}(rows)
 
-	fmt.Println("finished fetching candidate pages")
-	close(externalPageChannel)
+	for rows.Next() {
+		var host string
 
-	for j := 0; j < len(candidates); j++ {
-		externalPageInstance := <-externalPageChannel
+		err = rows.Scan(&host)
 
-		if externalPageInstance.Fetched {
-			externalPages = append(externalPages, externalPageInstance)
+		if err != nil {
+			return hosts, err
 		}
-	}
-
-	return externalPages, nil
-}
-
-func fetchExternalPageBatch(candidates []ExternalUrl, externalPageChannel chan<- ExternalPage) {
-	for _, candidate := range candidates {
-		externalPagesWg.Add(1)
 
-		go fetchExternalPage(candidate, externalPageChannel)
+		hosts[normalizeHost(host)] = true
 	}
 
-	externalPagesWg.Wait()
+	return hosts, rows.Err()
 }
 
-func fetchExternalPage(candidate ExternalUrl, externalPageChannel chan<- ExternalPage) {
-	var externalPage = ExternalPage{
-		Url:     candidate,
-		Fetched: false,
-	}
-
-	defer func(externalPage *ExternalPage, externalPageChannel chan<- ExternalPage) {
-		externalPageChannel <- *externalPage
-		externalPagesWg.Done()
-	}(&externalPage, externalPageChannel)
+func isTooLarge(bytes int64, crawler CrawlerConfig) bool {
+	return crawler.MaxBodyBytes > 0 && bytes > crawler.MaxBodyBytes
+}
 
-	headReq, err := http.NewRequest("HEAD", candidate.Link, nil)
+// Whether the media type of a Content-Type header is one of crawler.AcceptedContentTypes, whatever its parameters
+func isAcceptedContentType(contentType string, crawler CrawlerConfig) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
 
-	if err != nil {
-		fmt.Println("could not created head request", candidate.Link, err)
-		return
+	// A malformed parameter, such as a stray semicolon after the charset, still leaves the media type readable
+	if err != nil && !errors.Is(err, mime.ErrInvalidMediaParameter) {
+		return false
 	}
 
-	if !strings.Contains(candidate.Link, "tumblr.com") {
-		headReq.Header.Add("User-Agent", "@bateszi auto-discover spider")
-	} else {
-		headReq.Header.Add("User-Agent", "Baiduspider")
+	for _, accepted := range crawler.AcceptedContentTypes {
+		if strings.EqualFold(mediaType, strings.TrimSpace(accepted)) {
+			return true
+		}
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	return false
+}
 
-	defer func(cancel context.CancelFunc) {
-		cancel()
-	}(cancel)
+// Sends the crawler's HTTP requests. *http.Client satisfies it, and tests can swap in a stub
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Fetch the candidates, returning the fetched pages and the pages that failed
+func (d *Discoverer) fetchExternalPages(ctx context.Context, candidates []ExternalUrl) ([]ExternalPage, []ExternalPage, error) {
+	crawler := d.Config.Crawler
 
-	headReq = headReq.WithContext(ctx)
+	var externalPages []ExternalPage
+	var failedPages []ExternalPage
 
-	headHttpClient := &http.Client{}
-	headResponse, err := headHttpClient.Do(headReq)
+	remaining := candidates
+	outageBackoff := time.Duration(0)
+	outageWaited := time.Duration(0)
 
-	if err != nil {
-		fmt.Println("error making head request", candidate.Link, err)
-		return
-	}
+	for len(remaining) > 0 {
+		// On shutdown, stop at the end of the batch and let the caller queue what was fetched
+		if ctx.Err() != nil {
+			return externalPages, failedPages, ctx.Err()
+		}
 
-	defer func(resp *http.Response) {
-		_ = resp.Body.Close()
-	}(headResponse)
+		step := 100
 
-	verifiedContentType := false
+		if step >= len(remaining) {
+			step = len(remaining)
+		}
 
-	if headResponse.StatusCode == http.StatusOK && headResponse.StatusCode < 300 {
-		contentType := headResponse.Header.Get("Content-Type")
-		verifiedContentType = strings.Contains(contentType, "text/html")
-	}
+		batch := remaining[:step]
+		remaining = remaining[step:]
 
-	if verifiedContentType {
-		getReq, err := http.NewRequest("GET", candidate.Link, nil)
+		var unreachable []ExternalPage
 
-		if err != nil {
-			fmt.Println("could not created get request", candidate.Link, err)
-			return
+		for _, externalPageInstance := range d.fetchExternalPageBatch(ctx, batch) {
+			if externalPageInstance.Fetched {
+				externalPages = append(externalPages, externalPageInstance)
+			} else if externalPageInstance.Unreachable {
+				unreachable = append(unreachable, externalPageInstance)
+			} else if crawler.FetchAlternates && isBlockedPage(externalPageInstance) {
+				alternatePage, fetched := d.fetchAlternatePage(ctx, externalPageInstance)
+
+				if fetched {
+					externalPages = append(externalPages, alternatePage)
+				} else {
+					failedPages = append(failedPages, externalPageInstance)
+				}
+			} else {
+				failedPages = append(failedPages, externalPageInstance)
+			}
 		}
 
-		if !strings.Contains(candidate.Link, "tumblr.com") {
-			getReq.Header.Add("User-Agent", "@bateszi auto-discover spider")
-		} else {
-			getReq.Header.Add("User-Agent", "Baiduspider")
+		if ctx.Err() != nil || !isNetworkOutage(len(unreachable), len(batch), crawler) {
+			outageBackoff = 0
+			failedPages = append(failedPages, unreachable...)
+			continue
 		}
 
-		getCtx, getCancel := context.WithTimeout(context.Background(), time.Second*10)
+		outageBackoff = nextOutageBackoff(outageBackoff)
 
-		defer func(cancel context.CancelFunc) {
-			cancel()
-		}(getCancel)
+		if outageWaited+outageBackoff > time.Duration(crawler.OutageMaxWait)*time.Second {
+			slog.Error("network still unreachable, giving up on candidates", "candidates", len(unreachable))
+			failedPages = append(failedPages, unreachable...)
+			continue
+		}
 
-		getReq = getReq.WithContext(getCtx)
+		slog.Warn("network appears to be unreachable, pausing fetches", "backoff", outageBackoff)
+		select {
+		case <-time.After(outageBackoff):
+		case <-ctx.Done():
+			failedPages = append(failedPages, unreachable...)
+			continue
+		}
 
-		getHttpClient := &http.Client{}
-		getResponse, err := getHttpClient.Do(getReq)
+		outageWaited = outageWaited + outageBackoff
 
-		if err != nil {
-			fmt.Println("error making get request", candidate.Link, err)
-			return
+		// Retry the candidates lost to the outage before moving on to the rest
+		var retries []ExternalUrl
+
+		for _, unreachablePage := range unreachable {
+			retries = append(retries, unreachablePage.Url)
 		}
 
-		defer func(resp *http.Response) {
-			_ = resp.Body.Close()
-		}(getResponse)
+		remaining = append(retries, remaining...)
+	}
 
-		if getResponse.StatusCode == http.StatusOK && getResponse.StatusCode < 300 {
-			externalPage.Html, err = ioutil.ReadAll(getResponse.Body)
+	slog.Info("finished fetching candidate pages", "fetched", len(externalPages), "failed", len(failedPages))
 
-			if err != nil {
-				fmt.Println("could not read response body", candidate.Link, err)
-				return
-			}
+	return externalPages, failedPages, nil
+}
 
-			externalPage.Fetched = true
-		}
+// When nearly every fetch in a batch fails to connect, the problem is our network rather than the sites
+func isNetworkOutage(unreachable int, attempted int, crawler CrawlerConfig) bool {
+	if crawler.OutageMaxWait <= 0 || attempted == 0 || attempted < crawler.OutageMinFetches {
+		return false
 	}
-}
 
-func getRelevancyScore(site ExternalPage) int {
-	wordMap := make(map[string]int)
-	wordMap["anime"] = 0
-	wordMap["manga"] = 0
+	return float64(unreachable)/float64(attempted) > crawler.OutageFailureRate
+}
 
-	r := bytes.NewReader(site.Html)
-	scanner := bufio.NewScanner(r)
-	scanner.Split(bufio.ScanWords)
+// Only pages we couldn't connect to are unreachable, as those are what an outage looks like. A TLS failure or a
+// slow server got as far as the site, so says nothing about our network
+func setRequestFailure(externalPage *ExternalPage, err error) {
+	externalPage.Error = err.Error()
+
+	switch {
+	case isCertificateError(err):
+		externalPage.Failure = failureCertificate
+	case isConnectionFailure(err):
+		externalPage.Unreachable = true
+		externalPage.Failure = failureUnreachable
+	case isTimeout(err):
+		externalPage.Failure = failureTimeout
+	default:
+		externalPage.Failure = failureRequestError
+	}
+}
 
-	for scanner.Scan() {
-		word := strings.ToLower(scanner.Text())
+// DNS failures, and dials that were refused or found no route, rather than ones that timed out
+func isConnectionFailure(err error) bool {
+	var dnsErr *net.DNSError
 
-		if count, ok := wordMap[word]; ok {
-			wordMap[word] = count + 1
-		}
+	if errors.As(err, &dnsErr) {
+		return true
 	}
 
-	ttlScore := 0
+	var opErr *net.OpError
 
-	for _, wordCount := range wordMap {
-		ttlScore = ttlScore + wordCount
+	if !errors.As(err, &opErr) || opErr.Timeout() {
+		return false
 	}
 
-	return ttlScore
+	return opErr.Op == "dial" || errors.Is(opErr, syscall.ECONNREFUSED)
 }
 
-func getRssFeedUrl(site ExternalPage) string {
-	var rssFeedUrl string
-	hasRssFeed := false
+func isTimeout(err error) bool {
+	var netErr net.Error
 
-	r := bytes.NewReader(site.Html)
-	tokenizer := html.NewTokenizer(r)
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
 
-	for {
-		tokenType := tokenizer.Next()
+func nextOutageBackoff(previous time.Duration) time.Duration {
+	if previous == 0 {
+		return 5 * time.Second
+	}
 
-		if tokenType == html.ErrorToken {
-			err := tokenizer.Err()
+	return previous * 2
+}
 
-			if err == io.EOF {
-				break
-			}
-		}
+// A fetched page and the position of its candidate in the batch
+type batchPage struct {
+	index int
+	page  ExternalPage
+}
 
-		token := tokenizer.Token()
+func (d *Discoverer) fetchExternalPageBatch(ctx context.Context, candidates []ExternalUrl) []ExternalPage {
+	crawler := d.Config.Crawler
 
-		if token.Data == "link" && !hasRssFeed {
-			linkHref := ""
+	// Pages are kept in the order of their candidates rather than the order their fetches finish in
+	externalPages := make([]ExternalPage, len(candidates))
 
-			for i := range token.Attr {
-				if token.Attr[i].Key == "type" && token.Attr[i].Val == "application/rss+xml" {
-					hasRssFeed = true
-				} else if token.Attr[i].Key == "href" {
-					linkHref = token.Attr[i].Val
-				}
-			}
+	externalPageChannel := make(chan batchPage, len(candidates))
 
-			if hasRssFeed {
-				rssFeedUrl = linkHref
-				break
-			}
-		}
+	concurrency := crawler.MaxConcurrency
+
+	if concurrency < 1 {
+		concurrency = len(candidates)
 	}
 
-	return rssFeedUrl
-}
+	// Fetches take a slot only while they are making requests, so a page waiting to be retried doesn't hold one
+	slots := make(chan struct{}, concurrency)
 
-// Add the site to the queue for review
-func addSiteToReviewQueue(db *sql.DB, site ExternalPage, score int, rssFeedUrl string) (bool, error) {
-	prospectId := 0
-	existingScore := 0
-	encountered := 1
+	var wg sync.WaitGroup
 
-	err := db.QueryRow("SELECT pk_prospect_id, score, encountered "+
-		"FROM discovered_sites_queue "+
-		"WHERE fqdn = ?", site.Url.Url.Host).Scan(&prospectId, &existingScore, &encountered)
+	for index, candidate := range candidates {
+		wg.Add(1)
 
-	if err != nil {
-		if err.Error() != "sql: no rows in result set" {
-			return false, err
-		}
+		// First attempts are given their slots in candidate order, so the most promising candidates go first
+		slots <- struct{}{}
+
+		go func(index int, candidate ExternalUrl) {
+			defer wg.Done()
+
+			d.fetchExternalPage(ctx, index, candidate, slots, externalPageChannel)
+		}(index, candidate)
 	}
 
-	if prospectId > 0 {
-		existingScore = existingScore + score
-		encountered++
+	wg.Wait()
+	close(externalPageChannel)
 
-		stmt, err := db.Prepare("UPDATE `discovered_sites_queue` " +
-			"SET `score` = ?, `encountered` = ?, `feed_url` = ? " +
-			"WHERE `fqdn` = ?")
+	received := make([]bool, len(candidates))
 
-		if err != nil {
-			return false, err
+	for fetched := range externalPageChannel {
+		externalPages[fetched.index] = fetched.page
+		received[fetched.index] = true
+	}
+
+	// A fetch that ended without sending its page still counts as failed
+	for index, candidate := range candidates {
+		if !received[index] {
+			externalPages[index] = ExternalPage{
+				Url:     candidate,
+				Failure: failureNoResult,
+			}
 		}
+	}
 
-		_, err = stmt.Exec(
-			existingScore,
-			encountered,
-			rssFeedUrl,
-			site.Url.Url.Host,
-		)
+	return externalPages
+}
 
-		if err != nil {
-			return false, err
-		}
-	} else {
-		stmt, err := db.Prepare(
-			"INSERT INTO `discovered_sites_queue` (`fqdn`, `score`, `encountered`, `feed_url`) VALUES (?, ?, ?, ?)",
-		)
+// The user agent of the first rule matching the link's host, or crawler.UserAgent when none does
+func getUserAgent(link string, crawler CrawlerConfig) string {
+	linkUrl, err := url.Parse(link)
 
-		if err != nil {
-			return false, err
-		}
+	if err != nil {
+		return crawler.UserAgent
+	}
 
-		_, err = stmt.Exec(
-			site.Url.Url.Host,
-			score,
-			encountered,
-			rssFeedUrl,
-		)
+	host := strings.ToLower(linkUrl.Hostname())
 
-		if err != nil {
-			return false, err
+	for _, rule := range crawler.UserAgentRules {
+		if hasHostSuffix(host, strings.ToLower(rule.HostSuffix)) {
+			return rule.UserAgent
 		}
 	}
 
-	fmt.Println("queued", site.Url.Url.Host)
-	return true, nil
+	return crawler.UserAgent
 }
 
-func start() {
-	fmt.Println("starting auto discovery service")
+// Whether host is suffix or one of its subdomains, so tumblr.com matches example.tumblr.com but not nottumblr.com
+func hasHostSuffix(host string, suffix string) bool {
+	suffix = strings.TrimPrefix(suffix, ".")
 
-	db, err := makeDbConnection()
+	return suffix != "" && (host == suffix || strings.HasSuffix(host, "."+suffix))
+}
 
-	if err != nil {
-		fmt.Println("could not open db connection", err)
-		return
+func (d *Discoverer) fetchExternalPage(ctx context.Context, index int, candidate ExternalUrl, slots chan struct{}, externalPageChannel chan<- batchPage) {
+	crawler := d.Config.Crawler
+
+	var externalPage = ExternalPage{
+		Url:     candidate,
+		Fetched: false,
+	}
+
+	// Time spent waiting for a slot or to retry doesn't count towards the host's response time
+	var responseTime time.Duration
+
+	ctx, span := tracer.Start(ctx, "discovery.fetch", trace.WithAttributes(
+		attribute.String("host", candidate.Url.Host),
+		attribute.String("url", candidate.Link),
+	))
+
+	defer func(externalPage *ExternalPage, externalPageChannel chan<- batchPage) {
+		// One malformed candidate mustn't take down the whole crawl
+		if recovered := recover(); recovered != nil {
+			slog.Error("fetch panicked", "host", candidate.Url.Host, "url", candidate.Link, "error", recovered, "stack", string(debug.Stack()))
+			externalPage.Fetched = false
+			externalPage.Failure = failurePanic
+			externalPage.Error = fmt.Sprint(recovered)
+		}
+
+		span.SetAttributes(
+			attribute.Bool("fetched", externalPage.Fetched),
+			attribute.Bool("unreachable", externalPage.Unreachable),
+			attribute.String("failure", externalPage.Failure),
+		)
+		span.End()
+
+		fetchLatency.Observe(responseTime.Seconds())
+
+		if externalPage.Fetched {
+			pagesFetched.Inc()
+		} else {
+			fetchErrors.WithLabelValues(externalPage.Failure).Inc()
+		}
+
+		if crawler.SlowResponseMs > 0 && responseTime > 0 {
+			d.slowHosts.record(
+				candidate.Url.Host,
+				responseTime,
+				time.Duration(crawler.SlowResponseMs)*time.Millisecond,
+			)
+		}
+
+		externalPageChannel <- batchPage{index: index, page: *externalPage}
+	}(&externalPage, externalPageChannel)
+
+	for attempt := 0; ; attempt++ {
+		var attemptTime time.Duration
+		externalPage, attemptTime = d.fetchWithSlots(ctx, d.Client, candidate, slots, attempt == 0)
+		responseTime = responseTime + attemptTime
+
+		// A certificate that doesn't verify marks a neglected site rather than one to skip
+		if externalPage.Failure == failureCertificate && d.insecureClient != nil {
+			slog.Debug("certificate not valid, fetching without verifying it", "host", candidate.Url.Host, "url", candidate.Link, "error", externalPage.Error)
+			externalPage, attemptTime = d.fetchWithSlots(ctx, d.insecureClient, candidate, slots, false)
+			responseTime = responseTime + attemptTime
+			externalPage.BrokenTls = true
+		}
+
+		retryDelay, retry := getRetryDelay(externalPage, attempt, crawler)
+
+		if !retry || ctx.Err() != nil {
+			return
+		}
+
+		slog.Debug("retrying fetch", "host", candidate.Url.Host, "url", candidate.Link, "attempt", attempt+1, "delay", retryDelay)
+
+		select {
+		case <-time.After(retryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Fetch the page once, holding one of the batch's slots and one of its host's until the attempt is over. Returns the
+// page and how long the attempt took once it had its slots. A first attempt already holds the slot the batch gave it
+func (d *Discoverer) fetchWithSlots(ctx context.Context, client Doer, candidate ExternalUrl, slots chan struct{}, holdingSlot bool) (ExternalPage, time.Duration) {
+	if !holdingSlot {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return ExternalPage{Url: candidate, Failure: failureCancelled, Error: ctx.Err().Error()}, 0
+		}
+	}
+
+	defer func() {
+		<-slots
+	}()
+
+	releaseHost, err := d.hostConcurrency.acquire(ctx, candidate.Url.Host, d.Config.Crawler.MaxPerHostConcurrency)
+
+	if err != nil {
+		slog.Error("gave up waiting to fetch from host", "host", candidate.Url.Host, "url", candidate.Link, "error", err)
+		return ExternalPage{Url: candidate, Failure: failureCancelled, Error: err.Error()}, 0
+	}
+
+	defer releaseHost()
+
+	attemptStarted := time.Now()
+	externalPage := d.fetchExternalPageWith(ctx, client, candidate)
+
+	return externalPage, time.Since(attemptStarted)
+}
+
+// Fetch the page once: HEAD it to check it is html, then GET it
+func (d *Discoverer) fetchExternalPageAttempt(ctx context.Context, candidate ExternalUrl) ExternalPage {
+	return d.fetchExternalPageWith(ctx, d.Client, candidate)
+}
+
+func (d *Discoverer) fetchExternalPageWith(ctx context.Context, client Doer, candidate ExternalUrl) (externalPage ExternalPage) {
+	crawler := d.Config.Crawler
+	externalPage.Url = candidate
+
+	headReq, err := http.NewRequest("HEAD", candidate.Link, nil)
+
+	if err != nil {
+		slog.Error("could not create head request", "host", candidate.Url.Host, "url", candidate.Link, "error", err)
+		externalPage.Failure = failureInvalidRequest
+		externalPage.Error = err.Error()
+		return
+	}
+
+	headReq.Header.Add("User-Agent", getUserAgent(candidate.Link, crawler))
+	addConditionalHeaders(headReq, candidate)
+
+	// The timeout starts once the host's turn comes round, so waiting out a Crawl-delay doesn't count against it
+	err = d.hostRates.wait(ctx, client, candidate.Url, crawler)
+
+	if err != nil {
+		externalPage.Failure = failureCancelled
+		externalPage.Error = err.Error()
+		return
+	}
+
+	headCtx, cancel := context.WithTimeout(ctx, time.Duration(crawler.Timeout)*time.Second)
+
+	defer func(cancel context.CancelFunc) {
+		cancel()
+	}(cancel)
+
+	headReq = headReq.WithContext(headCtx)
+
+	headResponse, err := client.Do(headReq)
+
+	if errors.Is(err, errTooManyRedirects) {
+		slog.Warn("skipping page with too many redirects", "host", candidate.Url.Host, "url", candidate.Link, "error", err)
+		externalPage.Failure = failureTooManyRedirects
+		externalPage.Error = err.Error()
+		return
+	}
+
+	if errors.Is(err, errPrivateHost) {
+		slog.Warn("skipping page on a private host", "host", candidate.Url.Host, "url", candidate.Link, "error", err)
+		externalPage.Failure = failurePrivateHost
+		externalPage.Error = err.Error()
+		return
+	}
+
+	// Fetches still in flight at shutdown say nothing about the site
+	if err != nil && ctx.Err() != nil {
+		externalPage.Failure = failureCancelled
+		externalPage.Error = err.Error()
+		return
+	}
+
+	if err != nil {
+		slog.Error("error making head request", "host", candidate.Url.Host, "url", candidate.Link, "error", err)
+		setRequestFailure(&externalPage, err)
+		return
+	}
+
+	defer func(resp *http.Response) {
+		_ = resp.Body.Close()
+	}(headResponse)
+
+	externalPage.StatusCode = headResponse.StatusCode
+	externalPage.ContentType = headResponse.Header.Get("Content-Type")
+
+	if headResponse.StatusCode == http.StatusNotModified && candidate.Prior != nil {
+		externalPage.NotModified = true
+		externalPage.Fetched = true
+		return
+	}
+
+	verifiedContentType := false
+
+	// Servers that don't support HEAD get their content type checked on the GET instead. A blocked HEAD is
+	// followed by a GET too when alternates are fetched, to read the AMP link from the blocked page
+	headUnsupported := headResponse.StatusCode == http.StatusMethodNotAllowed ||
+		headResponse.StatusCode == http.StatusNotImplemented ||
+		(crawler.FetchAlternates && isBlockedStatus(headResponse.StatusCode))
+
+	if headUnsupported {
+		verifiedContentType = true
+	} else if headResponse.StatusCode == http.StatusOK && headResponse.StatusCode < 300 {
+		contentType := headResponse.Header.Get("Content-Type")
+		verifiedContentType = isAcceptedContentType(contentType, crawler)
+
+		if !verifiedContentType {
+			externalPage.Failure = failureContentType
+			externalPage.Error = contentType
+		} else if isTooLarge(headResponse.ContentLength, crawler) {
+			slog.Warn("skipping page larger than the body limit", "host", candidate.Url.Host, "url", candidate.Link, "bytes", headResponse.ContentLength)
+			verifiedContentType = false
+			externalPage.Failure = failureTooLarge
+			externalPage.Error = fmt.Sprintf("%d bytes", headResponse.ContentLength)
+		}
+	} else {
+		externalPage.Failure = failureHttpStatus
+		externalPage.RetryAfter = parseRetryAfter(headResponse.Header.Get("Retry-After"))
+	}
+
+	if verifiedContentType {
+		getReq, err := http.NewRequest("GET", candidate.Link, nil)
+
+		if err != nil {
+			slog.Error("could not create get request", "host", candidate.Url.Host, "url", candidate.Link, "error", err)
+			externalPage.Failure = failureInvalidRequest
+			externalPage.Error = err.Error()
+			return
+		}
+
+		getReq.Header.Add("User-Agent", getUserAgent(candidate.Link, crawler))
+
+		getReq.Header.Add("Accept-Encoding", "gzip")
+		addConditionalHeaders(getReq, candidate)
+
+		if crawler.RangeBytes > 0 {
+			getReq.Header.Add("Range", fmt.Sprintf("bytes=0-%d", crawler.RangeBytes-1))
+		}
+
+		err = d.hostRates.wait(ctx, client, candidate.Url, crawler)
+
+		if err != nil {
+			externalPage.Failure = failureCancelled
+			externalPage.Error = err.Error()
+			return
+		}
+
+		getCtx, getCancel := context.WithTimeout(ctx, time.Duration(crawler.Timeout)*time.Second)
+
+		defer func(cancel context.CancelFunc) {
+			cancel()
+		}(getCancel)
+
+		getReq = getReq.WithContext(getCtx)
+
+		getResponse, err := client.Do(getReq)
+
+		if errors.Is(err, errTooManyRedirects) {
+			slog.Warn("skipping page with too many redirects", "host", candidate.Url.Host, "url", candidate.Link, "error", err)
+			externalPage.Failure = failureTooManyRedirects
+			externalPage.Error = err.Error()
+			return
+		}
+
+		if errors.Is(err, errPrivateHost) {
+			slog.Warn("skipping page on a private host", "host", candidate.Url.Host, "url", candidate.Link, "error", err)
+			externalPage.Failure = failurePrivateHost
+			externalPage.Error = err.Error()
+			return
+		}
+
+		if err != nil && ctx.Err() != nil {
+			externalPage.Failure = failureCancelled
+			externalPage.Error = err.Error()
+			return
+		}
+
+		if err != nil {
+			slog.Error("error making get request", "host", candidate.Url.Host, "url", candidate.Link, "error", err)
+			setRequestFailure(&externalPage, err)
+			return
+		}
+
+		defer func(resp *http.Response) {
+			_ = resp.Body.Close()
+		}(getResponse)
+
+		externalPage.StatusCode = getResponse.StatusCode
+		externalPage.ContentType = getResponse.Header.Get("Content-Type")
+
+		if getResponse.StatusCode == http.StatusNotModified && candidate.Prior != nil {
+			externalPage.NotModified = true
+			externalPage.Fetched = true
+			return
+		}
+
+		// Servers that ignore the Range header answer with the whole page, which is used as is
+		externalPage.Partial = crawler.RangeBytes > 0 && getResponse.StatusCode == http.StatusPartialContent
+
+		if (getResponse.StatusCode == http.StatusOK && getResponse.StatusCode < 300) || externalPage.Partial {
+			if contentType := getResponse.Header.Get("Content-Type"); headUnsupported && !isAcceptedContentType(contentType, crawler) {
+				externalPage.Failure = failureContentType
+				externalPage.Error = contentType
+				return
+			}
+
+			body := io.Reader(getResponse.Body)
+
+			if externalPage.Partial {
+				body = io.LimitReader(body, int64(crawler.RangeBytes))
+			}
+
+			body, err = decompressBody(body, getResponse.Header.Get("Content-Encoding"))
+
+			if err != nil {
+				slog.Error("could not decompress response body", "host", candidate.Url.Host, "url", candidate.Link, "error", err)
+				externalPage.Failure = failureReadError
+				externalPage.Error = err.Error()
+				return
+			}
+
+			// Read one byte past the limit to tell a page that fits exactly from one that was cut off
+			if crawler.MaxBodyBytes > 0 {
+				body = io.LimitReader(body, crawler.MaxBodyBytes+1)
+			}
+
+			externalPage.Html, err = ioutil.ReadAll(body)
+
+			// A partial page cuts its compressed stream short
+			if externalPage.Partial && err == io.ErrUnexpectedEOF {
+				err = nil
+			}
+
+			if err != nil && ctx.Err() != nil {
+				externalPage.Failure = failureCancelled
+				externalPage.Error = err.Error()
+				return
+			}
+
+			if err != nil {
+				slog.Error("could not read response body", "host", candidate.Url.Host, "url", candidate.Link, "error", err)
+				externalPage.Failure = failureReadError
+				externalPage.Error = err.Error()
+				return
+			}
+
+			// A truncated page would be scored and searched for feeds on an arbitrary fragment, so it is skipped
+			if isTooLarge(int64(len(externalPage.Html)), crawler) {
+				slog.Warn("skipping page larger than the body limit", "host", candidate.Url.Host, "url", candidate.Link, "limit", crawler.MaxBodyBytes)
+				externalPage.Html = nil
+				externalPage.Failure = failureTooLarge
+				externalPage.Error = fmt.Sprintf("more than %d bytes", crawler.MaxBodyBytes)
+				return
+			}
+
+			externalPage.Html = decodeToUtf8(
+				externalPage.Html,
+				getResponse.Header.Get("Content-Type"),
+				crawler,
+				candidate.Link,
+			)
+
+			if lastModified, err := http.ParseTime(getResponse.Header.Get("Last-Modified")); err == nil {
+				externalPage.LastModified = lastModified
+			}
+
+			externalPage.ETag = getResponse.Header.Get("ETag")
+
+			followRedirect(&externalPage, getResponse)
+
+			externalPage.Fetched = true
+		} else {
+			externalPage.Failure = failureHttpStatus
+			externalPage.RetryAfter = parseRetryAfter(getResponse.Header.Get("Retry-After"))
+
+			if crawler.FetchAlternates && isBlockedPage(externalPage) {
+				blockedBody, err := decompressBody(getResponse.Body, getResponse.Header.Get("Content-Encoding"))
+
+				if err == nil {
+					blockedHtml, _ := ioutil.ReadAll(io.LimitReader(blockedBody, 256*1024))
+					externalPage.AmpUrl = getAmpUrl(blockedHtml, candidate.Url)
+				}
+			}
+		}
+	}
+
+	return
+}
+
+// A page's keyword score split by where the keywords were found. Title and Description are the weighted keyword
+// hits in those zones before their multipliers are applied
+type RelevancyScore struct {
+	Total       int
+	Title       int
+	Description int
+	Body        int
+	// Hits per keyword across all zones
+	Counts map[string]int
+}
+
+// Score the page by weighted keyword occurrences in its title, meta description and visible text, with hits in
+// the title and description multiplied so pages that are about the topic outrank ones that mention it in passing
+func getRelevancyScore(site ExternalPage, keywords map[string]int, scoring ScoringConfig) RelevancyScore {
+	score := RelevancyScore{
+		Counts: make(map[string]int),
+	}
+
+	for keyword := range keywords {
+		score.Counts[keyword] = 0
+	}
+
+	counter := NewKeywordCounter(keywords, scoring)
+	zones := getPageZones(site)
+
+	score.Title = counter.Count(zones.Title, score.Counts)
+	score.Description = counter.Count(zones.Description, score.Counts)
+	score.Body = counter.Count(zones.Body, score.Counts)
+	score.Total = score.Title*scoring.TitleMultiplier + score.Description*scoring.DescriptionMultiplier + score.Body
+
+	return score
+}
+
+// A site at example.com/anime-reviews/ signals its topic through the URL itself
+func getUrlKeywordScore(site ExternalPage, scoring ScoringConfig) int {
+	if len(scoring.UrlKeywords) == 0 || scoring.UrlKeywordWeight == 0 {
+		return 0
+	}
+
+	keywords := make(map[string]bool)
+
+	for _, keyword := range scoring.UrlKeywords {
+		keywords[strings.ToLower(keyword)] = true
+	}
+
+	urlWords := strings.FieldsFunc(
+		strings.ToLower(site.Url.Url.Hostname()+"/"+site.Url.Url.Path),
+		func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+		},
+	)
+
+	score := 0
+
+	for _, word := range urlWords {
+		if keywords[word] {
+			score = score + scoring.UrlKeywordWeight
+		}
+	}
+
+	return score
+}
+
+func getPageTitle(site ExternalPage) string {
+	r := bytes.NewReader(site.Html)
+	tokenizer := html.NewTokenizer(r)
+	inTitle := false
+
+	for {
+		tokenType := tokenizer.Next()
+
+		switch tokenType {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken:
+			inTitle = tokenizer.Token().Data == "title"
+		case html.TextToken:
+			if inTitle {
+				return strings.TrimSpace(tokenizer.Token().Data)
+			}
+		case html.EndTagToken:
+			inTitle = false
+		}
 	}
+}
+
+// The absolute URL of the page's <link rel="canonical">, or an empty string when it has none
+func getCanonicalUrl(site ExternalPage) string {
+	tokenizer := html.NewTokenizer(bytes.NewReader(site.Html))
+
+	for {
+		tokenType := tokenizer.Next()
+
+		if tokenType == html.ErrorToken {
+			return ""
+		}
+
+		if tokenType == html.EndTagToken {
+			if tagName, _ := tokenizer.TagName(); string(tagName) == "head" {
+				return ""
+			}
+
+			continue
+		}
+
+		if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+			continue
+		}
+
+		token := tokenizer.Token()
+
+		if token.Data == "body" {
+			return ""
+		}
+
+		if token.Data != "link" || !strings.EqualFold(strings.TrimSpace(getAttr(token, "rel")), "canonical") {
+			continue
+		}
+
+		canonicalUrl, err := site.Url.Url.Parse(strings.TrimSpace(getAttr(token, "href")))
+
+		if err != nil || (canonicalUrl.Scheme != "http" && canonicalUrl.Scheme != "https") || canonicalUrl.Host == "" {
+			return ""
+		}
+
+		return canonicalUrl.String()
+	}
+}
+
+// The language the page declares in <html lang>, or an empty string when it doesn't
+func getPageLanguage(site ExternalPage) string {
+	tokenizer := html.NewTokenizer(bytes.NewReader(site.Html))
+
+	for {
+		tokenType := tokenizer.Next()
+
+		switch tokenType {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken:
+			token := tokenizer.Token()
+
+			if token.Data == "html" {
+				return strings.TrimSpace(getAttr(token, "lang"))
+			}
+
+			// Pages without an <html> tag still have their other elements
+			if token.Data == "head" || token.Data == "body" {
+				return ""
+			}
+		}
+	}
+}
+
+// Feed link types in order of preference
+var feedTypes = []string{
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/feed+json",
+}
+
+// Every feed the page links to, as absolute URLs resolved against the page's final URL, RSS feeds first, then
+// Atom, then JSON feeds
+func getFeedUrls(site ExternalPage) []string {
+	feedsByType := make(map[string][]string)
+
+	r := bytes.NewReader(site.Html)
+	tokenizer := html.NewTokenizer(r)
+
+	for {
+		tokenType := tokenizer.Next()
+
+		if tokenType == html.ErrorToken {
+			break
+		}
+
+		// Feed links belong in the <head>, so the rest of the page isn't tokenized
+		if tokenType == html.EndTagToken {
+			if tagName, _ := tokenizer.TagName(); string(tagName) == "head" {
+				break
+			}
+
+			continue
+		}
+
+		if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+			continue
+		}
+
+		token := tokenizer.Token()
+
+		if token.Data == "body" {
+			break
+		}
+
+		if token.Data != "link" {
+			continue
+		}
+
+		feedType := strings.ToLower(strings.TrimSpace(getAttr(token, "type")))
+		linkHref := strings.TrimSpace(getAttr(token, "href"))
+
+		if linkHref == "" {
+			continue
+		}
+
+		feedUrl, err := url.Parse(linkHref)
+
+		if err != nil {
+			slog.Debug("could not parse feed url", "url", site.Url.Link, "href", linkHref, "error", err)
+			continue
+		}
+
+		feedsByType[feedType] = append(feedsByType[feedType], site.Url.Url.ResolveReference(feedUrl).String())
+	}
+
+	var feedUrls []string
+
+	for _, feedType := range feedTypes {
+		feedUrls = append(feedUrls, feedsByType[feedType]...)
+	}
+
+	return feedUrls
+}
+
+// The page's preferred feed, or an empty string when it doesn't link to one
+func getRssFeedUrl(site ExternalPage) string {
+	feedUrls := getFeedUrls(site)
+
+	if len(feedUrls) == 0 {
+		return ""
+	}
+
+	return feedUrls[0]
+}
+
+// Write the discovery as a single line of JSON so runs can be piped into jq
+func emitDiscovery(w io.Writer, discovery Discovery) error {
+	return json.NewEncoder(w).Encode(discovery)
+}
+
+// The factor an existing score is multiplied by on re-encounter: 1 keeps it, 0 replaces it with this run's. Values
+// outside 0 to 1, which validateConfig refuses, keep it
+func decayFactor(decay float64) float64 {
+	if decay < 0 || decay > 1 {
+		return 1
+	}
+
+	return decay
+}
+
+// Add this run's keyword hits to those stored for the prospect, as the JSON kept in score_detail. Keywords that
+// never matched are left out
+func mergeScoreDetail(existing []byte, detail map[string]int) (string, error) {
+	merged := make(map[string]int)
+
+	if len(existing) > 0 {
+		err := json.Unmarshal(existing, &merged)
+
+		if err != nil {
+			return "", fmt.Errorf("could not read score_detail: %w", err)
+		}
+	}
+
+	for keyword, count := range detail {
+		if count > 0 {
+			merged[keyword] += count
+		}
+	}
+
+	encoded, err := json.Marshal(merged)
+
+	return string(encoded), err
+}
+
+func (site ExternalPage) queueHost() string {
+	if site.Host != "" {
+		return site.Host
+	}
+
+	return normalizeHost(site.Url.Url.Host)
+}
+
+// Add the site to the queue for review. A host already in the queue keeps the page and post it was first found
+// through
+func addSiteToReviewQueue(ctx context.Context, db TxBeginner, site ExternalPage, score int, scoreDetail map[string]int, rssFeedUrl string, scoreDecay float64) (bool, error) {
+	err := inTransaction(ctx, db, func(tx *sql.Tx) error {
+		return upsertQueuedSite(ctx, tx, site, score, scoreDetail, rssFeedUrl, scoreDecay)
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	sitesQueued.Inc()
+	slog.Info("queued", "host", site.queueHost(), "url", site.Url.Link, "post_id", site.Url.PostId, "score", score)
+	return true, nil
+}
+
+// Insert the prospect, or update it when it's already queued, in one statement relying on the unique fqdn key. The
+// upsert locks the row until the transaction ends, so the read-modify-write of score_detail can't lose a
+// concurrent write
+func upsertQueuedSite(ctx context.Context, tx Querier, site ExternalPage, score int, scoreDetail map[string]int, rssFeedUrl string, scoreDecay float64) error {
+	upsert, err := tx.PrepareContext(
+		ctx,
+		"INSERT INTO `discovered_sites_queue` "+
+			"(`fqdn`, `score`, `encountered`, `feed_url`, `first_url`, `first_post_id`, `first_seen`, `last_seen`) "+
+			"VALUES (?, ?, 1, ?, ?, ?, NOW(), NOW()) "+
+			"ON DUPLICATE KEY UPDATE "+
+			"`score` = ROUND(`score` * ?) + VALUES(`score`), "+
+			"`encountered` = `encountered` + 1, "+
+			"`feed_url` = VALUES(`feed_url`), "+
+			"`last_seen` = NOW()",
+	)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = upsert.ExecContext(
+		ctx,
+		site.queueHost(),
+		score,
+		rssFeedUrl,
+		site.Url.Link,
+		site.Url.PostId,
+		decayFactor(scoreDecay),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	// MySQL can't add JSON objects together, so the keyword counts are merged here
+	var existingDetail []byte
+
+	err = tx.QueryRowContext(ctx, "SELECT score_detail "+
+		"FROM discovered_sites_queue "+
+		"WHERE fqdn = ?", site.queueHost()).Scan(&existingDetail)
+
+	if err != nil {
+		return err
+	}
+
+	mergedDetail, err := mergeScoreDetail(existingDetail, scoreDetail)
+
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, "UPDATE `discovered_sites_queue` SET `score_detail` = ? WHERE `fqdn` = ?")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.ExecContext(ctx, mergedDetail, site.queueHost())
+
+	return err
+}
+
+// Name of the discovery_state row holding the last post a finished run processed
+const watermarkState = "last_processed_post_id"
+
+// The last post a finished run processed, 0 before the first
+func getWatermark(ctx context.Context, db Querier) (int64, error) {
+	var postId int64
+
+	err := db.QueryRowContext(ctx, "SELECT `value` FROM `discovery_state` WHERE `name` = ?", watermarkState).Scan(&postId)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+
+	return postId, err
+}
+
+// Move the watermark on to postId. It never moves back, in case an older run finishes late
+func setWatermark(ctx context.Context, db Querier, postId int64) error {
+	stmt, err := db.PrepareContext(
+		ctx,
+		"INSERT INTO `discovery_state` (`name`, `value`, `updated_at`) VALUES (?, ?, NOW()) "+
+			"ON DUPLICATE KEY UPDATE `value` = GREATEST(`value`, VALUES(`value`)), `updated_at` = NOW()",
+	)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.ExecContext(ctx, watermarkState, postId)
+
+	return err
+}
+
+// Keep a page that scored too low to queue, with its keyword hits, for tuning scoring.minScore
+func recordRejected(ctx context.Context, db Querier, site ExternalPage, score int, scoreDetail map[string]int) error {
+	detail, err := mergeScoreDetail(nil, scoreDetail)
+
+	if err != nil {
+		return err
+	}
+
+	stmt, err := db.PrepareContext(
+		ctx,
+		"INSERT INTO `discovered_sites_rejected` "+
+			"(`fqdn`, `url`, `post_id`, `score`, `score_detail`, `rejected_at`) VALUES (?, ?, ?, ?, ?, NOW())",
+	)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.ExecContext(ctx, site.queueHost(), site.Url.Link, site.Url.PostId, score, detail)
+
+	return err
+}
+
+// Record why each page in a run couldn't be fetched
+func logFetchFailures(ctx context.Context, db Querier, runAt time.Time, failedPages []ExternalPage) error {
+	stmt, err := db.PrepareContext(
+		ctx,
+		"INSERT INTO `discovery_fetch_log` "+
+			"(`run_at`, `fqdn`, `url`, `post_id`, `failure`, `status_code`, `content_type`, `error`) "+
+			"VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+	)
+
+	if err != nil {
+		return err
+	}
+
+	defer func(stmt *sql.Stmt) {
+		_ = stmt.Close()
+	}(stmt)
+
+	for _, failedPage := range failedPages {
+		_, err = stmt.ExecContext(
+			ctx,
+			runAt,
+			normalizeHost(failedPage.Url.Url.Host),
+			failedPage.Url.Link,
+			failedPage.Url.PostId,
+			failedPage.Failure,
+			failedPage.StatusCode,
+			failedPage.ContentType,
+			failedPage.Error,
+		)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Keep the HTML a prospect was queued with, replacing what was kept from an earlier encounter
+func storePageHtml(ctx context.Context, db Querier, site ExternalPage) error {
+	compressed, err := gzipHtml(site.Html)
+
+	if err != nil {
+		return err
+	}
+
+	var lastModified *time.Time
+
+	if !site.LastModified.IsZero() {
+		lastModified = &site.LastModified
+	}
+
+	stmt, err := db.PrepareContext(
+		ctx,
+		"INSERT INTO `discovered_sites_html` (`fqdn`, `url`, `html`, `last_modified`, `fetched_at`) "+
+			"VALUES (?, ?, ?, ?, NOW()) "+
+			"ON DUPLICATE KEY UPDATE "+
+			"`url` = VALUES(`url`), "+
+			"`html` = VALUES(`html`), "+
+			"`last_modified` = VALUES(`last_modified`), "+
+			"`fetched_at` = NOW()",
+	)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.ExecContext(ctx, site.queueHost(), site.Url.Link, compressed, lastModified)
+
+	return err
+}
+
+// The stored pages of every prospect still in the queue
+func getStoredPages(ctx context.Context, db Querier) ([]StoredPage, error) {
+	var storedPages []StoredPage
+
+	rows, err := db.QueryContext(ctx, "SELECT `html`.`fqdn`, `html`.`url`, `html`.`html`, `html`.`last_modified`, "+
+		"`queue`.`score`, COALESCE(`queue`.`feed_url`, '') "+
+		"FROM `discovered_sites_html` `html` "+
+		"JOIN `discovered_sites_queue` `queue` ON `queue`.`fqdn` = `html`.`fqdn`")
+
+	if err != nil {
+		return storedPages, err
+	}
+
+	defer func(rows *sql.Rows) {
+		_ = rows.Close()
+	}(rows)
+
+	for rows.Next() {
+		var storedPage StoredPage
+		var link string
+		var compressed []byte
+		var lastModified sql.NullTime
+
+		err = rows.Scan(&storedPage.Page.Host, &link, &compressed, &lastModified, &storedPage.Score, &storedPage.FeedUrl)
+
+		if err != nil {
+			return storedPages, fmt.Errorf("could not read stored page: %w", err)
+		}
+
+		storedPage.Page.Url.Link = link
+		storedPage.Page.Url.Url, err = url.Parse(link)
 
-	defer func(db *sql.DB) {
-		fmt.Println("closing database connection at", time.Now().Format(time.RFC1123Z))
-		err := db.Close()
 		if err != nil {
-			panic(err)
+			slog.Warn("skipping stored page with an invalid url", "host", storedPage.Page.Host, "url", link, "error", err)
+			continue
 		}
-	}(db)
 
-	posts, err := getPosts(db)
+		storedPage.Page.Html, err = gunzipHtml(compressed)
+
+		if err != nil {
+			slog.Warn("skipping unreadable stored page", "host", storedPage.Page.Host, "url", link, "error", err)
+			continue
+		}
+
+		storedPage.Page.Fetched = true
+		storedPage.Page.LastModified = lastModified.Time
+		storedPages = append(storedPages, storedPage)
+	}
+
+	err = rows.Err()
+
+	if err != nil {
+		return storedPages, fmt.Errorf("could not read stored pages: %w", err)
+	}
+
+	return storedPages, nil
+}
+
+// The last fetch from each of the hosts that has one
+func getPriorFetches(ctx context.Context, db Querier, hosts []string) (map[string]PriorFetch, error) {
+	priorFetches := make(map[string]PriorFetch)
+
+	if len(hosts) == 0 {
+		return priorFetches, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(hosts)), ", ")
+	args := make([]interface{}, len(hosts))
+
+	for i, host := range hosts {
+		args[i] = host
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT `fqdn`, `url`, COALESCE(`etag`, ''), `last_modified`, `queue_fqdn`, "+
+		"`score`, `score_detail`, COALESCE(`feed_url`, '') "+
+		"FROM `discovery_validators` WHERE `fqdn` IN ("+placeholders+")", args...)
 
 	if err != nil {
-		fmt.Println("error getting posts", err)
+		return priorFetches, err
 	}
 
-	var candidates []ExternalUrl
+	defer func(rows *sql.Rows) {
+		_ = rows.Close()
+	}(rows)
+
+	for rows.Next() {
+		var host string
+		var prior PriorFetch
+		var lastModified sql.NullTime
+		var scoreDetail []byte
 
-	if len(posts) > 0 {
-		for _, post := range posts {
-			urls, err := getUrlsFromPost(post)
+		err = rows.Scan(&host, &prior.Url, &prior.ETag, &lastModified, &prior.Host, &prior.Score, &scoreDetail, &prior.FeedUrl)
+
+		if err != nil {
+			return priorFetches, fmt.Errorf("could not read validators: %w", err)
+		}
+
+		prior.LastModified = lastModified.Time
+		prior.ScoreDetail = make(map[string]int)
+
+		if len(scoreDetail) > 0 {
+			err = json.Unmarshal(scoreDetail, &prior.ScoreDetail)
 
 			if err != nil {
-				fmt.Println("error getting urls from posts", err)
+				return priorFetches, fmt.Errorf("could not read score detail of %s: %w", host, err)
 			}
+		}
 
-			if len(urls) > 0 {
-				candidates = append(candidates, urls...)
-			}
+		priorFetches[host] = prior
+	}
+
+	err = rows.Err()
+
+	if err != nil {
+		return priorFetches, fmt.Errorf("could not read validators: %w", err)
+	}
+
+	return priorFetches, nil
+}
+
+// Keep what the host's latest page was fetched and queued with, replacing its previous page
+func setPriorFetch(ctx context.Context, db Querier, host string, prior PriorFetch) error {
+	detail, err := mergeScoreDetail(nil, prior.ScoreDetail)
+
+	if err != nil {
+		return err
+	}
+
+	var lastModified *time.Time
+
+	if !prior.LastModified.IsZero() {
+		lastModified = &prior.LastModified
+	}
+
+	stmt, err := db.PrepareContext(
+		ctx,
+		"INSERT INTO `discovery_validators` "+
+			"(`fqdn`, `url`, `etag`, `last_modified`, `queue_fqdn`, `score`, `score_detail`, `feed_url`, `updated_at`) "+
+			"VALUES (?, ?, NULLIF(?, ''), ?, ?, ?, ?, NULLIF(?, ''), NOW()) "+
+			"ON DUPLICATE KEY UPDATE "+
+			"`url` = VALUES(`url`), "+
+			"`etag` = VALUES(`etag`), "+
+			"`last_modified` = VALUES(`last_modified`), "+
+			"`queue_fqdn` = VALUES(`queue_fqdn`), "+
+			"`score` = VALUES(`score`), "+
+			"`score_detail` = VALUES(`score_detail`), "+
+			"`feed_url` = VALUES(`feed_url`), "+
+			"`updated_at` = NOW()",
+	)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.ExecContext(ctx, host, prior.Url, prior.ETag, lastModified, prior.Host, prior.Score, detail, prior.FeedUrl)
+
+	return err
+}
+
+// Replace a prospect's score and keyword hits with those from scoring its stored page again
+func setRescored(ctx context.Context, db Querier, host string, score int, scoreDetail map[string]int) error {
+	detail, err := mergeScoreDetail(nil, scoreDetail)
+
+	if err != nil {
+		return err
+	}
+
+	stmt, err := db.PrepareContext(ctx, "UPDATE `discovered_sites_queue` SET `score` = ?, `score_detail` = ? WHERE `fqdn` = ?")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.ExecContext(ctx, score, detail, host)
+
+	return err
+}
+
+func setThumbnailUrl(ctx context.Context, db Querier, host string, thumbnailUrl string) error {
+	stmt, err := db.PrepareContext(ctx, "UPDATE `discovered_sites_queue` SET `thumbnail_url` = ? WHERE `fqdn` = ?")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.ExecContext(ctx, thumbnailUrl, host)
+
+	return err
+}
+
+func setMixedContent(ctx context.Context, db Querier, host string, mixedContent bool) error {
+	stmt, err := db.PrepareContext(ctx, "UPDATE `discovered_sites_queue` SET `mixed_content` = ? WHERE `fqdn` = ?")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.ExecContext(ctx, mixedContent, host)
+
+	return err
+}
+
+func setBrokenTls(ctx context.Context, db Querier, host string, brokenTls bool) error {
+	stmt, err := db.PrepareContext(ctx, "UPDATE `discovered_sites_queue` SET `broken_tls` = ? WHERE `fqdn` = ?")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.ExecContext(ctx, brokenTls, host)
+
+	return err
+}
+
+func getQueuedFeeds(ctx context.Context, db Querier) ([]QueuedFeed, error) {
+	var feeds []QueuedFeed
+
+	rows, err := db.QueryContext(ctx, "SELECT fqdn, feed_url "+
+		"FROM discovered_sites_queue "+
+		"WHERE feed_url IS NOT NULL AND feed_url != ''")
+
+	if err != nil {
+		return feeds, err
+	}
+
+	defer func(rows *sql.Rows) {
+		_ = rows.Close()
+	}(rows)
+
+	for rows.Next() {
+		var feed QueuedFeed
+
+		err = rows.Scan(&feed.Host, &feed.FeedUrl)
+
+		if err != nil {
+			return feeds, err
 		}
+
+		feeds = append(feeds, feed)
 	}
 
-	if len(candidates) > 0 {
-		var scheduledCandidates []ExternalUrl
+	return feeds, rows.Err()
+}
 
-	checkCandidates:
-		for _, candidate := range candidates {
-			alreadyDiscovered, err := isInBlacklist(db, candidate)
+func setFeedVerified(ctx context.Context, db Querier, host string, verified bool) error {
+	stmt, err := db.PrepareContext(ctx, "UPDATE `discovered_sites_queue` SET `feed_verified` = ? WHERE `fqdn` = ?")
 
-			if err != nil {
-				fmt.Println("error checking if candidate has already been discovered", err)
-			}
+	if err != nil {
+		return err
+	}
 
-			if !alreadyDiscovered {
-				for _, scheduledCandidate := range scheduledCandidates {
-					if scheduledCandidate.Url.Host == candidate.Url.Host {
-						continue checkCandidates
-					}
-				}
+	_, err = stmt.ExecContext(ctx, verified, host)
 
-				scheduledCandidates = append(scheduledCandidates, candidate)
-			}
+	return err
+}
+
+// Move a host from the review queue into the blacklist in one transaction, so it's never queued again. Returns
+// whether the host had been queued
+func blacklistHost(ctx context.Context, db TxBeginner, host string, reason string) (bool, error) {
+	removed := false
+
+	err := inTransaction(ctx, db, func(tx *sql.Tx) error {
+		inBlacklist, err := isInBlacklist(ctx, tx, host)
+
+		if err != nil {
+			return err
 		}
 
-		if len(scheduledCandidates) > 0 {
-			fetchedPages, err := fetchExternalPages(scheduledCandidates)
+		if !inBlacklist {
+			_, err = tx.ExecContext(ctx, "INSERT INTO `discovered_sites_blacklist` (`host`, `reason`) VALUES (?, ?)", host, reason)
 
 			if err != nil {
-				fmt.Println("there was an error fetching external pages", err)
+				return err
 			}
+		}
+
+		result, err := tx.ExecContext(ctx, "DELETE FROM `discovered_sites_queue` WHERE `fqdn` = ?", host)
 
-			for _, fetchedPage := range fetchedPages {
-				relevancyScore := getRelevancyScore(fetchedPage)
-				rssFeedUrl := getRssFeedUrl(fetchedPage)
+		if err != nil {
+			return err
+		}
 
-				_, err := addSiteToReviewQueue(db, fetchedPage, relevancyScore, rssFeedUrl)
+		deleted, err := result.RowsAffected()
+		removed = deleted > 0
 
-				if err != nil {
-					fmt.Println("there was an error adding site to queue", fetchedPage.Url.Link, err)
-				}
-			}
+		return err
+	})
+
+	return removed, err
+}
+
+// Run fn in a transaction, committing when it succeeds and rolling back when it fails
+func inTransaction(ctx context.Context, db TxBeginner, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Settings from the command line, which apply on top of config.json however often it is reloaded
+type runOptions struct {
+	dryRun bool
+	// Let --rescore overwrite the scores accumulated in the queue
+	replaceScores bool
+}
+
+// Run discovery once with the current config. The discoverer is kept between runs, for the hosts and candidates it
+// remembers, and given this run's config, store and client
+func start(ctx context.Context, options runOptions, discoverer *Discoverer) (err error) {
+	slog.Info("starting auto discovery service")
+
+	defer func() {
+		serviceHealth.record(err)
+	}()
+
+	config := activeConfig.get()
+	config.Output.DryRun = config.Output.DryRun || options.dryRun
+
+	db, err := makeDbConnection(ctx, config)
+
+	if err != nil {
+		slog.Error("could not open db connection", "error", err)
+		return err
+	}
+
+	defer func(db *sql.DB) {
+		slog.Debug("closing database connection")
+		err := db.Close()
+		if err != nil {
+			slog.Error("could not close database connection", "error", err)
+		}
+	}(db)
+
+	dbStore := mysqlStore{db: db, timeout: time.Duration(config.Db.QueryTimeout) * time.Second}
+
+	err = dbStore.CheckTables(ctx, config)
+
+	if err != nil {
+		slog.Error("database is missing a table", "error", err)
+		return err
+	}
+
+	var store Store = dbStore
+
+	if config.Output.DryRun {
+		slog.Info("dry run, the queue will not be written to")
+		store = dryRunStore{Store: store}
+	}
+
+	discoverer.Config = config
+	discoverer.Store = store
+	discoverer.Client = newCrawlerClient(config.Crawler)
+
+	result, err := discoverer.Run(ctx)
+
+	if err != nil {
+		slog.Error("discovery run failed", "error", err)
+		return err
+	}
+
+	slog.Info("discovery run finished", "queued", len(result.Queued), "rejected", result.Rejected, "soft_404s", result.Soft404s, "unchanged", result.Unchanged, "scheduled", result.Scheduled, "deferred", result.Deferred)
+
+	return nil
+}
+
+// Retry the first run with backoff, so the service recovers when it starts before the database is ready
+func startWithRetry(ctx context.Context, service ServiceConfig, run func(ctx context.Context) error) {
+	backoff := time.Duration(service.StartupBackoff) * time.Second
+
+	for attempt := 1; ; attempt++ {
+		err := run(ctx)
+
+		if err == nil || attempt >= service.StartupAttempts || ctx.Err() != nil {
+			return
+		}
+
+		slog.Warn("first run failed, retrying", "backoff", backoff, "attempt", attempt, "attempts", service.StartupAttempts)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
 		}
+
+		backoff = backoff * 2
 	}
 }
 
-func runService(d time.Duration) {
+// Run discovery every d until ctx is cancelled, moving to a new service.intervalHours when the config is reloaded. A
+// run in progress is finished, with its fetches aborted, before returning
+func runService(ctx context.Context, d time.Duration, options runOptions, discoverer *Discoverer) {
 	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_ = start(ctx, options, discoverer)
+		case <-configReloads:
+			d = resetInterval(ticker, d)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Reset the ticker to the active config's interval if a reload changed it, returning the interval now in use. The
+// next run is a full interval after the reload
+func resetInterval(ticker *time.Ticker, current time.Duration) time.Duration {
+	interval := time.Duration(activeConfig.get().Service.IntervalHours) * time.Hour
+
+	if interval <= 0 || interval == current {
+		return current
+	}
+
+	ticker.Reset(interval)
+	slog.Info("service interval changed", "from", current, "to", interval)
+
+	return interval
+}
+
+// abt verify-feeds [-config path] [-concurrency n]: re-check the feed URLs stored in the queue and mark dead ones
+func verifyFeedsCommand(args []string) int {
+	flags := flag.NewFlagSet("verify-feeds", flag.ExitOnError)
+	configPath := flags.String("config", configPathFromEnv(), "path to config.json, also read from $ABT_CONFIG")
+	concurrency := flags.Int("concurrency", 0, "number of feeds to check at once, feeds.maxConcurrency when 0")
+	_ = flags.Parse(args)
+
+	config, err := loadConfig(*configPath)
+
+	if err != nil {
+		slog.Error("could not load config", "error", err)
+		return 1
+	}
+
+	_ = setupLogging(config.Logging)
+
+	if *concurrency < 1 {
+		*concurrency = config.Feeds.MaxConcurrency
+	}
+
+	db, err := makeDbConnection(context.Background(), config)
+
+	if err != nil {
+		slog.Error("could not open db connection", "error", err)
+		return 1
+	}
 
-	for _ = range ticker.C {
-		start()
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+
+	store := mysqlStore{db: db, timeout: time.Duration(config.Db.QueryTimeout) * time.Second}
+
+	discoverer := NewDiscoverer(config, nil, newCrawlerClient(config.Crawler))
+	alive, dead, err := discoverer.verifyQueuedFeeds(context.Background(), store, *concurrency, config.Crawler.MaxPerHostConcurrency)
+
+	if err != nil {
+		slog.Error("could not verify feeds", "error", err)
+		return 1
+	}
+
+	slog.Info("verified feeds", "alive", alive, "dead", dead)
+
+	return 0
+}
+
+// abt --blacklist <host> [--reason text]: promote a reviewed prospect into the blacklist
+func blacklistCommand(config AppConfig, host string, reason string) int {
+	host = normalizeHost(host)
+
+	if host == "" {
+		slog.Error("no host to blacklist")
+		return 1
+	}
+
+	db, err := makeDbConnection(context.Background(), config)
+
+	if err != nil {
+		slog.Error("could not open db connection", "error", err)
+		return 1
 	}
+
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+
+	store := mysqlStore{db: db, timeout: time.Duration(config.Db.QueryTimeout) * time.Second}
+
+	removed, err := store.BlacklistHost(context.Background(), host, reason)
+
+	if err != nil {
+		slog.Error("could not blacklist host", "host", host, "error", err)
+		return 1
+	}
+
+	if removed {
+		fmt.Printf("blacklisted %s and removed it from the queue\n", host)
+	} else {
+		fmt.Printf("blacklisted %s, it was not in the queue\n", host)
+	}
+
+	return 0
 }
 
 func main() {
-	start()
+	if len(os.Args) > 1 && os.Args[1] == "verify-feeds" {
+		os.Exit(verifyFeedsCommand(os.Args[2:]))
+	}
+
+	configPath := flag.String("config", configPathFromEnv(), "path to config.json, also read from $ABT_CONFIG")
+	dryRun := flag.Bool("dry-run", false, "fetch and score candidates without writing to the queue")
+	singleUrl := flag.String("url", "", "fetch and score this one page, printing the breakdown, then exit")
+	singleUrlJson := flag.Bool("json", false, "print the --url breakdown as a JSON object")
+	blacklist := flag.String("blacklist", "", "move this host from the queue into the blacklist, then exit")
+	blacklistReason := flag.String("reason", "", "note stored with --blacklist")
+	rescore := flag.Bool("rescore", false, "score every queued prospect again from its stored html, then exit")
+	replaceScores := flag.Bool("replace", false, "with --rescore, replace each prospect's accumulated score with its new score")
+	flag.Parse()
+
+	options := runOptions{dryRun: *dryRun, replaceScores: *replaceScores}
+
+	config, err := loadConfig(*configPath)
+
+	if err != nil {
+		slog.Error("could not load config", "error", err)
+		os.Exit(1)
+	}
+
+	activeConfig.set(config)
+
+	err = setupLogging(activeConfig.get().Logging)
+
+	if err != nil {
+		slog.Error("could not set up logging", "error", err)
+	}
+
+	if *singleUrl != "" {
+		os.Exit(processSingleUrl(context.Background(), activeConfig.get(), *singleUrl, *singleUrlJson))
+	}
+
+	if *blacklist != "" {
+		os.Exit(blacklistCommand(activeConfig.get(), *blacklist, *blacklistReason))
+	}
+
+	if *rescore {
+		os.Exit(rescoreCommand(activeConfig.get(), options))
+	}
+
+	shutdownTracing, err := setupTracing(context.Background(), activeConfig.get().Tracing)
+
+	if err != nil {
+		slog.Warn("could not set up tracing, continuing without it", "error", err)
+	} else {
+		defer func() {
+			_ = shutdownTracing(context.Background())
+		}()
+	}
+
+	stopReloading := watchReloadSignals(*configPath)
+	defer stopReloading()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Runs open and close their own connection, so /healthz keeps a pool of its own
+	var healthDb Pinger
+
+	if activeConfig.get().Health.Enabled {
+		db, err := openDb(activeConfig.get())
+
+		if err != nil {
+			slog.Error("could not open db connection for health checks", "error", err)
+		} else {
+			healthDb = db
+			defer func(db *sql.DB) {
+				_ = db.Close()
+			}(db)
+		}
+	}
+
+	startHttpServers(activeConfig.get().Metrics, activeConfig.get().Health, healthDb)
+
+	discoverer := NewDiscoverer(activeConfig.get(), nil, nil)
+
+	startWithRetry(ctx, activeConfig.get().Service, func(ctx context.Context) error {
+		return start(ctx, options, discoverer)
+	})
+
+	interval := time.Duration(activeConfig.get().Service.IntervalHours) * time.Hour
 
-	interval := 2 * time.Hour
-	go runService(interval)
+	slog.Info("starting ticker to automatically discover new sites", "interval", interval)
 
-	fmt.Println("starting ticker to automatically discover new sites every", interval)
+	// Run until interrupted or terminated
+	runService(ctx, interval, options, discoverer)
 
-	// Run application indefinitely
-	select {}
+	slog.Info("shutting down")
 }
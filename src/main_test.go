@@ -0,0 +1,1675 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/net/html"
+)
+
+func newMockDb(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatalf("could not create mock db: %v", err)
+	}
+
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	return db, mock
+}
+
+func testPage(rawUrl string, postId int64) ExternalPage {
+	parsed, _ := url.Parse(rawUrl)
+
+	return ExternalPage{Url: ExternalUrl{Url: parsed, Link: rawUrl, PostId: postId}}
+}
+
+func TestGetPosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		rows    *sqlmock.Rows
+		err     error
+		want    int
+		wantErr bool
+	}{
+		{
+			name: "posts with bodies",
+			rows: sqlmock.NewRows([]string{"pk_post_id", "post_title", "link", "content"}).
+				AddRow(2, "Two", "https://a.example/2", "<p>two</p>").
+				AddRow(1, "One", "https://a.example/1", "<p>one</p>"),
+			want: 2,
+		},
+		{
+			name: "empty bodies are skipped",
+			rows: sqlmock.NewRows([]string{"pk_post_id", "post_title", "link", "content"}).
+				AddRow(1, "One", "https://a.example/1", ""),
+			want: 0,
+		},
+		{
+			name: "no rows",
+			rows: sqlmock.NewRows([]string{"pk_post_id", "post_title", "link", "content"}),
+			want: 0,
+		},
+		{
+			name:    "query error",
+			err:     errors.New("connection lost"),
+			wantErr: true,
+		},
+		{
+			name: "scan error",
+			rows: sqlmock.NewRows([]string{"pk_post_id", "post_title", "link", "content"}).
+				AddRow("not a number", "One", "https://a.example/1", "<p>one</p>"),
+			wantErr: true,
+		},
+		{
+			name: "close error fails the read without panicking",
+			rows: sqlmock.NewRows([]string{"pk_post_id", "post_title", "link", "content"}).
+				AddRow(1, "One", "https://a.example/1", "<p>one</p>").
+				CloseError(errors.New("connection lost")),
+			wantErr: true,
+		},
+		{
+			name: "row error",
+			rows: sqlmock.NewRows([]string{"pk_post_id", "post_title", "link", "content"}).
+				AddRow(1, "One", "https://a.example/1", "<p>one</p>").
+				RowError(0, errors.New("connection lost")),
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, mock := newMockDb(t)
+			query := mock.ExpectQuery("SELECT pk_post_id, post_title, link, content FROM `posts`").
+				WithArgs(24, int64(10))
+
+			if test.err != nil {
+				query.WillReturnError(test.err)
+			} else {
+				query.WillReturnRows(test.rows)
+			}
+
+			posts, err := getPosts(context.Background(), db, PostsConfig{LookbackHours: 24}, 10)
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("getPosts() error = %v, wantErr %v", err, test.wantErr)
+			}
+
+			if !test.wantErr && len(posts) != test.want {
+				t.Errorf("getPosts() returned %d posts, want %d", len(posts), test.want)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestIsInBlacklist(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    string
+		count   int
+		err     error
+		want    bool
+		wantErr bool
+	}{
+		{name: "blacklisted", host: "www.Spam.example", count: 1, want: true},
+		{name: "not blacklisted", host: "ok.example", count: 0, want: false},
+		{name: "query error", host: "ok.example", err: errors.New("connection lost"), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, mock := newMockDb(t)
+			host := normalizeHost(test.host)
+			query := mock.ExpectQuery("SELECT COUNT").WithArgs(host, "www."+host)
+
+			if test.err != nil {
+				query.WillReturnError(test.err)
+			} else {
+				query.WillReturnRows(sqlmock.NewRows([]string{"ttl"}).AddRow(test.count))
+			}
+
+			got, err := isInBlacklist(context.Background(), db, test.host)
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("isInBlacklist() error = %v, wantErr %v", err, test.wantErr)
+			}
+
+			if got != test.want {
+				t.Errorf("isInBlacklist() = %v, want %v", got, test.want)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestUpsertQueuedSite(t *testing.T) {
+	tests := []struct {
+		name       string
+		existing   any
+		detailErr  error
+		upsertErr  error
+		wantDetail string
+		wantErr    bool
+	}{
+		{
+			name:       "new host",
+			existing:   nil,
+			wantDetail: `{"anime":2}`,
+		},
+		{
+			name:       "merges stored detail",
+			existing:   []byte(`{"anime":1,"manga":3}`),
+			wantDetail: `{"anime":3,"manga":3}`,
+		},
+		{
+			name:      "no row after upsert",
+			detailErr: sql.ErrNoRows,
+			wantErr:   true,
+		},
+		{
+			name:      "upsert error",
+			upsertErr: errors.New("deadlock"),
+			wantErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, mock := newMockDb(t)
+			site := testPage("https://www.blog.example/post", 7)
+
+			mock.ExpectBegin()
+			upsert := mock.ExpectPrepare("INSERT INTO `discovered_sites_queue`").ExpectExec().
+				WithArgs("blog.example", 5, "https://blog.example/feed", site.Url.Link, int64(7), 0.5)
+
+			if test.upsertErr != nil {
+				upsert.WillReturnError(test.upsertErr)
+				mock.ExpectRollback()
+			} else {
+				upsert.WillReturnResult(sqlmock.NewResult(1, 1))
+				detail := mock.ExpectQuery("SELECT score_detail").WithArgs("blog.example")
+
+				if test.detailErr != nil {
+					detail.WillReturnError(test.detailErr)
+					mock.ExpectRollback()
+				} else {
+					detail.WillReturnRows(sqlmock.NewRows([]string{"score_detail"}).AddRow(test.existing))
+					mock.ExpectPrepare("UPDATE `discovered_sites_queue` SET `score_detail`").ExpectExec().
+						WithArgs(test.wantDetail, "blog.example").
+						WillReturnResult(sqlmock.NewResult(0, 1))
+					mock.ExpectCommit()
+				}
+			}
+
+			site.Host = normalizeHost(site.Url.Url.Host)
+			queued, err := addSiteToReviewQueue(context.Background(), db, site, 5, map[string]int{"anime": 2, "manga": 0}, "https://blog.example/feed", 0.5)
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("addSiteToReviewQueue() error = %v, wantErr %v", err, test.wantErr)
+			}
+
+			if queued == test.wantErr {
+				t.Errorf("addSiteToReviewQueue() queued = %v", queued)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// Crawler settings for fetching from httptest servers, which listen on loopback and shouldn't be rate limited
+func testCrawlerConfig() CrawlerConfig {
+	crawler := defaultConfig().Crawler
+	crawler.AllowPrivateHosts = true
+	crawler.RequestsPerHostPerSecond = 0
+
+	return crawler
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	_, _ = writer.Write(data)
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buffer.Bytes()
+}
+
+func TestFetchExternalPageAttempt(t *testing.T) {
+	page := []byte("<html><head><title>Anime</title></head><body>anime</body></html>")
+	compressed := gzipBytes(t, page)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/no-head", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write(page)
+	})
+	mux.HandleFunc("/no-head-image", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("png"))
+	})
+	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("png"))
+	})
+	mux.HandleFunc("/gzip", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Encoding", "gzip")
+		_, _ = w.Write(compressed)
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write(bytes.Repeat([]byte("a"), 2048))
+	})
+	mux.HandleFunc("/large-chunked", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+
+		if r.Method == http.MethodHead {
+			return
+		}
+
+		// Flushing before the end of the body drops the Content-Length, so the limit applies while reading
+		_, _ = w.Write(bytes.Repeat([]byte("a"), 1024))
+		w.(http.Flusher).Flush()
+		_, _ = w.Write(bytes.Repeat([]byte("a"), 1024))
+	})
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/gzip", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	crawler := testCrawlerConfig()
+	crawler.MaxBodyBytes = 1024
+	client := newCrawlerClient(crawler)
+
+	tests := []struct {
+		name        string
+		path        string
+		wantFetched bool
+		wantFailure string
+		wantPath    string
+	}{
+		{name: "head not allowed falls back to get", path: "/no-head", wantFetched: true, wantPath: "/no-head"},
+		{name: "head not allowed checks type on get", path: "/no-head-image", wantFailure: failureContentType},
+		{name: "non html content type", path: "/image", wantFailure: failureContentType},
+		{name: "gzip body", path: "/gzip", wantFetched: true, wantPath: "/gzip"},
+		{name: "oversized by content length", path: "/large", wantFailure: failureTooLarge},
+		{name: "oversized while reading", path: "/large-chunked", wantFailure: failureTooLarge},
+		{name: "redirect is followed", path: "/moved", wantFetched: true, wantPath: "/gzip"},
+		{name: "redirect loop", path: "/loop", wantFailure: failureTooManyRedirects},
+		{name: "http error", path: "/missing", wantFailure: failureHttpStatus},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			candidate := testPage(server.URL+test.path, 1).Url
+			got := testDiscoverer(client, crawler).fetchExternalPageAttempt(context.Background(), candidate)
+
+			if got.Fetched != test.wantFetched || got.Failure != test.wantFailure {
+				t.Fatalf("fetched = %v, failure = %q (%s), want %v, %q", got.Fetched, got.Failure, got.Error, test.wantFetched, test.wantFailure)
+			}
+
+			if got.Unreachable {
+				t.Errorf("page marked unreachable")
+			}
+
+			if !test.wantFetched {
+				return
+			}
+
+			if got.Url.Url.Path != test.wantPath {
+				t.Errorf("path = %q, want %q", got.Url.Url.Path, test.wantPath)
+			}
+
+			if !bytes.Equal(got.Html, page) {
+				t.Errorf("html = %q, want %q", got.Html, page)
+			}
+		})
+	}
+}
+
+func TestFetchExternalPageHeadFallback(t *testing.T) {
+	tests := []struct {
+		name        string
+		headStatus  int
+		headType    string
+		getType     string
+		wantFetched bool
+		wantFailure string
+		wantGets    int32
+	}{
+		{name: "head allowed", headStatus: http.StatusOK, headType: "text/html", getType: "text/html", wantFetched: true, wantGets: 1},
+		{name: "head not allowed", headStatus: http.StatusMethodNotAllowed, getType: "text/html; charset=utf-8", wantFetched: true, wantGets: 1},
+		{name: "head not implemented", headStatus: http.StatusNotImplemented, getType: "text/html", wantFetched: true, wantGets: 1},
+		{name: "head not allowed and get not html", headStatus: http.StatusMethodNotAllowed, getType: "application/pdf", wantFailure: failureContentType, wantGets: 1},
+		{name: "head not implemented and get without a type", headStatus: http.StatusNotImplemented, getType: "", wantFailure: failureContentType, wantGets: 1},
+		{name: "head not html skips the get", headStatus: http.StatusOK, headType: "image/png", getType: "text/html", wantFailure: failureContentType, wantGets: 0},
+		{name: "head missing skips the get", headStatus: http.StatusNotFound, getType: "text/html", wantFailure: failureHttpStatus, wantGets: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var gets atomic.Int32
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodHead {
+					w.Header().Set("Content-Type", test.headType)
+					w.WriteHeader(test.headStatus)
+					return
+				}
+
+				gets.Add(1)
+
+				// An empty type would otherwise be sniffed from the body
+				w.Header()["Content-Type"] = []string{test.getType}
+				_, _ = w.Write([]byte("<html><head><title>Anime</title></head><body>anime</body></html>"))
+			}))
+			defer server.Close()
+
+			crawler := testCrawlerConfig()
+			candidate := testPage(server.URL+"/post", 1).Url
+			got := testDiscoverer(server.Client(), crawler).fetchExternalPageAttempt(context.Background(), candidate)
+
+			if got.Fetched != test.wantFetched || got.Failure != test.wantFailure {
+				t.Errorf("fetched = %v, failure = %q (%s), want %v, %q", got.Fetched, got.Failure, got.Error, test.wantFetched, test.wantFailure)
+			}
+
+			if count := gets.Load(); count != test.wantGets {
+				t.Errorf("%d GET requests, want %d", count, test.wantGets)
+			}
+
+			// Only a page confirmed as html has its body kept for scoring
+			if test.wantFetched == (len(got.Html) == 0) {
+				t.Errorf("html = %q with fetched %v", got.Html, got.Fetched)
+			}
+		})
+	}
+}
+
+func TestUpsertQueuedSiteDecay(t *testing.T) {
+	tests := []struct {
+		name       string
+		scoreDecay float64
+		wantFactor float64
+	}{
+		{name: "decay applied", scoreDecay: 0.8, wantFactor: 0.8},
+		{name: "zero resets the score", scoreDecay: 0, wantFactor: 0},
+		{name: "one keeps the score", scoreDecay: 1, wantFactor: 1},
+		{name: "out of range keeps the score", scoreDecay: 1.5, wantFactor: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, mock := newMockDb(t)
+			site := testPage("https://blog.example/post", 3)
+
+			mock.ExpectBegin()
+			mock.ExpectPrepare(regexp.QuoteMeta("ON DUPLICATE KEY UPDATE `score` = ROUND(`score` * ?) + VALUES(`score`)")).
+				ExpectExec().
+				WithArgs("blog.example", 4, "", site.Url.Link, int64(3), test.wantFactor).
+				WillReturnResult(sqlmock.NewResult(1, 2))
+			mock.ExpectQuery("SELECT score_detail").
+				WithArgs("blog.example").
+				WillReturnRows(sqlmock.NewRows([]string{"score_detail"}).AddRow([]byte(`{"anime":1}`)))
+			mock.ExpectPrepare("UPDATE `discovered_sites_queue` SET `score_detail`").ExpectExec().
+				WithArgs(`{"anime":2}`, "blog.example").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			err := inTransaction(context.Background(), db, func(tx *sql.Tx) error {
+				return upsertQueuedSite(context.Background(), tx, site, 4, map[string]int{"anime": 1}, "", test.scoreDecay)
+			})
+
+			if err != nil {
+				t.Fatalf("upsertQueuedSite() error = %v", err)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestDecayFactor(t *testing.T) {
+	tests := []struct {
+		name        string
+		scoreDecay  float64
+		storedScore int
+		runScore    int
+		wantScore   int
+	}{
+		{name: "old high score decays", scoreDecay: 0.5, storedScore: 1000, runScore: 10, wantScore: 510},
+		{name: "decayed score rounds", scoreDecay: 0.9, storedScore: 15, runScore: 2, wantScore: 16},
+		{name: "repeat sites fall behind a fresh one", scoreDecay: 0.1, storedScore: 100, runScore: 0, wantScore: 10},
+		{name: "zero resets to this run's score", scoreDecay: 0, storedScore: 1000, runScore: 10, wantScore: 10},
+		{name: "factor of one", scoreDecay: 1, storedScore: 1000, runScore: 10, wantScore: 1010},
+		{name: "negative factor", scoreDecay: -0.5, storedScore: 1000, runScore: 10, wantScore: 1010},
+		{name: "factor above one", scoreDecay: 1.5, storedScore: 1000, runScore: 10, wantScore: 1010},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The score the upsert's ROUND(`score` * ?) + VALUES(`score`) stores on re-encounter
+			got := int(math.Round(float64(test.storedScore)*decayFactor(test.scoreDecay))) + test.runScore
+
+			if got != test.wantScore {
+				t.Errorf("re-encountered score = %d, want %d", got, test.wantScore)
+			}
+		})
+	}
+}
+
+func TestRunPassesScoreDecay(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<html><head><title>Anime</title></head><body>anime</body></html>`))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		scoreDecay float64
+	}{
+		{name: "decay", scoreDecay: 0.75},
+		{name: "no decay", scoreDecay: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := &fakeStore{posts: []Post{testPost(1, server.URL, "/page")}}
+
+			config := testDiscovererConfig()
+			config.Scoring.ScoreDecay = test.scoreDecay
+
+			if _, err := NewDiscoverer(config, store, server.Client()).Run(context.Background()); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			if len(store.decays) != 1 || store.decays[0] != test.scoreDecay {
+				t.Errorf("queued with decay %v, want [%v]", store.decays, test.scoreDecay)
+			}
+		})
+	}
+}
+
+func TestMergeScoreDetail(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []byte
+		detail   map[string]int
+		want     string
+		wantErr  bool
+	}{
+		{name: "nothing stored", existing: nil, detail: map[string]int{"anime": 2}, want: `{"anime":2}`},
+		{name: "counts added", existing: []byte(`{"anime":2,"manga":1}`), detail: map[string]int{"anime": 3}, want: `{"anime":5,"manga":1}`},
+		{name: "misses left out", existing: nil, detail: map[string]int{"anime": 1, "manga": 0}, want: `{"anime":1}`},
+		{name: "invalid json", existing: []byte(`{`), detail: map[string]int{"anime": 1}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := mergeScoreDetail(test.existing, test.detail)
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("mergeScoreDetail() error = %v, wantErr %v", err, test.wantErr)
+			}
+
+			if got != test.want {
+				t.Errorf("mergeScoreDetail() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+// A page of several MB with its feed links in the <head>, as large news and forum pages are
+func largePage(b *testing.B) ExternalPage {
+	b.Helper()
+
+	var buffer bytes.Buffer
+	buffer.WriteString(`<html><head><title>Anime</title>` +
+		`<link rel="alternate" type="application/rss+xml" href="/feed">` +
+		`<link rel="alternate" type="application/atom+xml" href="/atom"></head><body>`)
+
+	for buffer.Len() < 4*1024*1024 {
+		buffer.WriteString(`<div class="post"><p>Episode <a href="/episode">review</a> and <em>discussion</em></p></div>`)
+	}
+
+	buffer.WriteString(`</body></html>`)
+
+	site := testPage("https://blog.example/", 1)
+	site.Html = buffer.Bytes()
+
+	return site
+}
+
+func BenchmarkGetFeedUrls(b *testing.B) {
+	site := largePage(b)
+
+	b.Run("head", func(b *testing.B) {
+		b.SetBytes(int64(len(site.Html)))
+
+		for i := 0; i < b.N; i++ {
+			if feedUrls := getFeedUrls(site); len(feedUrls) != 2 {
+				b.Fatalf("getFeedUrls() = %v", feedUrls)
+			}
+		}
+	})
+
+	// Tokenizing the whole document, as feed detection did before it stopped at the <body>
+	b.Run("whole document", func(b *testing.B) {
+		b.SetBytes(int64(len(site.Html)))
+
+		for i := 0; i < b.N; i++ {
+			tokenizer := html.NewTokenizer(bytes.NewReader(site.Html))
+
+			for tokenizer.Next() != html.ErrorToken {
+				_ = tokenizer.Token()
+			}
+		}
+	})
+}
+
+func TestGetCanonicalUrl(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{name: "absolute", html: `<head><link rel="canonical" href="https://blog.example/a/b"></head>`, want: "https://blog.example/a/b"},
+		{name: "relative", html: `<link rel=canonical href="/a/b/">`, want: "https://www.blog.example/a/b/"},
+		{name: "missing", html: `<head><title>Anime</title></head>`, want: ""},
+		{name: "in the body", html: `<title>Anime</title><body><link rel=canonical href="/elsewhere">`, want: ""},
+		{name: "not http", html: `<link rel="canonical" href="javascript:void(0)">`, want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			site := testPage("https://www.blog.example/a/b?utm_source=feed", 1)
+			site.Html = []byte(test.html)
+
+			if got := getCanonicalUrl(site); got != test.want {
+				t.Errorf("getCanonicalUrl() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIsAcceptedContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{contentType: "text/html", want: true},
+		{contentType: "TEXT/HTML; charset=UTF-8", want: true},
+		{contentType: "application/xhtml+xml; charset=utf-8", want: true},
+		{contentType: "text/html; charset=utf-8;", want: true},
+		{contentType: "text/html; charset", want: true},
+		{contentType: "application/json", want: false},
+		{contentType: "application/json; charset=utf-8", want: false},
+		{contentType: "image/png", want: false},
+		{contentType: "", want: false},
+		{contentType: "text/", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.contentType, func(t *testing.T) {
+			if got := isAcceptedContentType(test.contentType, defaultConfig().Crawler); got != test.want {
+				t.Errorf("isAcceptedContentType(%q) = %v, want %v", test.contentType, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSetRequestFailure(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+
+	tests := []struct {
+		name            string
+		err             error
+		wantUnreachable bool
+		wantFailure     string
+	}{
+		{name: "dns", err: &url.Error{Op: "Head", URL: "http://nowhere.example", Err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "nowhere.example", IsNotFound: true}}}, wantUnreachable: true, wantFailure: failureUnreachable},
+		{name: "connection refused", err: &url.Error{Op: "Head", URL: "http://example.com", Err: refused}, wantUnreachable: true, wantFailure: failureUnreachable},
+		{name: "refused after dialling", err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNREFUSED}, wantUnreachable: true, wantFailure: failureUnreachable},
+		{name: "dial timeout", err: &url.Error{Op: "Head", URL: "http://example.com", Err: &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}}, wantFailure: failureTimeout},
+		{name: "request timeout", err: &url.Error{Op: "Get", URL: "http://example.com", Err: context.DeadlineExceeded}, wantFailure: failureTimeout},
+		{name: "untrusted certificate", err: &url.Error{Op: "Get", URL: "https://example.com", Err: &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}}, wantFailure: failureCertificate},
+		{name: "tls alert", err: &url.Error{Op: "Get", URL: "https://example.com", Err: &net.OpError{Op: "remote error", Err: errors.New("tls: handshake failure")}}, wantFailure: failureRequestError},
+		{name: "too many redirects", err: &url.Error{Op: "Get", URL: "http://example.com", Err: errTooManyRedirects}, wantFailure: failureRequestError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var page ExternalPage
+			setRequestFailure(&page, test.err)
+
+			if page.Unreachable != test.wantUnreachable || page.Failure != test.wantFailure {
+				t.Errorf("unreachable = %v, failure = %q, want %v, %q", page.Unreachable, page.Failure, test.wantUnreachable, test.wantFailure)
+			}
+		})
+	}
+}
+
+func TestFetchExternalPageUnreachable(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedUrl := closed.URL
+	closed.Close()
+
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsServer.Close()
+
+	crawler := testCrawlerConfig()
+	crawler.MaxRetries = 0
+
+	tests := []struct {
+		name            string
+		url             string
+		wantUnreachable bool
+		wantFailure     string
+	}{
+		{name: "nothing listening", url: closedUrl + "/", wantUnreachable: true, wantFailure: failureUnreachable},
+		{name: "untrusted certificate", url: tlsServer.URL + "/", wantFailure: failureCertificate},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			candidate := testPage(test.url, 1).Url
+			got := testDiscoverer(newCrawlerClient(crawler), crawler).fetchExternalPageAttempt(context.Background(), candidate)
+
+			if got.Unreachable != test.wantUnreachable || got.Failure != test.wantFailure {
+				t.Errorf("unreachable = %v, failure = %q (%s), want %v, %q", got.Unreachable, got.Failure, got.Error, test.wantUnreachable, test.wantFailure)
+			}
+		})
+	}
+}
+
+// Refuses its first failures requests as though the network were down, then passes them on
+type outageDoer struct {
+	client   Doer
+	failures int32
+	calls    atomic.Int32
+}
+
+func (doer *outageDoer) Do(req *http.Request) (*http.Response, error) {
+	if doer.calls.Add(1) <= doer.failures {
+		return nil, &url.Error{Op: req.Method, URL: req.URL.String(), Err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}
+	}
+
+	return doer.client.Do(req)
+}
+
+func TestFetchExternalPagesOutage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits out the first outage backoff")
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><head><title>Anime</title></head></html>"))
+	}))
+	defer server.Close()
+
+	crawler := testCrawlerConfig()
+	crawler.MaxRetries = 0
+	crawler.OutageMinFetches = 3
+	crawler.OutageFailureRate = 0.5
+	crawler.OutageMaxWait = 60
+
+	var candidates []ExternalUrl
+
+	for _, path := range []string{"/a", "/b", "/c"} {
+		candidates = append(candidates, testPage(server.URL+path, 1).Url)
+	}
+
+	doer := &outageDoer{client: newCrawlerClient(crawler), failures: int32(len(candidates))}
+	pages, failed, err := testDiscoverer(doer, crawler).fetchExternalPages(context.Background(), candidates)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pages) != len(candidates) || len(failed) != 0 {
+		t.Errorf("fetched %d and failed %d, want all %d fetched once the network is back", len(pages), len(failed), len(candidates))
+	}
+}
+
+// Answers each path with its failure status for the first failures requests, then with a page
+func flakyServer(t *testing.T, failures int, status int, retryAfter string) (*httptest.Server, func(path string) int) {
+	t.Helper()
+
+	var mu sync.Mutex
+	requests := make(map[string]int)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		count := requests[r.URL.Path]
+		mu.Unlock()
+
+		if count <= failures {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+
+			w.WriteHeader(status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><head><title>Anime</title></head></html>"))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return requests[path]
+	}
+}
+
+func TestFetchExternalPageRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		status       int
+		retryAfter   string
+		maxRetries   int
+		wantFetched  bool
+		wantRequests int
+	}{
+		{name: "recovers from 503s", failures: 1, status: http.StatusServiceUnavailable, maxRetries: 2, wantFetched: true, wantRequests: 3},
+		{name: "gives up after max retries", failures: 5, status: http.StatusServiceUnavailable, maxRetries: 1, wantRequests: 2},
+		{name: "404 is not retried", failures: 5, status: http.StatusNotFound, maxRetries: 2, wantRequests: 1},
+		{name: "429 waits for retry after", failures: 1, status: http.StatusTooManyRequests, retryAfter: "1", maxRetries: 2, wantFetched: true, wantRequests: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, requests := flakyServer(t, test.failures, test.status, test.retryAfter)
+
+			crawler := testCrawlerConfig()
+			crawler.MaxRetries = test.maxRetries
+			crawler.RetryBackoffMs = 10
+
+			candidate := testPage(server.URL+"/page", 1).Url
+			started := time.Now()
+			pages := testDiscoverer(newCrawlerClient(crawler), crawler).fetchExternalPageBatch(context.Background(), []ExternalUrl{candidate})
+
+			if pages[0].Fetched != test.wantFetched {
+				t.Errorf("fetched = %v (%s), want %v", pages[0].Fetched, pages[0].Failure, test.wantFetched)
+			}
+
+			// The HEAD that failed is retried, and a page that succeeds is then fetched with a GET
+			if got := requests("/page"); got != test.wantRequests {
+				t.Errorf("requests = %d, want %d", got, test.wantRequests)
+			}
+
+			if test.retryAfter != "" && time.Since(started) < time.Second {
+				t.Errorf("retried after %s, before the Retry-After", time.Since(started))
+			}
+		})
+	}
+}
+
+func TestRetryingFetchReleasesItsSlots(t *testing.T) {
+	server, requests := flakyServer(t, 1, http.StatusServiceUnavailable, "")
+
+	crawler := testCrawlerConfig()
+	crawler.MaxConcurrency = 1
+	crawler.MaxPerHostConcurrency = 1
+	crawler.MaxRetries = 1
+	crawler.RetryBackoffMs = 500
+
+	var candidates []ExternalUrl
+
+	for _, path := range []string{"/a", "/b", "/c"} {
+		candidates = append(candidates, testPage(server.URL+path, 1).Url)
+	}
+
+	started := time.Now()
+	pages := testDiscoverer(newCrawlerClient(crawler), crawler).fetchExternalPageBatch(context.Background(), candidates)
+
+	for _, page := range pages {
+		if !page.Fetched {
+			t.Errorf("%s not fetched: %s", page.Url.Link, page.Failure)
+		}
+
+		if got := requests(page.Url.Url.Path); got != 3 {
+			t.Errorf("%s requested %d times, want 3", page.Url.Link, got)
+		}
+	}
+
+	// Waiting in turn for each other's backoff would take at least three of them
+	if elapsed := time.Since(started); elapsed > 1500*time.Millisecond {
+		t.Errorf("batch took %s, retries held their slots while waiting", elapsed)
+	}
+}
+
+func TestFetchExternalPageBatchConcurrency(t *testing.T) {
+	tests := []struct {
+		name        string
+		concurrency int
+		wantMax     int32
+	}{
+		{name: "one at a time", concurrency: 1, wantMax: 1},
+		{name: "bounded", concurrency: 3, wantMax: 3},
+		{name: "limit above the batch", concurrency: 20, wantMax: 6},
+		{name: "unlimited", concurrency: 0, wantMax: 6},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var inFlight, maxInFlight atomic.Int32
+
+			doer := handlerDoer{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/robots.txt" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+
+				current := inFlight.Add(1)
+				defer inFlight.Add(-1)
+
+				for {
+					seen := maxInFlight.Load()
+
+					if current <= seen || maxInFlight.CompareAndSwap(seen, current) {
+						break
+					}
+				}
+
+				time.Sleep(50 * time.Millisecond)
+				w.Header().Set("Content-Type", "text/html")
+				_, _ = w.Write([]byte("<html><head><title>Anime</title></head></html>"))
+			})}
+
+			crawler := testCrawlerConfig()
+			crawler.MaxConcurrency = test.concurrency
+			crawler.RespectCrawlDelay = false
+
+			// Each candidate is on its own host so the per host limit doesn't come into it
+			var candidates []ExternalUrl
+
+			for i := 0; i < 6; i++ {
+				candidates = append(candidates, testPage(fmt.Sprintf("https://site%d.example/", i), 1).Url)
+			}
+
+			pages := testDiscoverer(doer, crawler).fetchExternalPageBatch(context.Background(), candidates)
+
+			for _, page := range pages {
+				if !page.Fetched {
+					t.Errorf("%s not fetched: %s", page.Url.Link, page.Failure)
+				}
+			}
+
+			if got := maxInFlight.Load(); got != test.wantMax {
+				t.Errorf("at most %d pages fetched at once, want %d", got, test.wantMax)
+			}
+		})
+	}
+}
+
+func TestGetUserAgent(t *testing.T) {
+	crawler := defaultConfig().Crawler
+	crawler.UserAgent = "default-agent"
+	crawler.UserAgentRules = []UserAgentRule{
+		{HostSuffix: "tumblr.com", UserAgent: "Baiduspider"},
+		{HostSuffix: ".walled.example", UserAgent: "first-rule"},
+		{HostSuffix: "walled.example", UserAgent: "second-rule"},
+	}
+
+	tests := []struct {
+		link string
+		want string
+	}{
+		{link: "https://tumblr.com/", want: "Baiduspider"},
+		{link: "https://anime.tumblr.com/post/1", want: "Baiduspider"},
+		{link: "https://ANIME.Tumblr.com/", want: "Baiduspider"},
+		{link: "https://nottumblr.com/", want: "default-agent"},
+		{link: "https://tumblr.com.evil.example/", want: "default-agent"},
+		{link: "https://www.walled.example/", want: "first-rule"},
+		{link: "https://example.com/", want: "default-agent"},
+		{link: "://not a url", want: "default-agent"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.link, func(t *testing.T) {
+			if got := getUserAgent(test.link, crawler); got != test.want {
+				t.Errorf("getUserAgent(%q) = %q, want %q", test.link, got, test.want)
+			}
+		})
+	}
+}
+
+// Panics on requests to paths in panicPaths and passes the rest on
+type panicDoer struct {
+	client     Doer
+	panicPaths map[string]any
+}
+
+func (doer panicDoer) Do(req *http.Request) (*http.Response, error) {
+	if value, ok := doer.panicPaths[req.URL.Path]; ok {
+		panic(value)
+	}
+
+	return doer.client.Do(req)
+}
+
+func TestFetchExternalPageBatchDrainsAfterPanic(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><head><title>Anime</title></head></html>"))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		paths       []string
+		panicPaths  []string
+		concurrency int
+	}{
+		{name: "first of several panics", paths: []string{"/a", "/b", "/c"}, panicPaths: []string{"/a"}, concurrency: 3},
+		{name: "last of several panics", paths: []string{"/a", "/b", "/c"}, panicPaths: []string{"/c"}, concurrency: 3},
+		{name: "panics with one slot", paths: []string{"/a", "/b", "/c"}, panicPaths: []string{"/a", "/b"}, concurrency: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			crawler := testCrawlerConfig()
+			crawler.MaxConcurrency = test.concurrency
+			crawler.RespectCrawlDelay = false
+
+			doer := panicDoer{client: server.Client(), panicPaths: make(map[string]any)}
+
+			for _, path := range test.panicPaths {
+				doer.panicPaths[path] = "boom"
+			}
+
+			var candidates []ExternalUrl
+
+			for _, path := range test.paths {
+				candidates = append(candidates, testPage(server.URL+path, 1).Url)
+			}
+
+			done := make(chan []ExternalPage)
+
+			go func() {
+				done <- testDiscoverer(doer, crawler).fetchExternalPageBatch(context.Background(), candidates)
+			}()
+
+			var pages []ExternalPage
+
+			select {
+			case pages = <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("batch didn't finish after a fetch panicked")
+			}
+
+			// Every candidate has its page, in order, whether its fetch panicked or not
+			for i, page := range pages {
+				_, panicked := doer.panicPaths[page.Url.Url.Path]
+
+				if page.Url.Link != candidates[i].Link || page.Fetched == panicked {
+					t.Errorf("page %d = %s fetched %v, want %s fetched %v", i, page.Url.Link, page.Fetched, candidates[i].Link, !panicked)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchExternalPageRecoversPanic(t *testing.T) {
+	var nilMap map[string]int
+
+	tests := []struct {
+		name      string
+		value     any
+		wantError string
+	}{
+		{name: "string", value: "boom", wantError: "boom"},
+		{name: "error", value: errors.New("bad url"), wantError: "bad url"},
+		{name: "runtime error", value: func() (recovered any) {
+			defer func() {
+				recovered = recover()
+			}()
+
+			nilMap["x"] = 1
+
+			return nil
+		}(), wantError: "assignment to entry in nil map"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			crawler := testCrawlerConfig()
+			crawler.RespectCrawlDelay = false
+
+			doer := panicDoer{panicPaths: map[string]any{"/x": test.value}}
+			candidates := []ExternalUrl{testPage("http://a.example/x", 1).Url, testPage("http://b.example/x", 2).Url}
+
+			pages := testDiscoverer(doer, crawler).fetchExternalPageBatch(context.Background(), candidates)
+
+			if len(pages) != len(candidates) {
+				t.Fatalf("got %d pages, want %d", len(pages), len(candidates))
+			}
+
+			for _, page := range pages {
+				if page.Fetched || page.Failure != failurePanic || !strings.Contains(page.Error, test.wantError) {
+					t.Errorf("page %s fetched %v, failure %q (%s), want a %q panic", page.Url.Link, page.Fetched, page.Failure, page.Error, test.wantError)
+				}
+			}
+		})
+	}
+}
+
+func TestGetRelevancyScoreVisibleText(t *testing.T) {
+	keywords := map[string]int{"anime": 1}
+
+	tests := []struct {
+		name string
+		html string
+		want int
+	}{
+		{name: "script only", html: `<html><head><title>Blog</title><script>var topic = "anime";</script></head><body><p>Hello</p></body></html>`, want: 0},
+		{name: "json-ld script only", html: `<html><body><script type="application/ld+json">{"keywords": "anime anime anime"}</script><p>Hello</p></body></html>`, want: 0},
+		{name: "script in the body", html: `<html><body><p>Hello</p><script>render("anime")</script></body></html>`, want: 0},
+		{name: "style only", html: `<html><head><style>.anime { color: red }</style></head><body><p>Hello</p></body></html>`, want: 0},
+		{name: "comment only", html: `<html><body><!-- anime --><p>Hello</p></body></html>`, want: 0},
+		{name: "attribute only", html: `<html><body><img alt="anime" src="/anime.png"><p>Hello</p></body></html>`, want: 0},
+		{name: "visible text", html: `<html><body><script>var anime;</script><p>anime</p></body></html>`, want: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scoring := defaultConfig().Scoring
+			page := testPage("https://blog.example/", 1)
+			page.Html = []byte(test.html)
+
+			if got := getRelevancyScore(page, keywords, scoring); got.Total != test.want || got.Counts["anime"] != test.want {
+				t.Errorf("getRelevancyScore() = %d with %v, want %d", got.Total, got.Counts, test.want)
+			}
+		})
+	}
+}
+
+// The links getUrlsFromPost takes from a post on blog.example with the given body
+func postLinks(t *testing.T, body string, filter FilterConfig) []string {
+	t.Helper()
+
+	urls, err := getUrlsFromPost(Post{Id: 1, Url: "https://blog.example/posts/1", Body: body}, filter)
+
+	if err != nil {
+		t.Fatalf("getUrlsFromPost() error = %v", err)
+	}
+
+	var links []string
+
+	for _, externalUrl := range urls {
+		links = append(links, externalUrl.Link)
+	}
+
+	return links
+}
+
+func TestIsIpHost(t *testing.T) {
+	tests := []struct {
+		rawUrl string
+		want   bool
+	}{
+		{rawUrl: "http://192.0.2.1/", want: true},
+		{rawUrl: "http://192.0.2.1:8080/feed", want: true},
+		{rawUrl: "http://[2001:db8::1]/", want: true},
+		{rawUrl: "http://[::1]:8080/", want: true},
+		{rawUrl: "http://example.com/", want: false},
+		{rawUrl: "http://1.example.com/", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.rawUrl, func(t *testing.T) {
+			parsed, err := url.Parse(test.rawUrl)
+
+			if err != nil {
+				t.Fatalf("could not parse %s: %v", test.rawUrl, err)
+			}
+
+			if got := isIpHost(parsed); got != test.want {
+				t.Errorf("isIpHost(%s) = %v, want %v", test.rawUrl, got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetUrlsFromPostSkipsIpHosts(t *testing.T) {
+	body := `<a href="http://192.0.2.1/">one</a><a href="http://[2001:db8::1]/">two</a><a href="http://example.com/">three</a>`
+
+	tests := []struct {
+		name        string
+		skipIpHosts bool
+		want        []string
+	}{
+		{name: "skipped", skipIpHosts: true, want: []string{"http://example.com/"}},
+		{name: "kept", skipIpHosts: false, want: []string{"http://192.0.2.1/", "http://[2001:db8::1]/", "http://example.com/"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter := defaultConfig().Filter
+			filter.SkipIpHosts = test.skipIpHosts
+
+			if got := postLinks(t, body, filter); strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("getUrlsFromPost() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetUrlsFromPostLinkTags(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{name: "anchor", body: `<a href="https://one.example/">one</a>`, want: []string{"https://one.example/"}},
+		{name: "area", body: `<map><area shape="rect" href="https://one.example/map"></map>`, want: []string{"https://one.example/map"}},
+		{name: "canonical link", body: `<link rel="canonical" href="https://one.example/original">`, want: []string{"https://one.example/original"}},
+		{name: "alternate link", body: `<link rel="Alternate" href="https://one.example/amp"/>`, want: []string{"https://one.example/amp"}},
+		{name: "stylesheet link", body: `<link rel="stylesheet" href="https://cdn.example/site.css">`},
+		{name: "icon link", body: `<link rel="icon" href="https://cdn.example/favicon.ico">`},
+		{name: "link without rel", body: `<link href="https://one.example/">`},
+		{name: "other tags", body: `<div href="https://one.example/"></div><img src="https://one.example/">`},
+		{name: "entity encoded query", body: `<a href="https://one.example/?a=1&amp;b=2">one</a>`, want: []string{"https://one.example/?a=1&b=2"}},
+		{name: "double encoded query", body: `<a href="https://one.example/?a=1&amp;amp;b=2">one</a>`, want: []string{"https://one.example/?a=1&b=2"}},
+		{name: "surrounding whitespace", body: `<a href="  https://one.example/  ">one</a>`, want: []string{"https://one.example/"}},
+		{name: "line break inside", body: "<a href=\"https://one.\nexample/\r\n\tpost\">one</a>", want: []string{"https://one.example/post"}},
+		{name: "unquoted href", body: `<a href=https://one.example/>one</a>`, want: []string{"https://one.example/"}},
+		{name: "empty href", body: `<a href="">one</a><a href="   ">two</a>`},
+		{name: "href without a value", body: `<a href>one</a>`},
+		{name: "unclosed attribute", body: `<a href="https://one.example/>one</a>`},
+		{name: "non navigable schemes", body: `<a href="mailto:a@one.example">a</a><a href=" JavaScript:void(0)">b</a><a href="#top">c</a>`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := postLinks(t, test.body, defaultConfig().Filter); strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("getUrlsFromPost() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetUrlsFromPostResolvesLinks(t *testing.T) {
+	tests := []struct {
+		name            string
+		postUrl         string
+		aggregatorHosts []string
+		body            string
+		want            []string
+	}{
+		{name: "protocol relative on https", postUrl: "https://blog.example/posts/1", body: `<a href="//cdn.example/page">a</a>`, want: []string{"https://cdn.example/page"}},
+		{name: "protocol relative on http", postUrl: "http://blog.example/posts/1", body: `<a href="//cdn.example/page">a</a>`, want: []string{"http://cdn.example/page"}},
+		{name: "protocol relative to the post host", postUrl: "https://blog.example/posts/1", body: `<a href="//www.blog.example/about">a</a>`},
+		{name: "root relative", postUrl: "https://blog.example/posts/1", body: `<a href="/about">a</a>`},
+		{name: "path relative", postUrl: "https://blog.example/posts/1", body: `<a href="2">a</a>`},
+		{name: "root relative on an aggregator", postUrl: "https://aggregator.example/posts/1", aggregatorHosts: []string{"aggregator.example"}, body: `<a href="/u/blog">a</a>`, want: []string{"https://aggregator.example/u/blog"}},
+		{name: "path relative on an aggregator", postUrl: "https://aggregator.example/posts/1", aggregatorHosts: []string{"aggregator.example"}, body: `<a href="../u/blog?page=2">a</a>`, want: []string{"https://aggregator.example/u/blog?page=2"}},
+		{name: "fragment only", postUrl: "https://blog.example/posts/1", body: `<a href="#comments">a</a>`},
+		{name: "fragment dropped", postUrl: "https://blog.example/posts/1", body: `<a href="https://one.example/page#top">a</a>`, want: []string{"https://one.example/page"}},
+		{name: "duplicates kept once", postUrl: "https://blog.example/posts/1", body: `<a href="https://one.example/">a</a><a href="//one.example/#about">b</a><a href="https://one.example/">c</a>`, want: []string{"https://one.example/"}},
+		{name: "same host with a port", postUrl: "https://blog.example/posts/1", body: `<a href="https://blog.example:443/about">a</a>`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter := defaultConfig().Filter
+			filter.AggregatorHosts = test.aggregatorHosts
+
+			urls, err := getUrlsFromPost(Post{Id: 1, Url: test.postUrl, Body: test.body}, filter)
+
+			if err != nil {
+				t.Fatalf("getUrlsFromPost() error = %v", err)
+			}
+
+			var got []string
+
+			for _, externalUrl := range urls {
+				got = append(got, externalUrl.Link)
+
+				// The parsed URL is the resolved one, so hosts are checked against where the link really goes
+				if externalUrl.Url.String() != externalUrl.Link || externalUrl.Url.Host == "" {
+					t.Errorf("url = %q, want %q", externalUrl.Url, externalUrl.Link)
+				}
+			}
+
+			if strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("getUrlsFromPost() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIsNavigableHref(t *testing.T) {
+	tests := []struct {
+		href string
+		want bool
+	}{
+		{href: "https://one.example/", want: true},
+		{href: "//one.example/", want: true},
+		{href: "/about", want: true},
+		{href: "page?a=1#top", want: true},
+		{href: "ftp://one.example/file", want: true},
+		{href: "mailto:a@one.example", want: false},
+		{href: "MAILTO:a@one.example", want: false},
+		{href: "tel:+441234567890", want: false},
+		{href: "javascript:void(0)", want: false},
+		{href: "JavaScript:alert(1)", want: false},
+		{href: "data:text/html;base64,PGh0bWw+", want: false},
+		{href: "#", want: false},
+		{href: "#comments", want: false},
+		{href: "", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.href, func(t *testing.T) {
+			if got := isNavigableHref(test.href); got != test.want {
+				t.Errorf("isNavigableHref(%q) = %v, want %v", test.href, got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetUrlsFromPostSkipsNonNavigableHrefs(t *testing.T) {
+	tests := []struct {
+		name string
+		href string
+	}{
+		{name: "mailto", href: "mailto:a@one.example?subject=hi"},
+		{name: "tel", href: "tel:+44 1234 567890"},
+		{name: "javascript", href: "javascript:window.open('https://one.example/')"},
+		{name: "data", href: "data:text/html,<a href=https://one.example/>"},
+		{name: "anchor only", href: "#https://one.example/"},
+		{name: "scheme after whitespace", href: "\n  javascript:void(0)"},
+		{name: "scheme split by a line break", href: "java\nscript:void(0)"},
+		{name: "entity encoded scheme", href: "&#109;ailto:a@one.example"},
+		{name: "unparseable mailto", href: "mailto:%zz"},
+		{name: "other scheme", href: "ftp://one.example/file"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := `<a href="` + html.EscapeString(test.href) + `">skipped</a><a href="https://kept.example/">kept</a>`
+
+			if got := postLinks(t, body, defaultConfig().Filter); strings.Join(got, " ") != "https://kept.example/" {
+				t.Errorf("getUrlsFromPost() = %v, want only https://kept.example/", got)
+			}
+		})
+	}
+}
+
+func TestGetUrlKeywordScore(t *testing.T) {
+	tests := []struct {
+		name     string
+		rawUrl   string
+		keywords []string
+		weight   int
+		want     int
+	}{
+		{name: "in the path", rawUrl: "https://example.com/anime-reviews/", keywords: []string{"anime"}, weight: 3, want: 3},
+		{name: "in the host", rawUrl: "https://anime.example.com/", keywords: []string{"anime"}, weight: 3, want: 3},
+		{name: "host and path", rawUrl: "https://anime.example.com/anime/", keywords: []string{"anime"}, weight: 2, want: 4},
+		{name: "configured in upper case", rawUrl: "https://example.com/Anime_Blog", keywords: []string{"ANIME"}, weight: 1, want: 1},
+		{name: "part of a word", rawUrl: "https://example.com/animebits/", keywords: []string{"anime"}, weight: 3, want: 0},
+		{name: "only in the query", rawUrl: "https://example.com/?tag=anime", keywords: []string{"anime"}, weight: 3, want: 0},
+		{name: "no keywords", rawUrl: "https://example.com/anime/", weight: 3, want: 0},
+		{name: "no weight", rawUrl: "https://example.com/anime/", keywords: []string{"anime"}, want: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scoring := defaultConfig().Scoring
+			scoring.UrlKeywords = test.keywords
+			scoring.UrlKeywordWeight = test.weight
+
+			if got := getUrlKeywordScore(testPage(test.rawUrl, 1), scoring); got != test.want {
+				t.Errorf("getUrlKeywordScore(%s) = %d, want %d", test.rawUrl, got, test.want)
+			}
+		})
+	}
+}
+
+func TestFormatDsn(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  map[string]string
+		want    []string
+		notWant []string
+	}{
+		{name: "default charset", want: []string{"charset=utf8mb4"}},
+		{
+			name:   "params passed through",
+			params: map[string]string{"parseTime": "true", "loc": "UTC", "readTimeout": "30s", "collation": "utf8mb4_unicode_ci"},
+			want:   []string{"charset=utf8mb4", "parseTime=true", "loc=UTC", "readTimeout=30s", "collation=utf8mb4_unicode_ci"},
+		},
+		{name: "charset overridden", params: map[string]string{"charset": "latin1"}, want: []string{"charset=latin1"}, notWant: []string{"utf8mb4"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dbConfig := DbConfig{User: "user", Password: "secret", Server: "db.example:3306", DbName: "abt", Params: test.params}
+			dsn := formatDsn(dbConfig)
+
+			if !strings.HasPrefix(dsn, "user:secret@tcp(db.example:3306)/abt?") {
+				t.Errorf("formatDsn() = %s, want it to connect to abt on db.example:3306", dsn)
+			}
+
+			for _, param := range test.want {
+				if !strings.Contains(dsn, param) {
+					t.Errorf("formatDsn() = %s, want %s", dsn, param)
+				}
+			}
+
+			for _, param := range test.notWant {
+				if strings.Contains(dsn, param) {
+					t.Errorf("formatDsn() = %s, don't want %s", dsn, param)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchExternalPageRange(t *testing.T) {
+	var filler strings.Builder
+
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&filler, "<p>post %d</p>", i)
+	}
+
+	page := []byte(`<html><head><title>Anime</title><link rel="alternate" type="application/rss+xml" href="/feed"></head><body>` + filler.String() + `<p>the end</p></body></html>`)
+	compressed := gzipBytes(t, page)
+
+	var ranges []string
+	var rangesMutex sync.Mutex
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ranged", func(w http.ResponseWriter, r *http.Request) {
+		rangesMutex.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		rangesMutex.Unlock()
+
+		w.Header().Set("Content-Type", "text/html")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(page))
+	})
+	mux.HandleFunc("/ranged-gzip", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "gzip")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(compressed))
+	})
+	mux.HandleFunc("/ignores-range", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write(page)
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		path        string
+		rangeBytes  int
+		wantPartial bool
+		wantRange   string
+	}{
+		{name: "prefix only", path: "/ranged", rangeBytes: 1024, wantPartial: true, wantRange: "bytes=0-1023"},
+		{name: "compressed prefix", path: "/ranged-gzip", rangeBytes: 1024, wantPartial: true},
+		{name: "server ignores range", path: "/ignores-range", rangeBytes: 1024},
+		{name: "range off", path: "/ranged", rangeBytes: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rangesMutex.Lock()
+			ranges = nil
+			rangesMutex.Unlock()
+
+			crawler := testCrawlerConfig()
+			crawler.RangeBytes = test.rangeBytes
+
+			candidate := testPage(server.URL+test.path, 1).Url
+			got := testDiscoverer(server.Client(), crawler).fetchExternalPageAttempt(context.Background(), candidate)
+
+			if !got.Fetched || got.Partial != test.wantPartial {
+				t.Fatalf("fetched = %v, partial = %v, failure = %q (%s), want a partial %v page", got.Fetched, got.Partial, got.Failure, got.Error, test.wantPartial)
+			}
+
+			if test.wantPartial == bytes.Contains(got.Html, []byte("the end")) {
+				t.Errorf("fetched %d of %d bytes, partial %v", len(got.Html), len(page), test.wantPartial)
+			}
+
+			if test.wantPartial && test.path == "/ranged" && len(got.Html) != test.rangeBytes {
+				t.Errorf("fetched %d bytes, want the first %d", len(got.Html), test.rangeBytes)
+			}
+
+			if feedUrl := getRssFeedUrl(got); !strings.HasSuffix(feedUrl, "/feed") {
+				t.Errorf("feed url = %q, want the feed linked in the head", feedUrl)
+			}
+
+			rangesMutex.Lock()
+			defer rangesMutex.Unlock()
+
+			if test.wantRange != "" && (len(ranges) == 0 || ranges[len(ranges)-1] != test.wantRange) {
+				t.Errorf("requested ranges %q, want %q", ranges, test.wantRange)
+			}
+
+			if test.rangeBytes == 0 && len(ranges) > 0 && ranges[len(ranges)-1] != "" {
+				t.Errorf("requested ranges %q with ranges off", ranges)
+			}
+		})
+	}
+}
+
+func TestStartWithRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		attempts     int
+		cancelled    bool
+		wantRuns     int
+		wantLastFail bool
+	}{
+		{name: "first run succeeds", failures: 0, attempts: 3, wantRuns: 1},
+		{name: "recovers after failures", failures: 2, attempts: 3, wantRuns: 3},
+		{name: "gives up", failures: 5, attempts: 3, wantRuns: 3, wantLastFail: true},
+		{name: "stops when shut down", failures: 5, attempts: 3, cancelled: true, wantRuns: 1, wantLastFail: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			if test.cancelled {
+				cancel()
+			}
+
+			runs := 0
+			var lastErr error
+
+			startWithRetry(ctx, ServiceConfig{StartupAttempts: test.attempts}, func(ctx context.Context) error {
+				runs++
+
+				if runs <= test.failures {
+					lastErr = errors.New("could not reach database")
+				} else {
+					lastErr = nil
+				}
+
+				return lastErr
+			})
+
+			if runs != test.wantRuns || (lastErr != nil) != test.wantLastFail {
+				t.Errorf("ran %d times, last error %v, want %d runs, failing %v", runs, lastErr, test.wantRuns, test.wantLastFail)
+			}
+		})
+	}
+}
+
+func TestPingWithRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		attempts int
+		wantErr  bool
+	}{
+		{name: "reachable", failures: 0, attempts: 3},
+		{name: "reachable after failures", failures: 2, attempts: 3},
+		{name: "unreachable", failures: 3, attempts: 3, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+
+			if err != nil {
+				t.Fatalf("could not create mock db: %v", err)
+			}
+
+			t.Cleanup(func() {
+				_ = db.Close()
+			})
+
+			for i := 0; i < test.attempts; i++ {
+				if i < test.failures {
+					mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+				} else {
+					mock.ExpectPing()
+					break
+				}
+			}
+
+			err = pingWithRetry(context.Background(), db, DbConfig{ConnectAttempts: test.attempts})
+
+			if (err != nil) != test.wantErr {
+				t.Errorf("pingWithRetry() error = %v, want error %v", err, test.wantErr)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestGetPostsFilters(t *testing.T) {
+	tests := []struct {
+		name        string
+		postsConfig PostsConfig
+		afterPostId int64
+		wantQuery   string
+		wantArgs    []driver.Value
+	}{
+		{
+			name:        "ingested recently",
+			postsConfig: PostsConfig{LookbackHours: 2},
+			wantQuery:   "SELECT pk_post_id, post_title, link, content FROM `posts` WHERE `created` >= now() - INTERVAL ? hour ORDER BY pub_date DESC",
+			wantArgs:    []driver.Value{2},
+		},
+		{
+			name:        "backdated posts skipped by max age",
+			postsConfig: PostsConfig{LookbackHours: 2, MaxAgeHours: 72},
+			wantQuery:   "SELECT pk_post_id, post_title, link, content FROM `posts` WHERE `created` >= now() - INTERVAL ? hour AND pub_date >= now() - INTERVAL 72 hour ORDER BY pub_date DESC",
+			wantArgs:    []driver.Value{2},
+		},
+		{
+			name:        "configured ingested column",
+			postsConfig: PostsConfig{LookbackHours: 2, IngestedColumn: "inserted_at", MaxAgeHours: 72},
+			wantQuery:   "SELECT pk_post_id, post_title, link, content FROM `posts` WHERE `inserted_at` >= now() - INTERVAL ? hour AND pub_date >= now() - INTERVAL 72 hour ORDER BY pub_date DESC",
+			wantArgs:    []driver.Value{2},
+		},
+		{
+			name:        "another schema after the watermark",
+			postsConfig: PostsConfig{LookbackHours: 2, Schema: "feeds"},
+			afterPostId: 40,
+			wantQuery:   "SELECT pk_post_id, post_title, link, content FROM `feeds`.`posts` WHERE `created` >= now() - INTERVAL ? hour AND pk_post_id > ? ORDER BY pub_date DESC",
+			wantArgs:    []driver.Value{2, int64(40)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, mock := newMockDb(t)
+			mock.ExpectQuery("^" + regexp.QuoteMeta(test.wantQuery) + "$").
+				WithArgs(test.wantArgs...).
+				WillReturnRows(sqlmock.NewRows([]string{"pk_post_id", "post_title", "link", "content"}).
+					AddRow(41, "Reposted", "https://a.example/41", "<p>old news</p>"))
+
+			posts, err := getPosts(context.Background(), db, test.postsConfig, test.afterPostId)
+
+			if err != nil || len(posts) != 1 {
+				t.Fatalf("getPosts() = %d posts, error = %v, want 1", len(posts), err)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"net/http"
+)
+
+var (
+	postsProcessed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "abt_discover_posts_processed_total",
+		Help: "Posts read to extract candidate links from.",
+	})
+	candidatesExtracted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "abt_discover_candidates_extracted_total",
+		Help: "Candidate links extracted from posts.",
+	})
+	pagesFetched = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "abt_discover_pages_fetched_total",
+		Help: "Candidate pages fetched successfully.",
+	})
+	fetchErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "abt_discover_fetch_errors_total",
+		Help: "Candidate pages that could not be fetched, by failure category.",
+	}, []string{"failure"})
+	sitesQueued = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "abt_discover_sites_queued_total",
+		Help: "Prospects added to or updated in the review queue.",
+	})
+	fetchLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "abt_discover_fetch_duration_seconds",
+		Help:    "Time taken to fetch a candidate page, including retries.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	})
+)
+
+// Serve /metrics and /healthz in the background until the process exits. They share a server when they are
+// configured on the same port
+func startHttpServers(metrics MetricsConfig, health HealthConfig, db Pinger) {
+	muxes := make(map[int]*http.ServeMux)
+
+	muxFor := func(port int) *http.ServeMux {
+		if muxes[port] == nil {
+			muxes[port] = http.NewServeMux()
+		}
+
+		return muxes[port]
+	}
+
+	if metrics.Enabled {
+		muxFor(metrics.Port).Handle("/metrics", promhttp.Handler())
+	}
+
+	if health.Enabled {
+		muxFor(health.Port).HandleFunc("/healthz", newHealthHandler(db))
+	}
+
+	for port, mux := range muxes {
+		address := fmt.Sprintf(":%d", port)
+
+		go func(address string, mux *http.ServeMux) {
+			err := http.ListenAndServe(address, mux)
+
+			if err != nil {
+				slog.Error("http server stopped", "address", address, "error", err)
+			}
+		}(address, mux)
+
+		slog.Info("serving http", "address", address, "metrics", metrics.Enabled && metrics.Port == port, "health", health.Enabled && health.Port == port)
+	}
+}
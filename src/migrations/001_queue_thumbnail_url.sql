@@ -0,0 +1,2 @@
+ALTER TABLE `discovered_sites_queue`
+    ADD COLUMN `thumbnail_url` VARCHAR(2048) NULL DEFAULT NULL;
@@ -0,0 +1,3 @@
+-- NULL until the feed has been checked, then 1 for a working feed and 0 for a dead one
+ALTER TABLE `discovered_sites_queue`
+    ADD COLUMN `feed_verified` TINYINT(1) NULL DEFAULT NULL;
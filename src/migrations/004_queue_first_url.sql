@@ -0,0 +1,4 @@
+-- The page that first led to the prospect and the post that linked to it, kept when the host is seen again
+ALTER TABLE `discovered_sites_queue`
+    ADD COLUMN `first_url` VARCHAR(2048) NULL DEFAULT NULL,
+    ADD COLUMN `first_post_id` BIGINT NULL DEFAULT NULL;
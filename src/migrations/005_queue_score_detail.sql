@@ -0,0 +1,3 @@
+-- Keyword hits behind the score, as {"keyword": count}, summed across every time the prospect is seen
+ALTER TABLE `discovered_sites_queue`
+    ADD COLUMN `score_detail` JSON NULL DEFAULT NULL;
@@ -0,0 +1,6 @@
+-- When the prospect was first queued and when a post last linked to it. Prospects queued before this migration have
+-- no first_seen, and no last_seen until they are seen again
+ALTER TABLE `discovered_sites_queue`
+    ADD COLUMN `first_seen` DATETIME NULL DEFAULT NULL,
+    ADD COLUMN `last_seen` DATETIME NULL DEFAULT NULL,
+    ADD INDEX `idx_last_seen` (`last_seen`);
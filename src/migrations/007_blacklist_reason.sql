@@ -0,0 +1,3 @@
+-- Why a host was blacklisted, from abt --blacklist <host> --reason <text>
+ALTER TABLE `discovered_sites_blacklist`
+    ADD COLUMN `reason` VARCHAR(255) NULL DEFAULT NULL;
@@ -0,0 +1,26 @@
+-- One row per prospect, so addSiteToReviewQueue can upsert. Duplicates left by earlier concurrent writes are
+-- merged into the row queued first, which takes their summed score and encounters and the earliest first_seen
+UPDATE `discovered_sites_queue` `kept`
+    JOIN (
+        SELECT `fqdn`,
+            MIN(`pk_prospect_id`) AS `pk_prospect_id`,
+            SUM(`score`) AS `score`,
+            SUM(`encountered`) AS `encountered`,
+            MIN(`first_seen`) AS `first_seen`,
+            MAX(`last_seen`) AS `last_seen`
+        FROM `discovered_sites_queue`
+        GROUP BY `fqdn`
+        HAVING COUNT(*) > 1
+    ) `merged` ON `kept`.`pk_prospect_id` = `merged`.`pk_prospect_id`
+SET `kept`.`score` = `merged`.`score`,
+    `kept`.`encountered` = `merged`.`encountered`,
+    `kept`.`first_seen` = `merged`.`first_seen`,
+    `kept`.`last_seen` = `merged`.`last_seen`;
+
+DELETE `newer`
+FROM `discovered_sites_queue` `newer`
+    JOIN `discovered_sites_queue` `older`
+        ON `newer`.`fqdn` = `older`.`fqdn` AND `newer`.`pk_prospect_id` > `older`.`pk_prospect_id`;
+
+ALTER TABLE `discovered_sites_queue`
+    ADD UNIQUE KEY `uniq_fqdn` (`fqdn`);
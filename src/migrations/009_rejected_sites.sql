@@ -0,0 +1,12 @@
+-- Pages that scored below scoring.minScore, kept when output.recordRejected is set
+CREATE TABLE IF NOT EXISTS `discovered_sites_rejected` (
+    `pk_rejected_id` BIGINT NOT NULL AUTO_INCREMENT,
+    `fqdn` VARCHAR(255) NOT NULL,
+    `url` VARCHAR(2048) NOT NULL,
+    `post_id` BIGINT NULL DEFAULT NULL,
+    `score` INT NOT NULL,
+    `score_detail` JSON NULL DEFAULT NULL,
+    `rejected_at` DATETIME NOT NULL,
+    PRIMARY KEY (`pk_rejected_id`),
+    INDEX `idx_fqdn` (`fqdn`)
+);
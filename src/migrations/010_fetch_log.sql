@@ -0,0 +1,15 @@
+-- Why candidates couldn't be fetched, one row per failed fetch when output.fetchLog is set
+CREATE TABLE IF NOT EXISTS `discovery_fetch_log` (
+    `pk_fetch_log_id` BIGINT NOT NULL AUTO_INCREMENT,
+    `run_at` DATETIME NOT NULL,
+    `fqdn` VARCHAR(255) NOT NULL,
+    `url` VARCHAR(2048) NOT NULL,
+    `post_id` BIGINT NULL DEFAULT NULL,
+    `failure` VARCHAR(32) NOT NULL,
+    `status_code` SMALLINT NULL DEFAULT NULL,
+    `content_type` VARCHAR(255) NULL DEFAULT NULL,
+    `error` TEXT NULL,
+    PRIMARY KEY (`pk_fetch_log_id`),
+    INDEX `idx_run_at` (`run_at`),
+    INDEX `idx_fqdn` (`fqdn`)
+);
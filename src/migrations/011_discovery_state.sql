@@ -0,0 +1,7 @@
+-- Values kept between runs, such as the last post processed when posts.watermark is set
+CREATE TABLE IF NOT EXISTS `discovery_state` (
+    `name` VARCHAR(64) NOT NULL,
+    `value` BIGINT NOT NULL,
+    `updated_at` DATETIME NOT NULL,
+    PRIMARY KEY (`name`)
+);
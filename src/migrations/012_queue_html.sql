@@ -0,0 +1,12 @@
+-- The gzipped HTML each prospect was queued with when output.storeHtml is set, so --rescore can score it again.
+-- Keyed by fqdn rather than the queue's pk_prospect_id, like the queue's own upsert, so a page is stored before
+-- its prospect's id is known and replaced whenever the prospect is queued again. Rows of hosts since removed from
+-- the queue are left behind, and ignored by --rescore, which joins on fqdn
+CREATE TABLE IF NOT EXISTS `discovered_sites_html` (
+    `fqdn` VARCHAR(255) NOT NULL,
+    `url` VARCHAR(2048) NOT NULL,
+    `html` MEDIUMBLOB NOT NULL,
+    `last_modified` DATETIME NULL DEFAULT NULL,
+    `fetched_at` DATETIME NOT NULL,
+    PRIMARY KEY (`fqdn`)
+);
@@ -0,0 +1,14 @@
+-- The ETag and Last-Modified of the last page fetched from each host, with the score it was queued with, so the
+-- next fetch of the page can be conditional when crawler.conditionalRequests is set
+CREATE TABLE IF NOT EXISTS `discovery_validators` (
+    `fqdn` VARCHAR(255) NOT NULL,
+    `url` VARCHAR(2048) NOT NULL,
+    `etag` VARCHAR(255) NULL DEFAULT NULL,
+    `last_modified` DATETIME NULL DEFAULT NULL,
+    `queue_fqdn` VARCHAR(255) NOT NULL,
+    `score` INT NOT NULL,
+    `score_detail` JSON NULL,
+    `feed_url` VARCHAR(2048) NULL DEFAULT NULL,
+    `updated_at` DATETIME NOT NULL,
+    PRIMARY KEY (`fqdn`)
+);
@@ -0,0 +1,34 @@
+-- Prospects queued before hosts were normalized were stored as written, so Example.com and www.example.com could be
+-- two rows. They are brought to the form normalizeHost gives, lowercase without www., merging rows that collide into
+-- the one queued first as 008 does. Unicode hosts can't be converted to punycode here and are left as they are
+UPDATE `discovered_sites_queue` `kept`
+    JOIN (
+        SELECT `normalized`.`host`,
+            MIN(`normalized`.`pk_prospect_id`) AS `pk_prospect_id`,
+            SUM(`normalized`.`score`) AS `score`,
+            SUM(`normalized`.`encountered`) AS `encountered`,
+            MIN(`normalized`.`first_seen`) AS `first_seen`,
+            MAX(`normalized`.`last_seen`) AS `last_seen`
+        FROM (
+            SELECT `pk_prospect_id`, `score`, `encountered`, `first_seen`, `last_seen`,
+                IF(LOWER(`fqdn`) LIKE 'www.%', SUBSTRING(LOWER(`fqdn`), 5), LOWER(`fqdn`)) AS `host`
+            FROM `discovered_sites_queue`
+        ) `normalized`
+        GROUP BY `normalized`.`host`
+        HAVING COUNT(*) > 1
+    ) `merged` ON `kept`.`pk_prospect_id` = `merged`.`pk_prospect_id`
+SET `kept`.`score` = `merged`.`score`,
+    `kept`.`encountered` = `merged`.`encountered`,
+    `kept`.`first_seen` = `merged`.`first_seen`,
+    `kept`.`last_seen` = `merged`.`last_seen`;
+
+DELETE `newer`
+FROM `discovered_sites_queue` `newer`
+    JOIN `discovered_sites_queue` `older`
+        ON IF(LOWER(`newer`.`fqdn`) LIKE 'www.%', SUBSTRING(LOWER(`newer`.`fqdn`), 5), LOWER(`newer`.`fqdn`)) =
+            IF(LOWER(`older`.`fqdn`) LIKE 'www.%', SUBSTRING(LOWER(`older`.`fqdn`), 5), LOWER(`older`.`fqdn`))
+        AND `newer`.`pk_prospect_id` > `older`.`pk_prospect_id`;
+
+UPDATE `discovered_sites_queue`
+SET `fqdn` = IF(LOWER(`fqdn`) LIKE 'www.%', SUBSTRING(LOWER(`fqdn`), 5), LOWER(`fqdn`))
+WHERE BINARY `fqdn` <> BINARY IF(LOWER(`fqdn`) LIKE 'www.%', SUBSTRING(LOWER(`fqdn`), 5), LOWER(`fqdn`));
@@ -0,0 +1,2 @@
+ALTER TABLE `discovered_sites_queue`
+    ADD COLUMN `broken_tls` TINYINT(1) NOT NULL DEFAULT 0;
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Decides whether a candidate host may be fetched, giving the reason when it may not
+type HostPolicy interface {
+	Allowed(ctx context.Context, host string) (bool, string)
+}
+
+// Every policy must allow the host
+type compositeHostPolicy []HostPolicy
+
+func (policies compositeHostPolicy) Allowed(ctx context.Context, host string) (bool, string) {
+	for _, policy := range policies {
+		if allowed, reason := policy.Allowed(ctx, host); !allowed {
+			return false, reason
+		}
+	}
+
+	return true, ""
+}
+
+// Hosts already discovered or rejected, loaded from the discovered_sites_blacklist table once per run
+type blacklistHostPolicy struct {
+	hosts map[string]bool
+}
+
+func (policy blacklistHostPolicy) Allowed(ctx context.Context, host string) (bool, string) {
+	if policy.hosts[normalizeHost(host)] {
+		return false, "in blacklist"
+	}
+
+	return true, ""
+}
+
+// Hosts matched along with their subdomains, so youtube.com also covers www.youtube.com and m.youtube.com but not
+// notyoutube.com
+type hostSuffixes map[string]bool
+
+func newHostSuffixes(hosts []string) hostSuffixes {
+	suffixes := make(hostSuffixes)
+
+	for _, host := range hosts {
+		suffixes.add(host)
+	}
+
+	return suffixes
+}
+
+func (suffixes hostSuffixes) add(host string) {
+	host = normalizeHost(host)
+
+	if host != "" {
+		suffixes[host] = true
+	}
+}
+
+func (suffixes hostSuffixes) matches(host string) bool {
+	host = strings.ToLower(host)
+
+	for {
+		if suffixes[host] {
+			return true
+		}
+
+		dot := strings.Index(host, ".")
+
+		if dot < 0 {
+			return false
+		}
+
+		host = host[dot+1:]
+	}
+}
+
+// Sites never worth discovering, like giant aggregators, from filter.skipHosts. Checked before any other policy
+// so these candidates cost nothing
+type skipHostPolicy struct {
+	hosts hostSuffixes
+}
+
+func (policy skipHostPolicy) Allowed(ctx context.Context, host string) (bool, string) {
+	if policy.hosts.matches(host) {
+		return false, "in skip list"
+	}
+
+	return true, ""
+}
+
+// Hosts listed one per line in a file, blocking the host and its subdomains. Blank lines and # comments are ignored
+type fileHostPolicy struct {
+	path  string
+	hosts hostSuffixes
+}
+
+func loadFileHostPolicy(path string) (fileHostPolicy, error) {
+	policy := fileHostPolicy{
+		path:  path,
+		hosts: make(hostSuffixes),
+	}
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		return policy, err
+	}
+
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		policy.hosts.add(line)
+	}
+
+	return policy, scanner.Err()
+}
+
+func (policy fileHostPolicy) Allowed(ctx context.Context, host string) (bool, string) {
+	if policy.hosts.matches(host) {
+		return false, "listed in " + policy.path
+	}
+
+	return true, ""
+}
+
+// Asks a remote service, called as GET <endpoint>?host=<host> and answering with JSON like
+// {"allowed": false, "reason": "..."}. The service's answers are kept for the run, so a host checked both when it is
+// scheduled and when it is queued is only asked about once. Hosts are allowed when the service can't be reached or
+// gives an answer it can't read, so an outage of an optional service doesn't stop discovery
+type httpHostPolicy struct {
+	endpoint string
+	client   Doer
+	timeout  time.Duration
+
+	mutex     sync.Mutex
+	decisions map[string]hostDecision
+}
+
+type hostDecision struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason"`
+}
+
+func newHttpHostPolicy(endpoint string, client Doer, timeout time.Duration) *httpHostPolicy {
+	return &httpHostPolicy{
+		endpoint:  endpoint,
+		client:    client,
+		timeout:   timeout,
+		decisions: make(map[string]hostDecision),
+	}
+}
+
+func (policy *httpHostPolicy) Allowed(ctx context.Context, host string) (bool, string) {
+	policy.mutex.Lock()
+	decision, ok := policy.decisions[host]
+	policy.mutex.Unlock()
+
+	if ok {
+		return decision.Allowed, decision.Reason
+	}
+
+	decision, err := policy.ask(ctx, host)
+
+	if err != nil {
+		slog.Error("could not check host with host policy service, allowing it", "host", host, "error", err)
+		return true, ""
+	}
+
+	policy.mutex.Lock()
+	policy.decisions[host] = decision
+	policy.mutex.Unlock()
+
+	return decision.Allowed, decision.Reason
+}
+
+func (policy *httpHostPolicy) ask(ctx context.Context, host string) (hostDecision, error) {
+	decision := hostDecision{Allowed: true}
+
+	endpoint, err := url.Parse(policy.endpoint)
+
+	if err != nil {
+		return decision, err
+	}
+
+	query := endpoint.Query()
+	query.Set("host", host)
+	endpoint.RawQuery = query.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, policy.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint.String(), nil)
+
+	if err != nil {
+		return decision, err
+	}
+
+	resp, err := policy.client.Do(req)
+
+	if err != nil {
+		return decision, err
+	}
+
+	defer func(resp *http.Response) {
+		_ = resp.Body.Close()
+	}(resp)
+
+	err = json.NewDecoder(resp.Body).Decode(&decision)
+
+	return decision, err
+}
+
+// Compose the policies named in filter.hostPolicies: "blacklist", "file" and "http", the last asked with the given
+// client and timeout
+func buildHostPolicy(ctx context.Context, filter FilterConfig, store Store, client Doer, timeout time.Duration) (HostPolicy, error) {
+	var policies compositeHostPolicy
+
+	if len(filter.SkipHosts) > 0 {
+		policies = append(policies, skipHostPolicy{hosts: newHostSuffixes(filter.SkipHosts)})
+	}
+
+	for _, name := range filter.HostPolicies {
+		switch name {
+		case "blacklist":
+			hosts, err := store.GetBlacklistedHosts(ctx)
+
+			if err != nil {
+				return nil, fmt.Errorf("could not load blacklist: %w", err)
+			}
+
+			policies = append(policies, blacklistHostPolicy{hosts: hosts})
+		case "file":
+			policy, err := loadFileHostPolicy(filter.BlocklistFile)
+
+			if err != nil {
+				return nil, fmt.Errorf("could not load blocklist file: %w", err)
+			}
+
+			policies = append(policies, policy)
+		case "http":
+			policies = append(policies, newHttpHostPolicy(filter.BlocklistEndpoint, client, timeout))
+		default:
+			return nil, fmt.Errorf("unknown host policy %q", name)
+		}
+	}
+
+	return policies, nil
+}
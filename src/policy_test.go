@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// Write a blocklist file to a temporary directory, returning its path
+func writeBlocklist(t *testing.T, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestBuildHostPolicyFileAndBlacklist(t *testing.T) {
+	blocklist := writeBlocklist(t, "# spam networks\nspam.example\n\n  Link-Farm.example  \n")
+
+	tests := []struct {
+		name        string
+		host        string
+		wantAllowed bool
+		wantReason  string
+	}{
+		{name: "allowed by both", host: "blog.example", wantAllowed: true},
+		{name: "in the blacklist table", host: "www.rejected.example", wantAllowed: false, wantReason: "in blacklist"},
+		{name: "in the file", host: "spam.example", wantAllowed: false, wantReason: "listed in " + blocklist},
+		{name: "subdomain of a file host", host: "feeds.link-farm.example", wantAllowed: false, wantReason: "listed in " + blocklist},
+		{name: "only a suffix of a file host", host: "notspam.example", wantAllowed: true},
+		{name: "in the skip list", host: "m.youtube.com", wantAllowed: false, wantReason: "in skip list"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, mock := newMockDb(t)
+			mock.ExpectQuery("SELECT host FROM discovered_sites_blacklist").
+				WillReturnRows(sqlmock.NewRows([]string{"host"}).AddRow("Rejected.example").AddRow("www.other.example"))
+
+			filter := defaultConfig().Filter
+			filter.SkipHosts = []string{"youtube.com"}
+			filter.HostPolicies = []string{"blacklist", "file"}
+			filter.BlocklistFile = blocklist
+
+			policy, err := buildHostPolicy(context.Background(), filter, mysqlStore{db: db}, nil, time.Second)
+
+			if err != nil {
+				t.Fatalf("buildHostPolicy() error = %v", err)
+			}
+
+			allowed, reason := policy.Allowed(context.Background(), test.host)
+
+			if allowed != test.wantAllowed || reason != test.wantReason {
+				t.Errorf("Allowed(%s) = %v, %q, want %v, %q", test.host, allowed, reason, test.wantAllowed, test.wantReason)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestBuildHostPolicyErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		policies []string
+		queryErr error
+		file     string
+		wantErr  string
+	}{
+		{name: "blacklist query fails", policies: []string{"blacklist"}, queryErr: errors.New("table missing"), wantErr: "could not load blacklist"},
+		{name: "missing file", policies: []string{"file"}, file: filepath.Join(t.TempDir(), "missing.txt"), wantErr: "could not load blocklist file"},
+		{name: "unknown policy", policies: []string{"dns"}, wantErr: `unknown host policy "dns"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, mock := newMockDb(t)
+
+			if test.queryErr != nil {
+				mock.ExpectQuery("SELECT host FROM discovered_sites_blacklist").WillReturnError(test.queryErr)
+			}
+
+			filter := defaultConfig().Filter
+			filter.HostPolicies = test.policies
+			filter.BlocklistFile = test.file
+
+			_, err := buildHostPolicy(context.Background(), filter, mysqlStore{db: db}, nil, time.Second)
+
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("buildHostPolicy() error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestHttpHostPolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("host") {
+		case "spam.example":
+			_ = json.NewEncoder(w).Encode(map[string]any{"allowed": false, "reason": "known spam"})
+		case "broken.example":
+			_, _ = w.Write([]byte("not json"))
+		default:
+			_ = json.NewEncoder(w).Encode(map[string]any{"allowed": true})
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		endpoint    string
+		host        string
+		wantAllowed bool
+		wantReason  string
+	}{
+		{name: "allowed", endpoint: server.URL + "/check", host: "blog.example", wantAllowed: true},
+		{name: "denied", endpoint: server.URL + "/check", host: "spam.example", wantAllowed: false, wantReason: "known spam"},
+		{name: "unreadable answer allows", endpoint: server.URL + "/check", host: "broken.example", wantAllowed: true},
+		{name: "unreachable service allows", endpoint: "http://127.0.0.1:1/check", host: "spam.example", wantAllowed: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy := newHttpHostPolicy(test.endpoint, server.Client(), time.Second)
+
+			allowed, reason := policy.Allowed(context.Background(), test.host)
+
+			if allowed != test.wantAllowed || reason != test.wantReason {
+				t.Errorf("Allowed(%s) = %v, %q, want %v, %q", test.host, allowed, reason, test.wantAllowed, test.wantReason)
+			}
+		})
+	}
+}
+
+func TestHttpHostPolicyRequests(t *testing.T) {
+	tests := []struct {
+		name        string
+		delay       time.Duration
+		cancelled   bool
+		wantAllowed bool
+		wantAsked   int32
+		maxElapsed  time.Duration
+	}{
+		{name: "answer kept for the run", wantAllowed: false, wantAsked: 1, maxElapsed: time.Second},
+		{name: "slow service times out", delay: time.Second, wantAllowed: true, wantAsked: 3, maxElapsed: 750 * time.Millisecond},
+		{name: "cancelled run", delay: time.Second, cancelled: true, wantAllowed: true, wantAsked: 0, maxElapsed: 250 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var asked atomic.Int32
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				asked.Add(1)
+
+				select {
+				case <-time.After(test.delay):
+				case <-r.Context().Done():
+					return
+				}
+
+				_ = json.NewEncoder(w).Encode(map[string]any{"allowed": false, "reason": "known spam"})
+			}))
+			defer server.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			if test.cancelled {
+				cancel()
+			}
+
+			policy := newHttpHostPolicy(server.URL+"/check", server.Client(), 200*time.Millisecond)
+			started := time.Now()
+
+			// Checked as the host is scheduled, as it is queued and again after a redirect
+			for i := 0; i < 3; i++ {
+				if allowed, reason := policy.Allowed(ctx, "spam.example"); allowed != test.wantAllowed {
+					t.Errorf("Allowed() = %v, %q, want %v", allowed, reason, test.wantAllowed)
+				}
+			}
+
+			if elapsed := time.Since(started); elapsed > test.maxElapsed {
+				t.Errorf("three checks took %s, want at most %s", elapsed, test.maxElapsed)
+			}
+
+			if got := asked.Load(); got != test.wantAsked {
+				t.Errorf("service asked %d times, want %d", got, test.wantAsked)
+			}
+		})
+	}
+}
+
+func TestSkipHostPolicy(t *testing.T) {
+	policy := skipHostPolicy{hosts: newHostSuffixes([]string{"youtube.com", "WWW.Reddit.com", " twitter.com. ", "co.uk.example", ""})}
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{host: "youtube.com", want: false},
+		{host: "www.youtube.com", want: false},
+		{host: "m.youtube.com", want: false},
+		{host: "music.m.youtube.com", want: false},
+		{host: "YouTube.COM", want: false},
+		{host: "youtube.com:443", want: false},
+		{host: "youtube.com.", want: false},
+		{host: "notyoutube.com", want: true},
+		{host: "youtube.com.evil.example", want: true},
+		{host: "youtube.co", want: true},
+		{host: "com", want: true},
+		{host: "reddit.com", want: false},
+		{host: "old.reddit.com", want: false},
+		{host: "twitter.com", want: false},
+		{host: "blog.co.uk.example", want: false},
+		{host: "uk.example", want: true},
+		{host: "blog.example", want: true},
+		{host: "", want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.host, func(t *testing.T) {
+			// Hosts are normalised before they're checked, as the discoverer does
+			allowed, reason := policy.Allowed(context.Background(), normalizeHost(test.host))
+
+			if allowed != test.want {
+				t.Errorf("Allowed(%q) = %v, %q, want %v", test.host, allowed, reason, test.want)
+			}
+
+			if !allowed && reason != "in skip list" {
+				t.Errorf("Allowed(%q) reason = %q, want %q", test.host, reason, "in skip list")
+			}
+		})
+	}
+}
+
+func TestRunSkipsHostsWithoutFetching(t *testing.T) {
+	tests := []struct {
+		name      string
+		skipHosts []string
+		want      []string
+	}{
+		{name: "nothing skipped", want: []string{"blog.example", "www.video.example"}},
+		{name: "subdomain of a skipped host", skipHosts: []string{"video.example"}, want: []string{"blog.example"}},
+		{name: "www entry", skipHosts: []string{"www.video.example"}, want: []string{"blog.example"}},
+		{name: "only a suffix of the host", skipHosts: []string{"deo.example"}, want: []string{"blog.example", "www.video.example"}},
+		{name: "every host skipped", skipHosts: []string{"blog.example", "video.example"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mutex sync.Mutex
+			fetched := make(map[string]bool)
+
+			doer := handlerDoer{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mutex.Lock()
+				fetched[r.Host] = true
+				mutex.Unlock()
+
+				w.Header().Set("Content-Type", "text/html")
+				_, _ = w.Write([]byte(`<html><head><title>Anime</title></head><body>anime</body></html>`))
+			})}
+
+			body := `<a href="https://blog.example/">a</a> <a href="https://www.video.example/watch">b</a>`
+			store := &fakeStore{posts: []Post{{Id: 1, Url: "https://aggregator.example/post", Body: body}}}
+
+			config := testDiscovererConfig()
+			config.Filter.SkipHosts = test.skipHosts
+
+			if _, err := NewDiscoverer(config, store, doer).Run(context.Background()); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			var got []string
+
+			for host := range fetched {
+				got = append(got, host)
+			}
+
+			sort.Strings(got)
+
+			if strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("fetched %v, want %v", got, test.want)
+			}
+		})
+	}
+}
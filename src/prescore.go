@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// A cheap estimate of a candidate's relevancy from what we know before fetching it: keywords in its anchor text
+// and URL path, plus how many posts linked to its host this run
+func getPreScore(candidate ExternalUrl, keywords map[string]int, hostFrequency int) int {
+	words := strings.FieldsFunc(
+		strings.ToLower(candidate.AnchorText+" "+candidate.Url.Path),
+		func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+		},
+	)
+
+	score := hostFrequency
+
+	for _, word := range words {
+		score = score + keywords[word]
+	}
+
+	return score
+}
+
+// Order scheduled candidates so the most promising hosts are fetched first. Ties keep their original order
+func orderByPreScore(scheduled []ExternalUrl, candidates []ExternalUrl, keywords map[string]int, filter FilterConfig) {
+	hostFrequency := make(map[string]int)
+
+	for _, candidate := range candidates {
+		hostFrequency[prospectHost(candidate.Url, filter)]++
+	}
+
+	scores := make([]int, len(scheduled))
+
+	for i := range scheduled {
+		scores[i] = getPreScore(scheduled[i], keywords, hostFrequency[prospectHost(scheduled[i].Url, filter)])
+	}
+
+	sort.Stable(preScoreOrder{candidates: scheduled, scores: scores})
+}
+
+type preScoreOrder struct {
+	candidates []ExternalUrl
+	scores     []int
+}
+
+func (o preScoreOrder) Len() int {
+	return len(o.candidates)
+}
+
+func (o preScoreOrder) Less(i, j int) bool {
+	return o.scores[i] > o.scores[j]
+}
+
+func (o preScoreOrder) Swap(i, j int) {
+	o.candidates[i], o.candidates[j] = o.candidates[j], o.candidates[i]
+	o.scores[i], o.scores[j] = o.scores[j], o.scores[i]
+}
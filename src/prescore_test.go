@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestGetPreScore(t *testing.T) {
+	keywords := map[string]int{"anime": 2, "manga": 1}
+
+	tests := []struct {
+		name          string
+		rawUrl        string
+		anchorText    string
+		hostFrequency int
+		want          int
+	}{
+		{name: "nothing known", rawUrl: "https://a.example/", anchorText: "click here", want: 0},
+		{name: "anchor text", rawUrl: "https://a.example/", anchorText: "Anime reviews", want: 2},
+		{name: "url path", rawUrl: "https://a.example/manga-news/", want: 1},
+		{name: "anchor and path", rawUrl: "https://a.example/anime/", anchorText: "manga and anime", want: 5},
+		{name: "linked from several posts", rawUrl: "https://a.example/", hostFrequency: 3, want: 3},
+		{name: "host ignored", rawUrl: "https://anime.example/", want: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parsed, err := url.Parse(test.rawUrl)
+
+			if err != nil {
+				t.Fatalf("could not parse %s: %v", test.rawUrl, err)
+			}
+
+			candidate := ExternalUrl{Link: test.rawUrl, Url: parsed, AnchorText: test.anchorText}
+
+			if got := getPreScore(candidate, keywords, test.hostFrequency); got != test.want {
+				t.Errorf("getPreScore() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRunFetchesInPreScoreOrder(t *testing.T) {
+	var fetched []string
+	var fetchedMutex sync.Mutex
+
+	doer := handlerDoer{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path != "/robots.txt" {
+			fetchedMutex.Lock()
+			fetched = append(fetched, r.Host)
+			fetchedMutex.Unlock()
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<html><head><title>Blog</title></head><body>Hello</body></html>`))
+	})}
+
+	posts := []Post{
+		{Id: 1, Url: "https://aggregator.example/1", Body: `<a href="https://plain.example/">click here</a> <a href="https://manga.example/">manga</a>`},
+		{Id: 2, Url: "https://aggregator.example/2", Body: `<a href="https://anime.example/anime/">anime reviews</a> <a href="https://popular.example/">site</a>`},
+		{Id: 3, Url: "https://aggregator.example/3", Body: `<a href="https://popular.example/about">about</a>`},
+		{Id: 4, Url: "https://aggregator.example/4", Body: `<a href="https://popular.example/archive">archive</a>`},
+	}
+
+	tests := []struct {
+		name     string
+		preScore bool
+		want     []string
+	}{
+		{name: "by pre-score", preScore: true, want: []string{"anime.example", "popular.example", "manga.example", "plain.example"}},
+		{name: "as linked", preScore: false, want: []string{"plain.example", "manga.example", "anime.example", "popular.example"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fetched = nil
+
+			config := testDiscovererConfig()
+			config.Scoring.PreScoreOrder = test.preScore
+			config.Crawler.MaxConcurrency = 1
+
+			if _, err := NewDiscoverer(config, &fakeStore{posts: posts}, doer).Run(context.Background()); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			if strings.Join(fetched, " ") != strings.Join(test.want, " ") {
+				t.Errorf("fetched %v, want %v", fetched, test.want)
+			}
+		})
+	}
+}
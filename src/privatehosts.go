@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"syscall"
+)
+
+var errPrivateHost = errors.New("host is not public")
+
+// Shared address space used by carrier-grade NAT, which net.IP doesn't count as private
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// Whether ip is reachable on the public internet, rather than loopback, link-local (which includes the
+// 169.254.169.254 cloud metadata service), private or unspecified
+func isPublicIp(ip net.IP) bool {
+	return !ip.IsLoopback() &&
+		!ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() &&
+		!ip.IsPrivate() &&
+		!ip.IsUnspecified() &&
+		!sharedAddressSpace.Contains(ip)
+}
+
+// Links in posts are untrusted, so a host that resolves to any internal address is refused rather than letting a
+// post point the crawler at services on our own network. A host that doesn't resolve is refused too, with the
+// lookup's error
+func checkPublicHost(ctx context.Context, host string) error {
+	_, err := publicHostIp(ctx, host)
+
+	return err
+}
+
+// The first address of a host that resolves only to public addresses
+func publicHostIp(ctx context.Context, host string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if !isPublicIp(ip) {
+			return nil, fmt.Errorf("%w: %s", errPrivateHost, host)
+		}
+
+		return ip, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%w: %s has no addresses", errPrivateHost, host)
+	}
+
+	for _, addr := range addrs {
+		if !isPublicIp(addr.IP) {
+			return nil, fmt.Errorf("%w: %s resolves to %s", errPrivateHost, host, addr.IP)
+		}
+	}
+
+	return addrs[0].IP, nil
+}
+
+// A net.Dialer Control that refuses to connect to an internal address. It runs on the address actually dialled, so
+// redirects and DNS answers that change between lookups are covered too. Connections to the configured proxies are
+// let through, as the proxy resolves the host itself
+func publicOnlyControl(proxyHosts []string) func(network string, address string, conn syscall.RawConn) error {
+	return func(network string, address string, conn syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+
+		if err != nil {
+			return err
+		}
+
+		ip := net.ParseIP(host)
+
+		if ip == nil {
+			return fmt.Errorf("%w: %s", errPrivateHost, address)
+		}
+
+		if isPublicIp(ip) || isProxyIp(ip, proxyHosts) {
+			return nil
+		}
+
+		return fmt.Errorf("%w: %s", errPrivateHost, ip)
+	}
+}
+
+// Whether ip is an address of one of the proxies, which are only looked up once a dial would otherwise be refused
+func isProxyIp(ip net.IP, proxyHosts []string) bool {
+	for _, proxyHost := range proxyHosts {
+		proxyIps, err := net.LookupIP(proxyHost)
+
+		if err != nil {
+			continue
+		}
+
+		for _, proxyIp := range proxyIps {
+			if proxyIp.Equal(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// The host names of proxy URLs, which may be given without a scheme
+func proxyHostnames(proxyUrls ...string) []string {
+	var hosts []string
+
+	for _, proxyUrl := range proxyUrls {
+		if proxyUrl == "" {
+			continue
+		}
+
+		parsed, err := url.Parse(proxyUrl)
+
+		if err != nil || parsed.Host == "" {
+			parsed, err = url.Parse("http://" + proxyUrl)
+		}
+
+		if err == nil && parsed.Hostname() != "" {
+			hosts = append(hosts, parsed.Hostname())
+		}
+	}
+
+	return hosts
+}
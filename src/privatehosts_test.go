@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsPublicIp(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "127.0.0.1", want: false},
+		{ip: "::1", want: false},
+		{ip: "169.254.169.254", want: false},
+		{ip: "10.1.2.3", want: false},
+		{ip: "192.168.0.10", want: false},
+		{ip: "100.64.0.1", want: false},
+		{ip: "0.0.0.0", want: false},
+		{ip: "fd00::1", want: false},
+		{ip: "93.184.216.34", want: true},
+		{ip: "2606:4700::1111", want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.ip, func(t *testing.T) {
+			if got := isPublicIp(net.ParseIP(test.ip)); got != test.want {
+				t.Errorf("isPublicIp(%s) = %v, want %v", test.ip, got, test.want)
+			}
+		})
+	}
+}
+
+func TestPublicOnlyControl(t *testing.T) {
+	tests := []struct {
+		name       string
+		address    string
+		proxyHosts []string
+		wantErr    bool
+	}{
+		{name: "localhost", address: "127.0.0.1:80", wantErr: true},
+		{name: "cloud metadata", address: "169.254.169.254:80", wantErr: true},
+		{name: "public host", address: "93.184.216.34:443"},
+		{name: "private proxy", address: "127.0.0.1:3128", proxyHosts: []string{"localhost"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := publicOnlyControl(test.proxyHosts)("tcp4", test.address, nil)
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("control(%s) error = %v, wantErr %v", test.address, err, test.wantErr)
+			}
+
+			if err != nil && !errors.Is(err, errPrivateHost) {
+				t.Errorf("control(%s) error = %v, want errPrivateHost", test.address, err)
+			}
+		})
+	}
+}
+
+func TestCheckPublicHost(t *testing.T) {
+	tests := []struct {
+		host        string
+		wantPrivate bool
+		wantErr     bool
+	}{
+		{host: "localhost", wantPrivate: true, wantErr: true},
+		{host: "169.254.169.254", wantPrivate: true, wantErr: true},
+		{host: "93.184.216.34"},
+		// A lookup failure mustn't let the host through
+		{host: "unresolvable.invalid", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.host, func(t *testing.T) {
+			err := checkPublicHost(context.Background(), test.host)
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("checkPublicHost(%s) error = %v, wantErr %v", test.host, err, test.wantErr)
+			}
+
+			if errors.Is(err, errPrivateHost) != test.wantPrivate {
+				t.Errorf("checkPublicHost(%s) error = %v, want private %v", test.host, err, test.wantPrivate)
+			}
+		})
+	}
+}
+
+func TestCrawlerClientRefusesPrivateHosts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<p>anime</p>"))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name  string
+		link  string
+		allow bool
+		want  string
+	}{
+		{name: "loopback refused", link: server.URL + "/page", want: failurePrivateHost},
+		{name: "loopback allowed when configured", link: server.URL + "/page", allow: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			crawler := testCrawlerConfig()
+			crawler.AllowPrivateHosts = test.allow
+			candidate := testPage(test.link, 1).Url
+
+			page := testDiscoverer(newCrawlerClient(crawler), crawler).fetchExternalPageAttempt(context.Background(), candidate)
+
+			if page.Failure != test.want {
+				t.Errorf("failure = %q (%s), want %q", page.Failure, page.Error, test.want)
+			}
+
+			if page.Unreachable {
+				t.Errorf("private host marked unreachable")
+			}
+		})
+	}
+}
+
+func TestCrawlerTransportDial(t *testing.T) {
+	tests := []struct {
+		name     string
+		proxyUrl string
+		address  string
+	}{
+		{name: "localhost", address: "localhost:80"},
+		{name: "cloud metadata", address: "169.254.169.254:80"},
+		{name: "localhost through socks5", proxyUrl: "socks5://127.0.0.1:1", address: "localhost:80"},
+		{name: "cloud metadata through socks5", proxyUrl: "socks5://127.0.0.1:1", address: "169.254.169.254:80"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			crawler := testCrawlerConfig()
+			crawler.AllowPrivateHosts = false
+			crawler.ProxyUrl = test.proxyUrl
+			transport := newCrawlerTransport(crawler)
+
+			conn, err := transport.DialContext(context.Background(), "tcp", test.address)
+
+			if err == nil {
+				_ = conn.Close()
+			}
+
+			if !errors.Is(err, errPrivateHost) {
+				t.Errorf("dial %s error = %v, want errPrivateHost", test.address, err)
+			}
+		})
+	}
+}
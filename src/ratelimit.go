@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Crawl-delays longer than this are capped, so one host can't stall a run
+const maxCrawlDelay = time.Second * 30
+
+// Hosts not requested for this long are forgotten, so a long running service doesn't keep every host it has ever
+// seen. Their robots.txt is read again if they come back
+const hostRateTtl = time.Hour
+
+// Spaces out the requests made to each host, across every fetch in the process
+type hostRateLimiter struct {
+	mutex       sync.Mutex
+	hosts       map[string]*hostRate
+	lastEvicted time.Time
+}
+
+type hostRate struct {
+	// Earliest time the next request to the host may be sent
+	next time.Time
+	// When the host was last asked for
+	lastUsed time.Time
+	// The host's robots.txt Crawl-delay, kept once a response has been read until crawler.robotsCacheTtlHours
+	// passes. A fetch that fails is tried again by the next request rather than leaving the host without its delay
+	crawlDelay      time.Duration
+	crawlDelayKnown bool
+	crawlDelayRead  time.Time
+	crawlDelayMutex sync.Mutex
+}
+
+func newHostRateLimiter() *hostRateLimiter {
+	return &hostRateLimiter{
+		hosts: make(map[string]*hostRate),
+	}
+}
+
+// Wait until a request to the page's host is allowed: at most crawler.RequestsPerHostPerSecond, slowed further by
+// the host's robots.txt Crawl-delay when crawler.RespectCrawlDelay is set
+func (limiter *hostRateLimiter) wait(ctx context.Context, client Doer, pageUrl *url.URL, crawler CrawlerConfig) error {
+	var interval time.Duration
+
+	if crawler.RequestsPerHostPerSecond > 0 {
+		interval = time.Duration(float64(time.Second) / crawler.RequestsPerHostPerSecond)
+	}
+
+	limiter.mutex.Lock()
+	limiter.evictIdle(time.Now())
+	rate, ok := limiter.hosts[pageUrl.Host]
+
+	if !ok {
+		rate = &hostRate{}
+		limiter.hosts[pageUrl.Host] = rate
+	}
+
+	rate.lastUsed = time.Now()
+	limiter.mutex.Unlock()
+
+	if crawler.RespectCrawlDelay {
+		if crawlDelay := rate.getCrawlDelay(ctx, client, pageUrl, crawler); crawlDelay > interval {
+			interval = crawlDelay
+		}
+	}
+
+	if interval <= 0 {
+		return nil
+	}
+
+	// Reserve the host's next slot, then sleep until it comes round
+	limiter.mutex.Lock()
+	now := time.Now()
+	slot := rate.next
+
+	if slot.Before(now) {
+		slot = now
+	}
+
+	rate.next = slot.Add(interval)
+	limiter.mutex.Unlock()
+
+	delay := time.Until(slot)
+
+	if delay <= 0 {
+		return nil
+	}
+
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Forget the hosts idle for longer than hostRateTtl, checking at most once a minute. Must be called with the mutex
+// held. A host idle that long has no reserved slot left to honour
+func (limiter *hostRateLimiter) evictIdle(now time.Time) {
+	if now.Sub(limiter.lastEvicted) < time.Minute {
+		return
+	}
+
+	limiter.lastEvicted = now
+
+	for host, rate := range limiter.hosts {
+		if now.Sub(rate.lastUsed) > hostRateTtl && now.After(rate.next) {
+			delete(limiter.hosts, host)
+		}
+	}
+}
+
+// The host's Crawl-delay, fetching its robots.txt if no earlier request has read it. Concurrent requests to the
+// host wait for one fetch rather than each making their own
+func (rate *hostRate) getCrawlDelay(ctx context.Context, client Doer, pageUrl *url.URL, crawler CrawlerConfig) time.Duration {
+	rate.crawlDelayMutex.Lock()
+	defer rate.crawlDelayMutex.Unlock()
+
+	if !rate.crawlDelayKnown || robotsExpired(rate.crawlDelayRead, crawler, time.Now()) {
+		rate.crawlDelay, rate.crawlDelayKnown = getCrawlDelay(ctx, client, pageUrl, crawler)
+		rate.crawlDelayRead = time.Now()
+	}
+
+	return rate.crawlDelay
+}
+
+// Read the Crawl-delay robots.txt gives our user agent, or every user agent (User-agent: *) when no group names
+// ours. 0 when there is none. ok is false when robots.txt couldn't be fetched, so the delay isn't known
+func getCrawlDelay(ctx context.Context, client Doer, pageUrl *url.URL, crawler CrawlerConfig) (crawlDelay time.Duration, ok bool) {
+	robotsUrl := url.URL{Scheme: pageUrl.Scheme, Host: pageUrl.Host, Path: "/robots.txt"}
+
+	robotsCtx, cancel := context.WithTimeout(ctx, time.Duration(crawler.Timeout)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(robotsCtx, "GET", robotsUrl.String(), nil)
+
+	if err != nil {
+		return 0, false
+	}
+
+	userAgent := getUserAgent(robotsUrl.String(), crawler)
+	req.Header.Add("User-Agent", userAgent)
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		slog.Debug("could not fetch robots.txt", "host", pageUrl.Host, "error", err)
+		return 0, false
+	}
+
+	defer func(resp *http.Response) {
+		_ = resp.Body.Close()
+	}(resp)
+
+	// A server error says nothing about the rules, so robots.txt is asked for again. A host without one has no delay
+	if resp.StatusCode >= 500 {
+		return 0, false
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, true
+	}
+
+	crawlDelay = parseCrawlDelay(io.LimitReader(resp.Body, 512*1024), userAgent)
+
+	if crawlDelay > maxCrawlDelay {
+		crawlDelay = maxCrawlDelay
+	}
+
+	if crawlDelay > 0 {
+		slog.Debug("host sets a crawl delay", "host", pageUrl.Host, "crawl_delay", crawlDelay)
+	}
+
+	return crawlDelay, true
+}
+
+// A group names our user agent when its User-agent is one of our product tokens, ignoring case, so "Googlebot"
+// names "Mozilla/5.0 (compatible; Googlebot/2.1)" but "bot" doesn't. That group's rules replace the wildcard
+// group's, even if it sets no delay
+func parseCrawlDelay(robots io.Reader, userAgent string) time.Duration {
+	scanner := bufio.NewScanner(robots)
+	products := userAgentProducts(userAgent)
+	inWildcardGroup := false
+	inAgentGroup := false
+	matchedAgent := false
+	// Consecutive User-agent lines share a group
+	readingAgents := false
+
+	var wildcardDelay time.Duration
+	var agentDelay time.Duration
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if comment := strings.Index(line, "#"); comment >= 0 {
+			line = line[:comment]
+		}
+
+		field, value, found := strings.Cut(line, ":")
+
+		if !found {
+			continue
+		}
+
+		field = strings.ToLower(strings.TrimSpace(field))
+		value = strings.TrimSpace(value)
+
+		if field == "user-agent" {
+			if !readingAgents {
+				inWildcardGroup = false
+				inAgentGroup = false
+			}
+
+			readingAgents = true
+			inWildcardGroup = inWildcardGroup || value == "*"
+
+			if products[userAgentProduct(value)] {
+				inAgentGroup = true
+				matchedAgent = true
+			}
+
+			continue
+		}
+
+		readingAgents = false
+
+		if field != "crawl-delay" || (!inWildcardGroup && !inAgentGroup) {
+			continue
+		}
+
+		seconds, err := strconv.ParseFloat(value, 64)
+
+		if err != nil || seconds <= 0 {
+			continue
+		}
+
+		crawlDelay := time.Duration(seconds * float64(time.Second))
+
+		if inAgentGroup && agentDelay == 0 {
+			agentDelay = crawlDelay
+		}
+
+		if inWildcardGroup && wildcardDelay == 0 {
+			wildcardDelay = crawlDelay
+		}
+	}
+
+	if matchedAgent {
+		return agentDelay
+	}
+
+	return wildcardDelay
+}
+
+// The product names in a user agent, lower cased without their versions: "Mozilla/5.0 (compatible; Googlebot/2.1)"
+// has mozilla, compatible and googlebot
+func userAgentProducts(userAgent string) map[string]bool {
+	products := make(map[string]bool)
+
+	for _, field := range strings.FieldsFunc(userAgent, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == ';' || r == ',' || r == '(' || r == ')'
+	}) {
+		if product := userAgentProduct(field); product != "" {
+			products[product] = true
+		}
+	}
+
+	return products
+}
+
+func userAgentProduct(token string) string {
+	product, _, _ := strings.Cut(strings.TrimSpace(token), "/")
+
+	return strings.ToLower(product)
+}
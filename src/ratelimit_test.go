@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseCrawlDelay(t *testing.T) {
+	tests := []struct {
+		name      string
+		robots    string
+		userAgent string
+		want      time.Duration
+	}{
+		{name: "wildcard", robots: "User-agent: *\nCrawl-delay: 2", userAgent: "abt spider", want: 2 * time.Second},
+		{name: "no delay", robots: "User-agent: *\nDisallow: /private", userAgent: "abt spider", want: 0},
+		{name: "other agents only", robots: "User-agent: Bingbot\nCrawl-delay: 5", userAgent: "abt spider", want: 0},
+		{name: "our group wins over wildcard", robots: "User-agent: *\nCrawl-delay: 1\n\nUser-agent: Googlebot\nCrawl-delay: 10", userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1)", want: 10 * time.Second},
+		{name: "our group without a delay replaces wildcard", robots: "User-agent: *\nCrawl-delay: 1\n\nUser-agent: googlebot\nDisallow: /x", userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1)", want: 0},
+		{name: "shared group", robots: "User-agent: Bingbot\nUser-agent: Googlebot\nCrawl-delay: 3", userAgent: "Googlebot/2.1", want: 3 * time.Second},
+		{name: "fractional seconds", robots: "User-agent: *\nCrawl-delay: 0.5", userAgent: "abt spider", want: 500 * time.Millisecond},
+		{name: "short name inside our product", robots: "User-agent: *\nCrawl-delay: 1\n\nUser-agent: bot\nCrawl-delay: 9", userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1)", want: time.Second},
+		{name: "name inside a longer product", robots: "User-agent: spider\nCrawl-delay: 9", userAgent: "Baiduspider", want: 0},
+		{name: "group with a version", robots: "User-agent: Googlebot/2.1\nCrawl-delay: 6", userAgent: "Mozilla/5.0 (compatible; googlebot/2.1)", want: 6 * time.Second},
+		{name: "one of several products", robots: "User-agent: Spider\nCrawl-delay: 7", userAgent: "@bateszi auto-discover spider", want: 7 * time.Second},
+		{name: "comments", robots: "# be nice\nUser-agent: * # everyone\nCrawl-delay: 4 # seconds", userAgent: "abt spider", want: 4 * time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseCrawlDelay(strings.NewReader(test.robots), test.userAgent); got != test.want {
+				t.Errorf("parseCrawlDelay() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHostRateLimiterEvictsIdleHosts(t *testing.T) {
+	crawler := testCrawlerConfig()
+	crawler.RequestsPerHostPerSecond = 1000
+
+	limiter := newHostRateLimiter()
+	client := http.DefaultClient
+
+	for _, host := range []string{"a.example", "b.example"} {
+		err := limiter.wait(context.Background(), client, &url.URL{Scheme: "http", Host: host}, crawler)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		after     time.Duration
+		wantHosts int
+	}{
+		{name: "recently used", after: time.Minute + time.Second, wantHosts: 2},
+		{name: "idle past the ttl", after: hostRateTtl + 2*time.Minute, wantHosts: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter.mutex.Lock()
+			defer limiter.mutex.Unlock()
+
+			limiter.lastEvicted = time.Time{}
+			limiter.evictIdle(time.Now().Add(test.after))
+
+			if len(limiter.hosts) != test.wantHosts {
+				t.Errorf("%d hosts kept, want %d", len(limiter.hosts), test.wantHosts)
+			}
+		})
+	}
+}
+
+func TestHostRateLimiterHonoursCrawlDelay(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("User-agent: *\nCrawl-delay: 5\n\nUser-agent: test-agent\nCrawl-delay: 0.2\n"))
+	}))
+	defer server.Close()
+
+	crawler := testCrawlerConfig()
+	crawler.RespectCrawlDelay = true
+	crawler.UserAgent = "test-agent"
+
+	serverUrl, _ := url.Parse(server.URL)
+	limiter := newHostRateLimiter()
+	started := time.Now()
+
+	for i := 0; i < 3; i++ {
+		err := limiter.wait(context.Background(), server.Client(), serverUrl, crawler)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Two waits of our group's 200ms, not the wildcard's 5 seconds
+	if elapsed := time.Since(started); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("three requests took %s, want about 400ms", elapsed)
+	}
+}
+
+func TestFetchWaitsOutCrawlDelayBeforeTimeout(t *testing.T) {
+	tests := []struct {
+		name       string
+		crawlDelay string
+		paths      []string
+	}{
+		{name: "delay longer than the timeout", crawlDelay: "1.5", paths: []string{"/a"}},
+		{name: "pages queued behind each other", crawlDelay: "1", paths: []string{"/a", "/b"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/robots.txt" {
+					_, _ = w.Write([]byte("User-agent: *\nCrawl-delay: " + test.crawlDelay + "\n"))
+					return
+				}
+
+				w.Header().Set("Content-Type", "text/html")
+				_, _ = w.Write([]byte("<html><head><title>Anime</title></head></html>"))
+			}))
+			defer server.Close()
+
+			// Every request waits at least as long as the timeout for its turn
+			crawler := testCrawlerConfig()
+			crawler.RespectCrawlDelay = true
+			crawler.Timeout = 1
+			crawler.MaxRetries = 0
+
+			var candidates []ExternalUrl
+
+			for _, path := range test.paths {
+				candidates = append(candidates, testPage(server.URL+path, 1).Url)
+			}
+
+			pages := testDiscoverer(server.Client(), crawler).fetchExternalPageBatch(context.Background(), candidates)
+
+			for _, page := range pages {
+				if !page.Fetched {
+					t.Errorf("%s not fetched: %s (%s)", page.Url.Link, page.Failure, page.Error)
+				}
+			}
+		})
+	}
+}
+
+func TestHostRateLimiterRetriesFailedRobots(t *testing.T) {
+	tests := []struct {
+		name         string
+		firstFailure func(w http.ResponseWriter, cancel context.CancelFunc)
+		wantFetches  int32
+	}{
+		{name: "cancelled first fetch", firstFailure: func(w http.ResponseWriter, cancel context.CancelFunc) {
+			cancel()
+			time.Sleep(50 * time.Millisecond)
+		}, wantFetches: 2},
+		{name: "server error", firstFailure: func(w http.ResponseWriter, cancel context.CancelFunc) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}, wantFetches: 2},
+		{name: "no failure", wantFetches: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var fetches atomic.Int32
+			firstCtx, cancelFirst := context.WithCancel(context.Background())
+			defer cancelFirst()
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if fetches.Add(1) == 1 && test.firstFailure != nil {
+					test.firstFailure(w, cancelFirst)
+					return
+				}
+
+				_, _ = w.Write([]byte("User-agent: *\nCrawl-delay: 0.3\n"))
+			}))
+			defer server.Close()
+
+			crawler := testCrawlerConfig()
+			crawler.RespectCrawlDelay = true
+
+			serverUrl, _ := url.Parse(server.URL)
+			limiter := newHostRateLimiter()
+
+			// The first request gives up or is let through without a delay, which isn't remembered
+			_ = limiter.wait(firstCtx, server.Client(), serverUrl, crawler)
+
+			started := time.Now()
+
+			for i := 0; i < 2; i++ {
+				if err := limiter.wait(context.Background(), server.Client(), serverUrl, crawler); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if elapsed := time.Since(started); elapsed < 250*time.Millisecond {
+				t.Errorf("two requests took %s, the crawl delay wasn't honoured", elapsed)
+			}
+
+			if got := fetches.Load(); got != test.wantFetches {
+				t.Errorf("robots.txt fetched %d times, want %d", got, test.wantFetches)
+			}
+		})
+	}
+}
+
+func TestUserAgentProducts(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		want      []string
+	}{
+		{userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1)", want: []string{"compatible", "googlebot", "mozilla"}},
+		{userAgent: "@bateszi auto-discover spider", want: []string{"@bateszi", "auto-discover", "spider"}},
+		{userAgent: "Baiduspider", want: []string{"baiduspider"}},
+		{userAgent: "", want: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.userAgent, func(t *testing.T) {
+			var got []string
+
+			for product := range userAgentProducts(test.userAgent) {
+				got = append(got, product)
+			}
+
+			sort.Strings(got)
+
+			if strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("userAgentProducts(%q) = %v, want %v", test.userAgent, got, test.want)
+			}
+		})
+	}
+}
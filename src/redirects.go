@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var errTooManyRedirects = errors.New("too many redirects")
+
+// The client used for a run, which goes through the configured proxy and follows at most crawler.MaxRedirects
+// redirects. Its transport refuses private hosts unless crawler.AllowPrivateHosts is set
+func newCrawlerClient(crawler CrawlerConfig) *http.Client {
+	return &http.Client{
+		Transport: newCrawlerTransport(crawler),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > crawler.MaxRedirects {
+				return fmt.Errorf("%w: stopped after %d", errTooManyRedirects, crawler.MaxRedirects)
+			}
+
+			return nil
+		},
+	}
+}
+
+// The client for endpoints the operator configures, such as the blocklist service and thumbnail lookup. They often
+// run on localhost or a private network, so unlike the crawler client it may reach private hosts, and it doesn't go
+// through crawler.ProxyUrl
+func newServiceClient() *http.Client {
+	return &http.Client{
+		Transport: http.DefaultTransport.(*http.Transport).Clone(),
+	}
+}
+
+// A transport routed through crawler.ProxyUrl, or the proxy from the environment when none is configured, with the
+// TLS settings of newCrawlerTlsConfig. The proxy URL is checked by validateConfig, so a bad one here falls back to
+// the environment
+func newCrawlerTransport(crawler CrawlerConfig) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = newCrawlerTlsConfig(crawler)
+
+	if !crawler.AllowPrivateHosts {
+		guardPrivateHosts(transport, crawler)
+	}
+
+	if crawler.ProxyUrl == "" {
+		return transport
+	}
+
+	proxyUrl, err := url.Parse(crawler.ProxyUrl)
+
+	if err != nil {
+		slog.Error("invalid proxy url, using the environment's proxy", "error", err)
+		return transport
+	}
+
+	if proxyUrl.Scheme != "socks5" {
+		transport.Proxy = http.ProxyURL(proxyUrl)
+
+		if !crawler.AllowPrivateHosts {
+			transport.Proxy = publicProxiedRequests(transport.Proxy)
+		}
+
+		return transport
+	}
+
+	dialer, err := proxy.FromURL(proxyUrl, proxy.Direct)
+
+	if err != nil {
+		slog.Error("could not create socks5 dialer, using the environment's proxy", "error", err)
+		return transport
+	}
+
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+
+	if !ok {
+		slog.Error("socks5 dialer does not support contexts, using the environment's proxy")
+		return transport
+	}
+
+	transport.Proxy = nil
+	transport.DialContext = contextDialer.DialContext
+
+	// The socks5 proxy would otherwise resolve the host itself, so it's sent the address checked here instead
+	if !crawler.AllowPrivateHosts {
+		transport.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(address)
+
+			if err != nil {
+				return nil, err
+			}
+
+			ip, err := publicHostIp(ctx, host)
+
+			if err != nil {
+				return nil, err
+			}
+
+			return contextDialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		}
+	}
+
+	return transport
+}
+
+// Check every address the transport connects to, and every host it hands to the environment's proxy
+func guardPrivateHosts(transport *http.Transport, crawler CrawlerConfig) {
+	proxyHosts := proxyHostnames(crawler.ProxyUrl)
+
+	if crawler.ProxyUrl == "" {
+		environment := httpproxy.FromEnvironment()
+		proxyHosts = proxyHostnames(environment.HTTPProxy, environment.HTTPSProxy)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   publicOnlyControl(proxyHosts),
+	}
+
+	transport.DialContext = dialer.DialContext
+
+	if transport.Proxy != nil {
+		transport.Proxy = publicProxiedRequests(transport.Proxy)
+	}
+}
+
+// An HTTP proxy resolves the hosts it is sent itself, out of the dialer's sight, so they are checked before the
+// request is handed to it
+func publicProxiedRequests(proxyFor func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		proxyUrl, err := proxyFor(req)
+
+		if err != nil || proxyUrl == nil {
+			return proxyUrl, err
+		}
+
+		err = checkPublicHost(req.Context(), req.URL.Hostname())
+
+		if err != nil {
+			return nil, err
+		}
+
+		return proxyUrl, nil
+	}
+}
+
+// Score and queue a redirected page under the URL it ended up at rather than the link in the post. Redirects from
+// https down to http are allowed but flagged
+func followRedirect(site *ExternalPage, response *http.Response) {
+	finalUrl := response.Request.URL
+
+	if finalUrl.String() == site.Url.Link {
+		return
+	}
+
+	site.RedirectedFrom = site.Url.Link
+	site.InsecureRedirect = site.Url.Url.Scheme == "https" && finalUrl.Scheme == "http"
+
+	if site.InsecureRedirect {
+		slog.Warn("redirected from https to http", "url", site.Url.Link, "final_url", finalUrl.String())
+	}
+
+	site.Url.Link = finalUrl.String()
+	site.Url.Url = finalUrl
+}
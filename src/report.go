@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+// Why a page wasn't fetched
+const (
+	failureCancelled        = "cancelled"
+	failureInvalidRequest   = "invalid request"
+	failureUnreachable      = "unreachable"
+	failureTimeout          = "timeout"
+	failureRequestError     = "request error"
+	failureCertificate      = "certificate"
+	failureHttpStatus       = "http status"
+	failureContentType      = "content type"
+	failureReadError        = "read error"
+	failureTooManyRedirects = "too many redirects"
+	failureTooLarge         = "too large"
+	failureNoResult         = "no result"
+	failurePanic            = "panic"
+	failurePrivateHost      = "private host"
+)
+
+// The failed fetches of a run, counted by failure category and then by host, so systematic problems like a CDN
+// blocking us across many hosts stand out
+type FailureReport struct {
+	RunAt      time.Time                 `json:"runAt"`
+	Failures   int                       `json:"failures"`
+	Categories map[string]map[string]int `json:"categories"`
+}
+
+func buildFailureReport(runAt time.Time, failedPages []ExternalPage) FailureReport {
+	report := FailureReport{
+		RunAt:      runAt,
+		Failures:   len(failedPages),
+		Categories: make(map[string]map[string]int),
+	}
+
+	for _, failedPage := range failedPages {
+		category := failedPage.Failure
+
+		if category == failureHttpStatus {
+			category = fmt.Sprintf("%s %d", category, failedPage.StatusCode)
+		}
+
+		if report.Categories[category] == nil {
+			report.Categories[category] = make(map[string]int)
+		}
+
+		report.Categories[category][failedPage.Url.Url.Host]++
+	}
+
+	return report
+}
+
+func writeFailureReport(dir string, report FailureReport) (string, error) {
+	encodedJson, err := json.MarshalIndent(report, "", "  ")
+
+	if err != nil {
+		return "", err
+	}
+
+	reportPath := filepath.Join(dir, "failures-"+report.RunAt.Format("20060102-150405")+".json")
+
+	return reportPath, ioutil.WriteFile(reportPath, encodedJson, 0644)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// A failed page on host, with the given failure and, for http status failures, status code
+func failedPage(host string, failure string, statusCode int) ExternalPage {
+	page := testPage("https://"+host+"/", 1)
+	page.Failure = failure
+	page.StatusCode = statusCode
+
+	return page
+}
+
+func TestBuildFailureReport(t *testing.T) {
+	runAt := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		failedPages []ExternalPage
+		want        map[string]map[string]int
+	}{
+		{name: "no failures", want: map[string]map[string]int{}},
+		{
+			name: "grouped by category then host",
+			failedPages: []ExternalPage{
+				failedPage("a.example", failureHttpStatus, 403),
+				failedPage("b.example", failureHttpStatus, 403),
+				failedPage("a.example", failureHttpStatus, 403),
+				failedPage("a.example", failureHttpStatus, 500),
+				failedPage("c.example", failureTimeout, 0),
+				failedPage("d.example", failureUnreachable, 0),
+			},
+			want: map[string]map[string]int{
+				"http status 403":  {"a.example": 2, "b.example": 1},
+				"http status 500":  {"a.example": 1},
+				failureTimeout:     {"c.example": 1},
+				failureUnreachable: {"d.example": 1},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			report := buildFailureReport(runAt, test.failedPages)
+
+			if report.Failures != len(test.failedPages) || !report.RunAt.Equal(runAt) {
+				t.Errorf("report counts %d failures at %s, want %d at %s", report.Failures, report.RunAt, len(test.failedPages), runAt)
+			}
+
+			if !reflect.DeepEqual(report.Categories, test.want) {
+				t.Errorf("categories = %v, want %v", report.Categories, test.want)
+			}
+		})
+	}
+}
+
+// Serves the test sites by host, refusing connections to down.example
+type failingSitesDoer struct {
+	sites handlerDoer
+}
+
+func (doer failingSitesDoer) Do(req *http.Request) (*http.Response, error) {
+	if req.URL.Hostname() == "down.example" {
+		return nil, &url.Error{Op: req.Method, URL: req.URL.String(), Err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}
+	}
+
+	return doer.sites.Do(req)
+}
+
+func TestRunWritesFailureReport(t *testing.T) {
+	doer := failingSitesDoer{sites: handlerDoer{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Host {
+		case "blocked.example", "cdn-blocked.example":
+			w.WriteHeader(http.StatusForbidden)
+		case "gone.example":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(`<html><head><title>Anime</title></head><body>anime</body></html>`))
+		}
+	})}}
+
+	post := func(hosts ...string) []Post {
+		body := ""
+
+		for _, host := range hosts {
+			body += `<a href="https://` + host + `/">link</a> `
+		}
+
+		return []Post{{Id: 1, Url: "https://aggregator.example/post", Body: body}}
+	}
+
+	tests := []struct {
+		name      string
+		reportDir bool
+		posts     []Post
+		want      map[string]map[string]int
+	}{
+		{
+			name:      "mixed failures",
+			reportDir: true,
+			posts:     post("blocked.example", "cdn-blocked.example", "gone.example", "down.example", "fine.example"),
+			want: map[string]map[string]int{
+				"http status 403":  {"blocked.example": 1, "cdn-blocked.example": 1},
+				"http status 404":  {"gone.example": 1},
+				failureUnreachable: {"down.example": 1},
+			},
+		},
+		{name: "no failures", reportDir: true, posts: post("fine.example")},
+		{name: "reports off", posts: post("gone.example")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			config := testDiscovererConfig()
+			config.Crawler.MaxRetries = 0
+
+			if test.reportDir {
+				config.Output.FailureReportDir = dir
+			}
+
+			if _, err := NewDiscoverer(config, &fakeStore{posts: test.posts}, doer).Run(context.Background()); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			reports, err := filepath.Glob(filepath.Join(dir, "failures-*.json"))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.want == nil {
+				if len(reports) != 0 {
+					t.Errorf("wrote reports %v, want none", reports)
+				}
+
+				return
+			}
+
+			if len(reports) != 1 {
+				t.Fatalf("wrote reports %v, want one", reports)
+			}
+
+			contents, err := os.ReadFile(reports[0])
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var report FailureReport
+
+			if err := json.Unmarshal(contents, &report); err != nil {
+				t.Fatalf("report %s is not json: %v", contents, err)
+			}
+
+			if report.Failures != 4 || !reflect.DeepEqual(report.Categories, test.want) {
+				t.Errorf("report = %d failures in %v, want 4 in %v", report.Failures, report.Categories, test.want)
+			}
+		})
+	}
+}
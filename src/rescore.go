@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// A queued prospect's page as stored by output.storeHtml, with its current score and feed
+type StoredPage struct {
+	Page    ExternalPage
+	Score   int
+	FeedUrl string
+}
+
+func gzipHtml(page []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+
+	writer := gzip.NewWriter(&compressed)
+
+	_, err := writer.Write(page)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = writer.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return compressed.Bytes(), nil
+}
+
+func gunzipHtml(compressed []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(reader *gzip.Reader) {
+		_ = reader.Close()
+	}(reader)
+
+	return io.ReadAll(reader)
+}
+
+// Score a stored page the way a run would have. Its feed is the one queued with it, as feeds found by probing
+// aren't in the page
+func scoreStoredPage(storedPage StoredPage, scorer Scorer, scoring ScoringConfig) (int, map[string]int, error) {
+	page := storedPage.Page
+	relevancy, scoreDetail, err := scorePage(scorer, page)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	score := getCompositeScore(ScoreComponents{
+		Keywords: relevancy + getUrlKeywordScore(page, scoring),
+		HasFeed:  storedPage.FeedUrl != "" || getRssFeedUrl(page) != "",
+		Fresh:    isFreshPage(page, scoring.FreshnessDays),
+		Articles: getArticleCount(page),
+	}, scoring)
+
+	return score, scoreDetail, nil
+}
+
+// Where rescorePages writes new scores
+type RescoreStore interface {
+	SetRescored(ctx context.Context, host string, score int, scoreDetail map[string]int) error
+}
+
+// Score the stored pages again, printing old and new scores and writing the new ones unless dryRun is set. Returns
+// the number of pages that couldn't be scored or written
+func rescorePages(ctx context.Context, store RescoreStore, storedPages []StoredPage, scorer Scorer, scoring ScoringConfig, dryRun bool) int {
+	failed := 0
+
+	for _, storedPage := range storedPages {
+		host := storedPage.Page.Host
+		score, scoreDetail, err := scoreStoredPage(storedPage, scorer, scoring)
+
+		if err != nil {
+			slog.Error("could not score stored page", "host", host, "error", err)
+			failed++
+			continue
+		}
+
+		fmt.Printf("%s: %d -> %d\n", host, storedPage.Score, score)
+
+		if dryRun {
+			continue
+		}
+
+		err = store.SetRescored(ctx, host, score, scoreDetail)
+
+		if err != nil {
+			slog.Error("could not store new score", "host", host, "score", score, "error", err)
+			failed++
+		}
+	}
+
+	return failed
+}
+
+// --rescore only writes with --replace, and never in a dry run
+func isRescoreDryRun(config AppConfig, options runOptions) bool {
+	return config.Output.DryRun || options.dryRun || !options.replaceScores
+}
+
+// abt --rescore: score every queued prospect with a stored page again under the current keywords and weights.
+// The new scores are only printed unless --replace is given, as they replace scores accumulated over repeat
+// encounters with the score of the stored page alone. Returns the process exit code
+func rescoreCommand(config AppConfig, options runOptions) int {
+	ctx := context.Background()
+	dryRun := isRescoreDryRun(config, options)
+
+	if !options.replaceScores {
+		slog.Info("printing new scores only, pass --replace to overwrite the queue's accumulated scores")
+	}
+
+	keywords, err := loadKeywords(config.Scoring)
+
+	if err != nil {
+		slog.Error("could not load keywords", "error", err)
+		return 1
+	}
+
+	scorer, err := newScorer(keywords, config.Scoring)
+
+	if err != nil {
+		slog.Error("could not create scorer", "error", err)
+		return 1
+	}
+
+	db, err := makeDbConnection(ctx, config)
+
+	if err != nil {
+		slog.Error("could not open db connection", "error", err)
+		return 1
+	}
+
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+
+	store := mysqlStore{db: db, timeout: time.Duration(config.Db.QueryTimeout) * time.Second}
+
+	storedPages, err := store.GetStoredPages(ctx)
+
+	if err != nil {
+		slog.Error("could not read stored pages", "error", err)
+		return 1
+	}
+
+	failed := rescorePages(ctx, store, storedPages, scorer, config.Scoring, dryRun)
+
+	slog.Info("rescored queued prospects", "rescored", len(storedPages)-failed, "failed", failed, "dry_run", dryRun)
+
+	if failed > 0 {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestScoreStoredPage(t *testing.T) {
+	page := testPage("https://blog.example/", 1)
+	page.Html = []byte(`<html><head><title>Anime</title></head><body><p>anime</p></body></html>`)
+
+	tests := []struct {
+		name       string
+		strategy   string
+		wantDetail int
+	}{
+		{name: "keywords", strategy: "keywords", wantDetail: 2},
+		{name: "constant", strategy: "constant", wantDetail: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scoring := defaultConfig().Scoring
+			scoring.Strategy = test.strategy
+
+			scorer, err := newScorer(map[string]int{"anime": 1}, scoring)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, detail, err := scoreStoredPage(StoredPage{Page: page}, scorer, scoring)
+
+			if err != nil {
+				t.Fatalf("scoreStoredPage() error = %v", err)
+			}
+
+			if detail["anime"] != test.wantDetail {
+				t.Errorf("scoreStoredPage() detail = %v, want %d hits", detail, test.wantDetail)
+			}
+		})
+	}
+}
+
+func TestGzipHtml(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+	}{
+		{name: "page", html: "<html><body>anime</body></html>"},
+		{name: "empty", html: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			compressed, err := gzipHtml([]byte(test.html))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := gunzipHtml(compressed)
+
+			if err != nil || string(got) != test.html {
+				t.Errorf("gunzipHtml(gzipHtml(%q)) = %q, %v", test.html, got, err)
+			}
+		})
+	}
+}
+
+type fakeRescoreStore struct {
+	scores map[string]int
+}
+
+func (store *fakeRescoreStore) SetRescored(ctx context.Context, host string, score int, scoreDetail map[string]int) error {
+	store.scores[host] = score
+	return nil
+}
+
+func TestRescorePages(t *testing.T) {
+	page := testPage("https://blog.example/", 1)
+	page.Host = "blog.example"
+	page.Html = []byte(`<html><body><p>anime</p></body></html>`)
+
+	tests := []struct {
+		name        string
+		dryRun      bool
+		replace     bool
+		wantWritten bool
+	}{
+		{name: "printed only by default", wantWritten: false},
+		{name: "replaced with --replace", replace: true, wantWritten: true},
+		{name: "dry run wins over --replace", dryRun: true, replace: true, wantWritten: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := defaultConfig()
+			store := &fakeRescoreStore{scores: make(map[string]int)}
+			scorer, _ := newScorer(map[string]int{"anime": 1}, config.Scoring)
+			dryRun := isRescoreDryRun(config, runOptions{dryRun: test.dryRun, replaceScores: test.replace})
+
+			failed := rescorePages(context.Background(), store, []StoredPage{{Page: page, Score: 40}}, scorer, config.Scoring, dryRun)
+
+			if failed != 0 {
+				t.Fatalf("rescorePages() failed %d pages", failed)
+			}
+
+			if _, written := store.scores["blog.example"]; written != test.wantWritten {
+				t.Errorf("score written = %v, want %v", written, test.wantWritten)
+			}
+		})
+	}
+}
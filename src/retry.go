@@ -0,0 +1,60 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Longest Retry-After we are prepared to wait, so one host can't stall a batch
+const maxRetryAfter = time.Minute
+
+// Whether a failed fetch is worth trying again and how long to wait first. Connection errors, timeouts and 5xx
+// responses are retried with exponential backoff and jitter, 429s after their Retry-After. Other 4xx responses are
+// final
+func getRetryDelay(site ExternalPage, attempt int, crawler CrawlerConfig) (time.Duration, bool) {
+	if site.Fetched || attempt >= crawler.MaxRetries {
+		return 0, false
+	}
+
+	transient := site.Unreachable || site.Failure == failureTimeout ||
+		(site.Failure == failureHttpStatus && (site.StatusCode >= 500 || site.StatusCode == http.StatusTooManyRequests))
+
+	if !transient {
+		return 0, false
+	}
+
+	if site.RetryAfter > 0 {
+		return site.RetryAfter, site.RetryAfter <= maxRetryAfter
+	}
+
+	base := time.Duration(crawler.RetryBackoffMs) * time.Millisecond
+	backoff := base << attempt
+
+	if base > 0 {
+		backoff = backoff + time.Duration(rand.Int63n(int64(base)))
+	}
+
+	return backoff, true
+}
+
+// Retry-After is either a number of seconds or an HTTP date
+func parseRetryAfter(retryAfter string) time.Duration {
+	retryAfter = strings.TrimSpace(retryAfter)
+
+	if retryAfter == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if retryAt, err := http.ParseTime(retryAfter); err == nil && retryAt.After(time.Now()) {
+		return time.Until(retryAt)
+	}
+
+	return 0
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A host's robots.txt Crawl-delay as kept in crawler.robotsCacheFile
+type robotsRecord struct {
+	CrawlDelayMs int64     `json:"crawlDelayMs"`
+	ReadAt       time.Time `json:"readAt"`
+}
+
+// Whether a Crawl-delay read at readAt is too old to use. Without a TTL it is kept for as long as the host is
+func robotsExpired(readAt time.Time, crawler CrawlerConfig, now time.Time) bool {
+	if crawler.RobotsCacheTtlHours <= 0 {
+		return false
+	}
+
+	return now.Sub(readAt) > time.Duration(crawler.RobotsCacheTtlHours)*time.Hour
+}
+
+// Seed the limiter with the unexpired Crawl-delays in crawler.robotsCacheFile. Hosts it already knows keep their own
+func (limiter *hostRateLimiter) loadRobotsCache(crawler CrawlerConfig) error {
+	records, err := readRobotsCache(crawler.RobotsCacheFile)
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	for host, record := range records {
+		if _, ok := limiter.hosts[host]; ok || robotsExpired(record.ReadAt, crawler, now) {
+			continue
+		}
+
+		limiter.hosts[host] = &hostRate{
+			lastUsed:        now,
+			crawlDelay:      time.Duration(record.CrawlDelayMs) * time.Millisecond,
+			crawlDelayKnown: true,
+			crawlDelayRead:  record.ReadAt,
+		}
+	}
+
+	return nil
+}
+
+// Write the limiter's Crawl-delays to crawler.robotsCacheFile, along with the file's unexpired records for hosts
+// the limiter has since forgotten. The file is replaced by a rename, so a crash never leaves it half written
+func (limiter *hostRateLimiter) saveRobotsCache(crawler CrawlerConfig) error {
+	records, err := readRobotsCache(crawler.RobotsCacheFile)
+
+	// An unreadable cache is replaced rather than kept forever
+	if err != nil {
+		records = make(map[string]robotsRecord)
+	}
+
+	limiter.mutex.Lock()
+	rates := make(map[string]*hostRate, len(limiter.hosts))
+
+	for host, rate := range limiter.hosts {
+		rates[host] = rate
+	}
+
+	limiter.mutex.Unlock()
+
+	for host, rate := range rates {
+		rate.crawlDelayMutex.Lock()
+
+		if rate.crawlDelayKnown {
+			records[host] = robotsRecord{CrawlDelayMs: rate.crawlDelay.Milliseconds(), ReadAt: rate.crawlDelayRead}
+		}
+
+		rate.crawlDelayMutex.Unlock()
+	}
+
+	now := time.Now()
+
+	for host, record := range records {
+		if robotsExpired(record.ReadAt, crawler, now) {
+			delete(records, host)
+		}
+	}
+
+	contents, err := json.Marshal(records)
+
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(crawler.RobotsCacheFile), ".robots-cache-*")
+
+	if err != nil {
+		return fmt.Errorf("could not write robots cache: %w", err)
+	}
+
+	defer func() {
+		_ = os.Remove(file.Name())
+	}()
+
+	_, err = file.Write(contents)
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not write robots cache: %w", err)
+	}
+
+	return os.Rename(file.Name(), crawler.RobotsCacheFile)
+}
+
+// The records in a robots cache file, by host. A file that doesn't exist yet is an empty cache
+func readRobotsCache(path string) (map[string]robotsRecord, error) {
+	records := make(map[string]robotsRecord)
+	contents, err := os.ReadFile(path)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return records, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not read robots cache: %w", err)
+	}
+
+	if err := json.Unmarshal(contents, &records); err != nil {
+		return nil, fmt.Errorf("could not parse robots cache %s: %w", path, err)
+	}
+
+	return records, nil
+}
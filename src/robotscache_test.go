@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunReusesCachedRobots(t *testing.T) {
+	var fetches atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			fetches.Add(1)
+			_, _ = w.Write([]byte("User-agent: *\nCrawl-delay: 0.05\n"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = fmt.Fprint(w, `<html><head><title>Anime</title></head><body>anime manga</body></html>`)
+	}))
+	defer server.Close()
+
+	serverUrl, _ := url.Parse(server.URL)
+
+	tests := []struct {
+		name        string
+		noCacheFile bool
+		// Age of the record already in the cache file, none when 0
+		cachedAge   time.Duration
+		runs        int
+		wantFetches int32
+	}{
+		{name: "first run reads robots.txt", runs: 1, wantFetches: 1},
+		{name: "later run reuses it", runs: 2, wantFetches: 1},
+		{name: "unexpired record reused", cachedAge: time.Hour, runs: 2, wantFetches: 0},
+		{name: "expired record read again", cachedAge: 48 * time.Hour, runs: 2, wantFetches: 1},
+		{name: "without a cache file", noCacheFile: true, runs: 2, wantFetches: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fetches.Store(0)
+			path := filepath.Join(t.TempDir(), "robots.json")
+
+			if test.cachedAge > 0 {
+				records := map[string]robotsRecord{serverUrl.Host: {CrawlDelayMs: 50, ReadAt: time.Now().Add(-test.cachedAge)}}
+				contents, _ := json.Marshal(records)
+
+				if err := os.WriteFile(path, contents, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			config := testDiscovererConfig()
+			config.Crawler.RespectCrawlDelay = true
+			config.Crawler.RobotsCacheTtlHours = 24
+
+			if !test.noCacheFile {
+				config.Crawler.RobotsCacheFile = path
+			}
+
+			// A new Discoverer each run, as after a restart, so only the file carries the cache over
+			for i := 0; i < test.runs; i++ {
+				store := &fakeStore{posts: []Post{testPost(int64(i+1), server.URL, "/page")}}
+
+				if _, err := NewDiscoverer(config, store, server.Client()).Run(context.Background()); err != nil {
+					t.Fatalf("Run() error = %v", err)
+				}
+			}
+
+			if got := fetches.Load(); got != test.wantFetches {
+				t.Errorf("robots.txt fetched %d times, want %d", got, test.wantFetches)
+			}
+
+			if test.noCacheFile {
+				return
+			}
+
+			records, err := readRobotsCache(path)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if records[serverUrl.Host].CrawlDelayMs != 50 {
+				t.Errorf("cached records %v, want a 50ms crawl delay for %s", records, serverUrl.Host)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+)
+
+// A relevancy heuristic, chosen by scoring.strategy. Its score stands in for the page's keyword score in
+// getCompositeScore
+type Scorer interface {
+	Score(page ExternalPage) (int, error)
+}
+
+// Scorers that can say which keywords a score came from, kept as the prospect's score_detail
+type detailedScorer interface {
+	Scorer
+	ScoreDetail(page ExternalPage) (int, map[string]int, error)
+}
+
+// The default strategy: weighted keyword hits in the title, description and text, see getRelevancyScore
+type keywordScorer struct {
+	keywords map[string]int
+	scoring  ScoringConfig
+}
+
+func (scorer keywordScorer) Score(page ExternalPage) (int, error) {
+	score, _, err := scorer.ScoreDetail(page)
+
+	return score, err
+}
+
+func (scorer keywordScorer) ScoreDetail(page ExternalPage) (int, map[string]int, error) {
+	relevancy := getRelevancyScore(page, scorer.keywords, scorer.scoring)
+
+	return relevancy.Total, relevancy.Counts, nil
+}
+
+// Scores every page 1, for testing the pipeline independently of page content
+type constantScorer struct{}
+
+func (scorer constantScorer) Score(page ExternalPage) (int, error) {
+	return 1, nil
+}
+
+// Scoring strategies by their scoring.strategy name
+var scoringStrategies = map[string]func(keywords map[string]int, scoring ScoringConfig) Scorer{
+	"keywords": func(keywords map[string]int, scoring ScoringConfig) Scorer {
+		return keywordScorer{keywords: keywords, scoring: scoring}
+	},
+	"constant": func(keywords map[string]int, scoring ScoringConfig) Scorer {
+		return constantScorer{}
+	},
+}
+
+// The scorer of scoring.strategy, keywords when none is set so configs built without defaultConfig still score
+func newScorer(keywords map[string]int, scoring ScoringConfig) (Scorer, error) {
+	name := scoring.Strategy
+
+	if name == "" {
+		name = "keywords"
+	}
+
+	strategy, ok := scoringStrategies[name]
+
+	if !ok {
+		return nil, fmt.Errorf("scoring.strategy %q is not one of keywords or constant", name)
+	}
+
+	return strategy(keywords, scoring), nil
+}
+
+// The page's score and, when the scorer can tell, the keyword hits behind it
+func scorePage(scorer Scorer, page ExternalPage) (int, map[string]int, error) {
+	if detailed, ok := scorer.(detailedScorer); ok {
+		return detailed.ScoreDetail(page)
+	}
+
+	score, err := scorer.Score(page)
+
+	return score, map[string]int{}, err
+}
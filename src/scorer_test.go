@@ -0,0 +1,89 @@
+package main
+
+import "testing"
+
+func TestNewScorer(t *testing.T) {
+	tests := []struct {
+		strategy string
+		want     Scorer
+		wantErr  bool
+	}{
+		{strategy: "", want: keywordScorer{}},
+		{strategy: "keywords", want: keywordScorer{}},
+		{strategy: "constant", want: constantScorer{}},
+		{strategy: "bayesian", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.strategy, func(t *testing.T) {
+			scorer, err := newScorer(map[string]int{"anime": 1}, ScoringConfig{Strategy: test.strategy})
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("newScorer(%q) error = %v, wantErr %v", test.strategy, err, test.wantErr)
+			}
+
+			if test.wantErr {
+				return
+			}
+
+			switch test.want.(type) {
+			case keywordScorer:
+				if _, ok := scorer.(keywordScorer); !ok {
+					t.Errorf("newScorer(%q) = %T, want keywordScorer", test.strategy, scorer)
+				}
+			case constantScorer:
+				if _, ok := scorer.(constantScorer); !ok {
+					t.Errorf("newScorer(%q) = %T, want constantScorer", test.strategy, scorer)
+				}
+			}
+
+			config := defaultConfig()
+			config.Scoring.Strategy = test.strategy
+
+			if err := validateConfig(config); err != nil {
+				t.Errorf("validateConfig() rejected strategy %q that newScorer accepts: %v", test.strategy, err)
+			}
+		})
+	}
+}
+
+func TestScorePage(t *testing.T) {
+	page := testPage("https://blog.example/", 1)
+	page.Html = []byte(`<html><head><title>Anime</title></head><body><p>anime and manga</p></body></html>`)
+
+	tests := []struct {
+		strategy   string
+		wantScore  bool
+		wantDetail map[string]int
+	}{
+		{strategy: "keywords", wantScore: true, wantDetail: map[string]int{"anime": 2}},
+		{strategy: "constant", wantScore: true, wantDetail: map[string]int{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.strategy, func(t *testing.T) {
+			scoring := defaultConfig().Scoring
+			scoring.Strategy = test.strategy
+
+			scorer, err := newScorer(map[string]int{"anime": 1}, scoring)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			score, detail, err := scorePage(scorer, page)
+
+			if err != nil {
+				t.Fatalf("scorePage() error = %v", err)
+			}
+
+			if (score > 0) != test.wantScore {
+				t.Errorf("scorePage() = %d", score)
+			}
+
+			if len(detail) != len(test.wantDetail) || detail["anime"] != test.wantDetail["anime"] {
+				t.Errorf("scorePage() detail = %v, want %v", detail, test.wantDetail)
+			}
+		})
+	}
+}
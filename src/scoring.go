@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"golang.org/x/net/html"
+	"math"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The signals combined into a page's final score
+type ScoreComponents struct {
+	Keywords int
+	HasFeed  bool
+	Fresh    bool
+	Articles int
+}
+
+// Combine the signals into the single score used for queueing:
+//
+//	KeywordWeight * keyword score
+//	+ FeedBonus if the page advertises a feed
+//	+ FreshnessBonus if the page was modified within FreshnessDays
+//	+ ArticleWeight * number of <article> elements
+func getCompositeScore(components ScoreComponents, scoring ScoringConfig) int {
+	score := scoring.KeywordWeight * float64(components.Keywords)
+
+	if components.HasFeed {
+		score = score + float64(scoring.FeedBonus)
+	}
+
+	if components.Fresh {
+		score = score + float64(scoring.FreshnessBonus)
+	}
+
+	score = score + scoring.ArticleWeight*float64(components.Articles)
+
+	return int(math.Round(score))
+}
+
+func isFreshPage(site ExternalPage, freshnessDays int) bool {
+	if site.LastModified.IsZero() || freshnessDays <= 0 {
+		return false
+	}
+
+	return time.Since(site.LastModified) <= time.Duration(freshnessDays)*24*time.Hour
+}
+
+// Sites that publish regularly tend to list several posts as <article> elements
+func getArticleCount(site ExternalPage) int {
+	articles := 0
+
+	tokenizer := html.NewTokenizer(bytes.NewReader(site.Html))
+
+	for {
+		tokenType := tokenizer.Next()
+
+		if tokenType == html.ErrorToken {
+			return articles
+		}
+
+		if tokenType == html.StartTagToken {
+			name, _ := tokenizer.TagName()
+
+			if string(name) == "article" {
+				articles++
+			}
+		}
+	}
+}
+
+// Attributes that load a subresource, which browsers block or warn about when fetched over http from an https page
+var subresourceAttrs = map[string]string{
+	"img":    "src",
+	"script": "src",
+	"iframe": "src",
+	"audio":  "src",
+	"video":  "src",
+	"source": "src",
+	"embed":  "src",
+	"object": "data",
+	"link":   "href",
+}
+
+// Sites serving mixed content tend to be poorly maintained, which is worth flagging to reviewers
+func hasMixedContent(site ExternalPage) bool {
+	if site.Url.Url.Scheme != "https" {
+		return false
+	}
+
+	tokenizer := html.NewTokenizer(bytes.NewReader(site.Html))
+
+	for {
+		tokenType := tokenizer.Next()
+
+		if tokenType == html.ErrorToken {
+			return false
+		}
+
+		if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+			continue
+		}
+
+		token := tokenizer.Token()
+		attrKey, ok := subresourceAttrs[token.Data]
+
+		if !ok {
+			continue
+		}
+
+		// Only stylesheets and icons are loaded by a <link>, alternates and canonicals are just references
+		if token.Data == "link" {
+			rel := strings.ToLower(getAttr(token, "rel"))
+
+			if !strings.Contains(rel, "stylesheet") && !strings.Contains(rel, "icon") {
+				continue
+			}
+		}
+
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(getAttr(token, attrKey))), "http://") {
+			return true
+		}
+	}
+}
+
+// Elements whose text readers never see. The <head> isn't one of them: many pages never close it, and anything in it
+// other than these and the title is shown in the body anyway
+var invisibleElements = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"noscript": true,
+	"template": true,
+	"svg":      true,
+}
+
+// The parts of a page scored separately: its <title>, its meta description and the visible text of its body
+type pageZones struct {
+	Title       string
+	Description string
+	Body        string
+}
+
+func getPageZones(site ExternalPage) pageZones {
+	var zones pageZones
+	var body strings.Builder
+
+	tokenizer := html.NewTokenizer(bytes.NewReader(site.Html))
+	inTitle := false
+	invisibleDepth := 0
+
+	for {
+		tokenType := tokenizer.Next()
+
+		if tokenType == html.ErrorToken {
+			zones.Body = body.String()
+			return zones
+		}
+
+		token := tokenizer.Token()
+
+		// <meta> is a void element, written with or without the closing slash
+		if (tokenType == html.StartTagToken || tokenType == html.SelfClosingTagToken) && token.Data == "meta" &&
+			strings.EqualFold(getAttr(token, "name"), "description") {
+			zones.Description = zones.Description + " " + getAttr(token, "content")
+		}
+
+		switch tokenType {
+		case html.StartTagToken:
+			inTitle = token.Data == "title"
+
+			if invisibleElements[token.Data] {
+				invisibleDepth++
+			}
+		case html.EndTagToken:
+			inTitle = false
+
+			if invisibleElements[token.Data] && invisibleDepth > 0 {
+				invisibleDepth--
+			}
+		case html.TextToken:
+			if inTitle {
+				zones.Title = zones.Title + " " + token.Data
+			} else if invisibleDepth == 0 {
+				body.WriteString(" ")
+				body.WriteString(token.Data)
+			}
+		}
+	}
+}
+
+// A soft 404 is an error page served with a 200: little visible text, and a title or text that reads like an error.
+// Phrases are matched anywhere in the title, but only as whole words in the text, so "404" doesn't match a price or
+// a product number
+func isSoft404(site ExternalPage, filter FilterConfig) bool {
+	if filter.Soft404MaxTextLength <= 0 {
+		return false
+	}
+
+	zones := getPageZones(site)
+	text := strings.Join(strings.Fields(zones.Body), " ")
+
+	if len([]rune(text)) >= filter.Soft404MaxTextLength {
+		return false
+	}
+
+	title := strings.ToLower(zones.Title)
+	textWords := " " + joinWords(text) + " "
+
+	for _, phrase := range filter.Soft404Phrases {
+		phraseWords := joinWords(phrase)
+
+		if phraseWords == "" {
+			continue
+		}
+
+		if strings.Contains(title, strings.ToLower(phrase)) || strings.Contains(textWords, " "+phraseWords+" ") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The lowercased words of text, split on anything that isn't a letter or number and joined by single spaces
+func joinWords(text string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}), " ")
+}
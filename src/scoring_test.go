@@ -0,0 +1,190 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetPageZones(t *testing.T) {
+	tests := []struct {
+		name            string
+		html            string
+		wantTitle       string
+		wantDescription string
+		wantBody        string
+	}{
+		{
+			name:            "closed head",
+			html:            `<html><head><title>Anime</title><meta name="description" content="Reviews"></head><body><p>Episode one</p></body></html>`,
+			wantTitle:       "Anime",
+			wantDescription: "Reviews",
+			wantBody:        "Episode one",
+		},
+		{
+			name:      "head never closed",
+			html:      `<html><head><title>Anime</title><body><p>Episode one</p></body></html>`,
+			wantTitle: "Anime",
+			wantBody:  "Episode one",
+		},
+		{
+			name:     "no head tags",
+			html:     `<title>Anime</title><p>Episode one</p>`,
+			wantBody: "Episode one",
+		},
+		{
+			name:      "scripts and styles in an unclosed head",
+			html:      `<head><title>Anime</title><script>var anime = 1;</script><style>.anime {}</style><p>Episode one</p>`,
+			wantTitle: "Anime",
+			wantBody:  "Episode one",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			zones := getPageZones(ExternalPage{Html: []byte(test.html)})
+
+			if got := strings.TrimSpace(zones.Title); test.wantTitle != "" && got != test.wantTitle {
+				t.Errorf("title = %q, want %q", got, test.wantTitle)
+			}
+
+			if got := strings.TrimSpace(zones.Description); got != test.wantDescription {
+				t.Errorf("description = %q, want %q", got, test.wantDescription)
+			}
+
+			if got := strings.Join(strings.Fields(zones.Body), " "); got != test.wantBody {
+				t.Errorf("body = %q, want %q", got, test.wantBody)
+			}
+		})
+	}
+}
+
+func TestHasMixedContent(t *testing.T) {
+	tests := []struct {
+		name   string
+		scheme string
+		html   string
+		want   bool
+	}{
+		{name: "http image on https", scheme: "https", html: `<img src="http://cdn.example/a.png">`, want: true},
+		{name: "http script on https", scheme: "https", html: `<script src=" HTTP://cdn.example/a.js"></script>`, want: true},
+		{name: "http stylesheet on https", scheme: "https", html: `<link rel="stylesheet" href="http://cdn.example/a.css"/>`, want: true},
+		{name: "https resources", scheme: "https", html: `<img src="https://cdn.example/a.png"><script src="/a.js"></script>`},
+		{name: "http link is only a reference", scheme: "https", html: `<a href="http://example.com">x</a><link rel="canonical" href="http://example.com">`},
+		{name: "http page", scheme: "http", html: `<img src="http://cdn.example/a.png">`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			page := testPage(test.scheme+"://blog.example/post", 1)
+			page.Html = []byte(test.html)
+
+			if got := hasMixedContent(page); got != test.want {
+				t.Errorf("hasMixedContent() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIsSoft404(t *testing.T) {
+	filter := defaultConfig().Filter
+	longText := strings.Repeat("Episode reviews and season guides. ", 40)
+
+	tests := []struct {
+		name string
+		html string
+		want bool
+	}{
+		{name: "404 in the title", html: `<title>404 - Example</title><p>Sorry.</p>`, want: true},
+		{name: "not found in the text", html: `<title>Example</title><p>Page not found.</p>`, want: true},
+		{name: "404 token in the text", html: `<title>Example</title><h1>Error 404</h1>`, want: true},
+		{name: "configured phrase with an apostrophe", html: `<title>Oops</title><p>This page doesn't exist!</p>`, want: true},
+		{name: "404 inside a number", html: `<title>Figures</title><p>Order 14042 for $40404 shipped.</p>`},
+		{name: "404 inside a word", html: `<title>Shop</title><p>See item abc404def.</p>`},
+		{name: "short page without error phrases", html: `<title>Anime</title><p>Short review.</p>`},
+		{name: "long page mentioning not found", html: `<title>Anime</title><p>` + longText + ` Some episodes are not found on streaming sites.</p>`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isSoft404(ExternalPage{Html: []byte(test.html)}, filter); got != test.want {
+				t.Errorf("isSoft404() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetCompositeScore(t *testing.T) {
+	weighted := ScoringConfig{KeywordWeight: 1.5, FeedBonus: 10, FreshnessBonus: 5, ArticleWeight: 0.5}
+
+	tests := []struct {
+		name       string
+		components ScoreComponents
+		scoring    ScoringConfig
+		want       int
+	}{
+		{name: "keywords only by default", components: ScoreComponents{Keywords: 7, HasFeed: true, Fresh: true, Articles: 4}, scoring: defaultConfig().Scoring, want: 7},
+		{name: "every component", components: ScoreComponents{Keywords: 4, HasFeed: true, Fresh: true, Articles: 3}, scoring: weighted, want: 23},
+		{name: "no feed", components: ScoreComponents{Keywords: 4, Fresh: true, Articles: 3}, scoring: weighted, want: 13},
+		{name: "stale", components: ScoreComponents{Keywords: 4, HasFeed: true, Articles: 3}, scoring: weighted, want: 18},
+		{name: "no articles", components: ScoreComponents{Keywords: 4, HasFeed: true, Fresh: true}, scoring: weighted, want: 21},
+		{name: "rounded", components: ScoreComponents{Keywords: 3}, scoring: weighted, want: 5},
+		{name: "nothing", scoring: weighted, want: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := getCompositeScore(test.components, test.scoring); got != test.want {
+				t.Errorf("getCompositeScore(%+v) = %d, want %d", test.components, got, test.want)
+			}
+		})
+	}
+}
+
+func TestIsFreshPage(t *testing.T) {
+	tests := []struct {
+		name          string
+		lastModified  time.Time
+		freshnessDays int
+		want          bool
+	}{
+		{name: "modified yesterday", lastModified: time.Now().Add(-24 * time.Hour), freshnessDays: 30, want: true},
+		{name: "modified long ago", lastModified: time.Now().Add(-60 * 24 * time.Hour), freshnessDays: 30, want: false},
+		{name: "unknown", freshnessDays: 30, want: false},
+		{name: "freshness off", lastModified: time.Now(), freshnessDays: 0, want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			page := testPage("https://blog.example/", 1)
+			page.LastModified = test.lastModified
+
+			if got := isFreshPage(page, test.freshnessDays); got != test.want {
+				t.Errorf("isFreshPage() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetArticleCount(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want int
+	}{
+		{name: "articles", html: `<main><article><p>one</p></article><article>two</article><article>three</article></main>`, want: 3},
+		{name: "nested", html: `<article><article>inner</article></article>`, want: 2},
+		{name: "none", html: `<div class="article">not one</div>`, want: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			page := testPage("https://blog.example/", 1)
+			page.Html = []byte(test.html)
+
+			if got := getArticleCount(page); got != test.want {
+				t.Errorf("getArticleCount() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"sort"
+)
+
+// What --url found out about a page, printed as JSON with --json
+type singleUrlReport struct {
+	Url              string `json:"url"`
+	Host             string `json:"host,omitempty"`
+	Status           int    `json:"status,omitempty"`
+	Title            string `json:"title,omitempty"`
+	Score            int    `json:"score"`
+	Relevancy        int    `json:"relevancy"`
+	TitleScore       int    `json:"titleScore"`
+	DescriptionScore int    `json:"descriptionScore"`
+	BodyScore        int    `json:"bodyScore"`
+	UrlScore         int    `json:"urlScore"`
+	// Hits of each keyword that matched
+	Breakdown    map[string]int `json:"breakdown"`
+	FeedUrls     []string       `json:"feeds"`
+	CanonicalUrl string         `json:"canonical,omitempty"`
+	// As declared by the page's lang attribute
+	Language string `json:"language,omitempty"`
+}
+
+// Printed by --url --json instead of a report when the page couldn't be fetched or scored
+type singleUrlError struct {
+	Url     string `json:"url"`
+	Status  int    `json:"status,omitempty"`
+	Failure string `json:"failure,omitempty"`
+	Error   string `json:"error"`
+}
+
+// abt --url <url>: fetch and score a single page without reading posts or writing to the queue, for debugging
+// relevancy and feed detection. With asJson the report is a single JSON object, for scripting. Returns the process
+// exit code
+func processSingleUrl(ctx context.Context, config AppConfig, rawUrl string, asJson bool) int {
+	report, failed := scoreSingleUrl(ctx, config, rawUrl)
+
+	if !asJson {
+		if failed != nil {
+			return 1
+		}
+
+		printSingleUrlReport(report)
+		return 0
+	}
+
+	var output interface{} = report
+
+	if failed != nil {
+		output = failed
+	}
+
+	err := json.NewEncoder(os.Stdout).Encode(output)
+
+	if err != nil {
+		slog.Error("could not write report", "error", err)
+		return 1
+	}
+
+	if failed != nil {
+		return 1
+	}
+
+	return 0
+}
+
+// Fetch and score the page, or describe why it couldn't be
+func scoreSingleUrl(ctx context.Context, config AppConfig, rawUrl string) (singleUrlReport, *singleUrlError) {
+	report := singleUrlReport{Url: rawUrl}
+	failed := &singleUrlError{Url: rawUrl}
+
+	parsedUrl, err := url.Parse(rawUrl)
+
+	if err != nil || parsedUrl.Host == "" || (parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https") {
+		slog.Error("not an absolute http(s) url", "url", rawUrl)
+		failed.Failure = failureInvalidRequest
+		failed.Error = "not an absolute http(s) url"
+		return report, failed
+	}
+
+	keywords, err := loadKeywords(config.Scoring)
+
+	if err != nil {
+		slog.Error("could not load keywords", "error", err)
+		failed.Error = err.Error()
+		return report, failed
+	}
+
+	scorer, err := newScorer(keywords, config.Scoring)
+
+	if err != nil {
+		slog.Error("could not create scorer", "error", err)
+		failed.Error = err.Error()
+		return report, failed
+	}
+
+	candidate := ExternalUrl{
+		Link: parsedUrl.String(),
+		Url:  parsedUrl,
+	}
+
+	discoverer := NewDiscoverer(config, nil, newCrawlerClient(config.Crawler))
+	fetchedPages, failedPages, err := discoverer.fetchExternalPages(ctx, []ExternalUrl{candidate})
+
+	if err != nil {
+		slog.Error("there was an error fetching the page", "url", rawUrl, "error", err)
+	}
+
+	if len(fetchedPages) == 0 {
+		failed.Error = "could not fetch page"
+
+		for _, failedPage := range failedPages {
+			slog.Error("could not fetch page", "url", failedPage.Url.Link, "failure", failedPage.Failure, "status", failedPage.StatusCode, "error", failedPage.Error)
+			failed.Status = failedPage.StatusCode
+			failed.Failure = failedPage.Failure
+
+			if failedPage.Error != "" {
+				failed.Error = failedPage.Error
+			}
+		}
+
+		return report, failed
+	}
+
+	page := fetchedPages[0]
+	page.Host = prospectHost(queueUrl(page), config.Filter)
+
+	canonicalUrl := getCanonicalUrl(page)
+
+	if canonicalUrl != "" {
+		parsedCanonicalUrl, _ := url.Parse(canonicalUrl)
+		page.Host = prospectHost(parsedCanonicalUrl, config.Filter)
+	}
+
+	relevancy, scoreDetail, err := scorePage(scorer, page)
+
+	if err != nil {
+		slog.Error("could not score page", "url", page.Url.Link, "error", err)
+		failed.Error = err.Error()
+		return report, failed
+	}
+
+	urlScore := getUrlKeywordScore(page, config.Scoring)
+	feedUrls := getFeedUrls(page)
+
+	if len(feedUrls) == 0 && config.Crawler.ProbeFeedPaths {
+		if probedUrl := discoverer.probeFeedUrl(ctx, page); probedUrl != "" {
+			feedUrls = append(feedUrls, probedUrl)
+		}
+	}
+
+	report.Url = page.Url.Link
+	report.Host = page.queueHost()
+	report.Status = page.StatusCode
+	report.Title = getPageTitle(page)
+	report.Relevancy = relevancy
+	report.UrlScore = urlScore
+	report.Breakdown = make(map[string]int)
+	report.FeedUrls = feedUrls
+	report.CanonicalUrl = canonicalUrl
+	report.Language = getPageLanguage(page)
+
+	report.Score = getCompositeScore(ScoreComponents{
+		Keywords: relevancy + urlScore,
+		HasFeed:  len(feedUrls) > 0,
+		Fresh:    isFreshPage(page, config.Scoring.FreshnessDays),
+		Articles: getArticleCount(page),
+	}, config.Scoring)
+
+	for keyword, count := range scoreDetail {
+		if count > 0 {
+			report.Breakdown[keyword] = count
+		}
+	}
+
+	// Only the keywords strategy scores the title, description and text separately
+	if keywordScorer, ok := scorer.(keywordScorer); ok {
+		parts := getRelevancyScore(page, keywordScorer.keywords, keywordScorer.scoring)
+		report.TitleScore = parts.Title
+		report.DescriptionScore = parts.Description
+		report.BodyScore = parts.Body
+	}
+
+	if report.FeedUrls == nil {
+		report.FeedUrls = []string{}
+	}
+
+	return report, nil
+}
+
+func printSingleUrlReport(report singleUrlReport) {
+	fmt.Printf("url:         %s\n", report.Url)
+	fmt.Printf("host:        %s\n", report.Host)
+	fmt.Printf("title:       %s\n", report.Title)
+	fmt.Printf("score:       %d\n", report.Score)
+	fmt.Printf("relevancy:   %d\n", report.Relevancy)
+	fmt.Printf("  title:       %d\n", report.TitleScore)
+	fmt.Printf("  description: %d\n", report.DescriptionScore)
+	fmt.Printf("  body:        %d\n", report.BodyScore)
+	fmt.Printf("  url:         %d\n", report.UrlScore)
+
+	var matched []string
+
+	for keyword := range report.Breakdown {
+		matched = append(matched, keyword)
+	}
+
+	sort.Strings(matched)
+
+	for _, keyword := range matched {
+		fmt.Printf("  %q: %d\n", keyword, report.Breakdown[keyword])
+	}
+
+	if len(report.FeedUrls) == 0 {
+		fmt.Println("feeds:       none")
+	}
+
+	for _, feedUrl := range report.FeedUrls {
+		fmt.Printf("feed:        %s\n", feedUrl)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestScoreSingleUrl(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<html><head><title>Anime blog</title><link rel="alternate" type="application/rss+xml" href="/feed"></head><body>anime anime</body></html>`))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name          string
+		link          string
+		strategy      string
+		wantFailed    bool
+		wantRelevancy int
+		wantBody      int
+	}{
+		{name: "keywords", link: server.URL + "/", strategy: "keywords", wantRelevancy: 1*defaultConfig().Scoring.TitleMultiplier + 2, wantBody: 2},
+		{name: "constant", link: server.URL + "/", strategy: "constant", wantRelevancy: 1, wantBody: 0},
+		{name: "not found", link: server.URL + "/gone", strategy: "keywords", wantFailed: true},
+		{name: "not a url", link: "anime", strategy: "keywords", wantFailed: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testDiscovererConfig()
+			config.Scoring.Keywords = KeywordWeights{"anime": 1}
+			config.Scoring.Strategy = test.strategy
+
+			report, failed := scoreSingleUrl(context.Background(), config, test.link)
+
+			if (failed != nil) != test.wantFailed {
+				t.Fatalf("scoreSingleUrl() failed = %+v, want failed %v", failed, test.wantFailed)
+			}
+
+			if test.wantFailed {
+				return
+			}
+
+			if report.Relevancy != test.wantRelevancy || report.BodyScore != test.wantBody {
+				t.Errorf("relevancy = %d, body = %d, want %d, %d", report.Relevancy, report.BodyScore, test.wantRelevancy, test.wantBody)
+			}
+
+			if len(report.FeedUrls) != 1 {
+				t.Errorf("feeds = %v, want the linked feed", report.FeedUrls)
+			}
+		})
+	}
+}
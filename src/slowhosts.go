@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Hosts not fetched for this long are forgotten, strikes and all. A host skipped for being slow isn't fetched, so
+// this is also the cool-down after which it gets another chance
+const slowHostTtl = 12 * time.Hour
+
+type hostTiming struct {
+	Last    time.Duration
+	Average time.Duration
+	Samples int
+	// Consecutive fetches slower than the threshold
+	SlowStrikes int
+	// When the host was last fetched
+	lastFetched time.Time
+}
+
+// Remembers how quickly each host responds, so hosts that are consistently slow can be skipped on later runs
+// rather than dragging every run out to the timeout
+type slowHostTracker struct {
+	mutex       sync.Mutex
+	hosts       map[string]*hostTiming
+	lastEvicted time.Time
+}
+
+func newSlowHostTracker() *slowHostTracker {
+	return &slowHostTracker{
+		hosts: make(map[string]*hostTiming),
+	}
+}
+
+func (tracker *slowHostTracker) record(host string, elapsed time.Duration, threshold time.Duration) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.evictStale(time.Now())
+	timing, ok := tracker.hosts[host]
+
+	if !ok {
+		timing = &hostTiming{}
+		tracker.hosts[host] = timing
+	}
+
+	timing.lastFetched = time.Now()
+	timing.Last = elapsed
+	timing.Average = (timing.Average*time.Duration(timing.Samples) + elapsed) / time.Duration(timing.Samples+1)
+	timing.Samples++
+
+	if elapsed >= threshold {
+		timing.SlowStrikes++
+	} else {
+		timing.SlowStrikes = 0
+	}
+}
+
+func (tracker *slowHostTracker) isTooSlow(host string, maxStrikes int) (bool, hostTiming) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.evictStale(time.Now())
+	timing, ok := tracker.hosts[host]
+
+	if !ok {
+		return false, hostTiming{}
+	}
+
+	return timing.SlowStrikes >= maxStrikes, *timing
+}
+
+// Forget the hosts not fetched for longer than slowHostTtl, checking at most once a minute. Must be called with the
+// mutex held
+func (tracker *slowHostTracker) evictStale(now time.Time) {
+	if now.Sub(tracker.lastEvicted) < time.Minute {
+		return
+	}
+
+	tracker.lastEvicted = now
+
+	for host, timing := range tracker.hosts {
+		if now.Sub(timing.lastFetched) > slowHostTtl {
+			delete(tracker.hosts, host)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSlowHostTracker(t *testing.T) {
+	threshold := 100 * time.Millisecond
+
+	tests := []struct {
+		name        string
+		elapsed     []time.Duration
+		wantTooSlow bool
+		wantAverage time.Duration
+	}{
+		{name: "never seen", wantTooSlow: false},
+		{name: "fast", elapsed: []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond}, wantTooSlow: false, wantAverage: 20 * time.Millisecond},
+		{name: "slow once", elapsed: []time.Duration{150 * time.Millisecond}, wantTooSlow: false, wantAverage: 150 * time.Millisecond},
+		{name: "slow on every fetch", elapsed: []time.Duration{100 * time.Millisecond, 120 * time.Millisecond, 140 * time.Millisecond}, wantTooSlow: true, wantAverage: 120 * time.Millisecond},
+		{name: "a fast fetch resets the strikes", elapsed: []time.Duration{150 * time.Millisecond, 150 * time.Millisecond, 30 * time.Millisecond, 150 * time.Millisecond}, wantTooSlow: false, wantAverage: 120 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := newSlowHostTracker()
+
+			for _, elapsed := range test.elapsed {
+				tracker.record("slow.example", elapsed, threshold)
+			}
+
+			tooSlow, timing := tracker.isTooSlow("slow.example", 3)
+
+			if tooSlow != test.wantTooSlow {
+				t.Errorf("isTooSlow() = %v with %d strikes, want %v", tooSlow, timing.SlowStrikes, test.wantTooSlow)
+			}
+
+			if timing.Average != test.wantAverage || timing.Samples != len(test.elapsed) {
+				t.Errorf("average %s over %d samples, want %s over %d", timing.Average, timing.Samples, test.wantAverage, len(test.elapsed))
+			}
+
+			if other, _ := tracker.isTooSlow("other.example", 3); other {
+				t.Errorf("isTooSlow() = true for a host never fetched")
+			}
+		})
+	}
+}
+
+func TestRunSkipsSlowHosts(t *testing.T) {
+	tests := []struct {
+		name         string
+		delay        time.Duration
+		wantRequests []int32
+	}{
+		{name: "just under the timeout", delay: 150 * time.Millisecond, wantRequests: []int32{1, 2, 2, 2}},
+		{name: "fast", delay: 0, wantRequests: []int32{1, 2, 3, 4}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var requests atomic.Int32
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet && r.URL.Path == "/a" {
+					requests.Add(1)
+				}
+
+				time.Sleep(test.delay)
+				w.Header().Set("Content-Type", "text/html")
+				_, _ = fmt.Fprint(w, `<html><head><title>Anime</title></head><body>anime</body></html>`)
+			}))
+			defer server.Close()
+
+			config := testDiscovererConfig()
+			config.Crawler.Timeout = 1
+			config.Crawler.SlowResponseMs = 100
+			config.Crawler.SlowResponseStrikes = 2
+
+			discoverer := NewDiscoverer(config, &fakeStore{posts: []Post{testPost(1, server.URL, "/a")}}, server.Client())
+
+			for run, want := range test.wantRequests {
+				if _, err := discoverer.Run(context.Background()); err != nil {
+					t.Fatalf("Run() error = %v", err)
+				}
+
+				if got := requests.Load(); got != want {
+					t.Errorf("after run %d the host was fetched %d times, want %d", run+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSlowHostTrackerForgetsStaleHosts(t *testing.T) {
+	threshold := 100 * time.Millisecond
+
+	tests := []struct {
+		name        string
+		after       time.Duration
+		wantTooSlow bool
+	}{
+		{name: "still cooling down", after: time.Hour, wantTooSlow: true},
+		{name: "just inside the ttl", after: slowHostTtl - time.Minute, wantTooSlow: true},
+		{name: "past the ttl", after: slowHostTtl + 2*time.Minute, wantTooSlow: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := newSlowHostTracker()
+
+			for i := 0; i < 3; i++ {
+				tracker.record("slow.example", 150*time.Millisecond, threshold)
+			}
+
+			tracker.record("fast.example", 10*time.Millisecond, threshold)
+
+			tracker.mutex.Lock()
+			tracker.lastEvicted = time.Time{}
+			tracker.evictStale(time.Now().Add(test.after))
+			tracker.mutex.Unlock()
+
+			if tooSlow, timing := tracker.isTooSlow("slow.example", 3); tooSlow != test.wantTooSlow {
+				t.Errorf("isTooSlow() = %v with %d strikes, want %v", tooSlow, timing.SlowStrikes, test.wantTooSlow)
+			}
+
+			wantHosts := 2
+
+			if !test.wantTooSlow {
+				wantHosts = 0
+			}
+
+			if len(tracker.hosts) != wantHosts {
+				t.Errorf("%d hosts kept, want %d", len(tracker.hosts), wantHosts)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+)
+
+// A light English stemmer that folds plurals and possessives onto their base word, so "animes" and "anime's"
+// both become "anime". It deliberately leaves other suffixes alone, trading recall for fewer false matches
+func stemWord(word string) string {
+	word = trimPunctuation(word)
+
+	for _, possessive := range []string{"'s", "’s"} {
+		word = strings.TrimSuffix(word, possessive)
+	}
+
+	switch {
+	case len(word) > 4 && strings.HasSuffix(word, "ies") && !strings.HasSuffix(word, "eies") && !strings.HasSuffix(word, "aies"):
+		return word[:len(word)-3] + "y"
+	case len(word) > 3 && strings.HasSuffix(word, "es") && !strings.HasSuffix(word, "aes") && !strings.HasSuffix(word, "ees") && !strings.HasSuffix(word, "oes"):
+		if strings.HasSuffix(word, "ses") || strings.HasSuffix(word, "xes") || strings.HasSuffix(word, "zes") ||
+			strings.HasSuffix(word, "ches") || strings.HasSuffix(word, "shes") {
+			return word[:len(word)-2]
+		}
+
+		return word[:len(word)-1]
+	case len(word) > 2 && strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss") &&
+		!strings.HasSuffix(word, "us") && !strings.HasSuffix(word, "is"):
+		return word[:len(word)-1]
+	}
+
+	return word
+}
+
+// Keywords grouped by how scanned words are compared with them: exactly, or by stem when stemming is enabled and
+// the keyword hasn't opted out
+type keywordMatcher struct {
+	exact   map[string]bool
+	stemmed map[string][]string
+}
+
+func newKeywordMatcher(keywords map[string]int, scoring ScoringConfig) keywordMatcher {
+	matcher := keywordMatcher{
+		exact:   make(map[string]bool),
+		stemmed: make(map[string][]string),
+	}
+
+	exactKeywords := make(map[string]bool)
+
+	for _, keyword := range scoring.ExactKeywords {
+		exactKeywords[strings.ToLower(keyword)] = true
+	}
+
+	for keyword := range keywords {
+		if scoring.Stemming && !exactKeywords[keyword] {
+			stem := stemWord(keyword)
+			matcher.stemmed[stem] = append(matcher.stemmed[stem], keyword)
+		} else {
+			matcher.exact[keyword] = true
+		}
+	}
+
+	return matcher
+}
+
+// The keywords a lowercased scanned word counts towards
+func (matcher keywordMatcher) match(word string) []string {
+	var matched []string
+
+	if matcher.exact[word] {
+		matched = append(matched, word)
+	}
+
+	if len(matcher.stemmed) > 0 {
+		matched = append(matched, matcher.stemmed[stemWord(word)]...)
+	}
+
+	return matched
+}
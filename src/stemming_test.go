@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestGetRelevancyScoreStemming(t *testing.T) {
+	keywords := map[string]int{"anime": 2, "light novel": 3}
+
+	tests := []struct {
+		name          string
+		html          string
+		stemming      bool
+		exactKeywords []string
+		want          int
+		wantAnime     int
+	}{
+		{name: "plural without stemming", html: `<p>animes</p>`, want: 0, wantAnime: 0},
+		{name: "plural with stemming", html: `<p>animes</p>`, stemming: true, want: 2, wantAnime: 1},
+		{name: "possessive without stemming", html: `<p>anime's</p>`, want: 0, wantAnime: 0},
+		{name: "possessive with stemming", html: `<p>anime's</p>`, stemming: true, want: 2, wantAnime: 1},
+		{name: "exact word stays a match", html: `<p>anime</p>`, stemming: true, want: 2, wantAnime: 1},
+		{name: "plural phrase with stemming", html: `<p>light novels</p>`, stemming: true, want: 3},
+		{name: "plural phrase without stemming", html: `<p>light novels</p>`, want: 0},
+		{name: "opted out keyword", html: `<p>animes</p>`, stemming: true, exactKeywords: []string{"Anime"}, want: 0, wantAnime: 0},
+		{name: "plural in the title", html: `<title>Animes</title>`, stemming: true, want: 2 * defaultConfig().Scoring.TitleMultiplier, wantAnime: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scoring := defaultConfig().Scoring
+			scoring.Stemming = test.stemming
+			scoring.ExactKeywords = test.exactKeywords
+			page := testPage("https://blog.example/", 1)
+			page.Html = []byte(`<html><body>` + test.html + `</body></html>`)
+
+			got := getRelevancyScore(page, keywords, scoring)
+
+			if got.Total != test.want || got.Counts["anime"] != test.wantAnime {
+				t.Errorf("getRelevancyScore() = %d with %v, want %d with %d anime", got.Total, got.Counts, test.want, test.wantAnime)
+			}
+		})
+	}
+}
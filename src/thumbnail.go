@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Ask the configured thumbnail service for an image of the page. The service is called as
+// GET <endpoint>?url=<page url> and must answer with JSON like {"url": "https://..."}
+func fetchThumbnailUrl(ctx context.Context, client Doer, thumbnail ThumbnailConfig, pageUrl string) (string, error) {
+	endpoint, err := url.Parse(thumbnail.Endpoint)
+
+	if err != nil {
+		return "", err
+	}
+
+	query := endpoint.Query()
+	query.Set("url", pageUrl)
+	endpoint.RawQuery = query.Encode()
+
+	thumbnailCtx, cancel := context.WithTimeout(ctx, time.Duration(thumbnail.Timeout)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(thumbnailCtx, "GET", endpoint.String(), nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer func(resp *http.Response) {
+		_ = resp.Body.Close()
+	}(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("thumbnail service responded with %d", resp.StatusCode)
+	}
+
+	var thumbnailResponse struct {
+		Url string `json:"url"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&thumbnailResponse)
+
+	if err != nil {
+		return "", err
+	}
+
+	return thumbnailResponse.Url, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// A thumbnail service answering every request with status and body, recording the page urls it was asked for
+func stubThumbnailService(t *testing.T, status int, body string) (*httptest.Server, *[]string) {
+	t.Helper()
+
+	var requested []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Query().Get("url"))
+		w.WriteHeader(status)
+		_, _ = fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requested
+}
+
+func TestFetchThumbnailUrl(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{name: "image url", status: http.StatusOK, body: `{"url": "https://thumbs.example/blog.png"}`, want: "https://thumbs.example/blog.png"},
+		{name: "no image", status: http.StatusOK, body: `{}`, want: ""},
+		{name: "service error", status: http.StatusInternalServerError, body: `{"url": "https://thumbs.example/blog.png"}`, wantErr: true},
+		{name: "not json", status: http.StatusOK, body: `<html>`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, requested := stubThumbnailService(t, test.status, test.body)
+			thumbnail := ThumbnailConfig{Endpoint: server.URL + "/shot?size=small", Timeout: 5}
+
+			got, err := fetchThumbnailUrl(context.Background(), server.Client(), thumbnail, "https://blog.example/a?b=c")
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("fetchThumbnailUrl() error = %v, want error %v", err, test.wantErr)
+			}
+
+			if got != test.want {
+				t.Errorf("fetchThumbnailUrl() = %q, want %q", got, test.want)
+			}
+
+			if len(*requested) != 1 || (*requested)[0] != "https://blog.example/a?b=c" {
+				t.Errorf("service was asked for %v, want the page url once", *requested)
+			}
+		})
+	}
+}
+
+func TestFetchThumbnailUrlTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	_, err := fetchThumbnailUrl(context.Background(), server.Client(), ThumbnailConfig{Endpoint: server.URL, Timeout: 1}, "https://blog.example/")
+
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 3*time.Second {
+		t.Errorf("fetchThumbnailUrl() error = %v after %s, want a timeout after a second", err, time.Since(start))
+	}
+}
+
+func TestRunStoresThumbnails(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = fmt.Fprint(w, `<html><head><title>Anime</title></head><body>anime</body></html>`)
+	}))
+	defer site.Close()
+
+	tests := []struct {
+		name          string
+		status        int
+		body          string
+		wantThumbnail string
+	}{
+		{name: "stored", status: http.StatusOK, body: `{"url": "https://thumbs.example/blog.png"}`, wantThumbnail: "https://thumbs.example/blog.png"},
+		{name: "service failing still queues", status: http.StatusBadGateway, body: `bad gateway`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service, _ := stubThumbnailService(t, test.status, test.body)
+
+			config := testDiscovererConfig()
+			config.Thumbnail = ThumbnailConfig{Endpoint: service.URL, Timeout: 5}
+
+			store := &fakeStore{posts: []Post{testPost(1, site.URL, "/a")}}
+			result, err := NewDiscoverer(config, store, site.Client()).Run(context.Background())
+
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			if len(result.Queued) != 1 {
+				t.Fatalf("queued %d, want 1", len(result.Queued))
+			}
+
+			host := result.Queued[0].Host
+
+			if result.Queued[0].Thumbnail != test.wantThumbnail || store.thumbnails[host] != test.wantThumbnail {
+				t.Errorf("thumbnail %q, stored %q, want %q", result.Queued[0].Thumbnail, store.thumbnails[host], test.wantThumbnail)
+			}
+
+			if _, stored := store.thumbnails[host]; stored != (test.wantThumbnail != "") {
+				t.Errorf("stored thumbnails %v, want one only when the service answered", store.thumbnails)
+			}
+		})
+	}
+}
+
+func TestSetThumbnailUrl(t *testing.T) {
+	tests := []struct {
+		name    string
+		execErr error
+		wantErr bool
+	}{
+		{name: "stored"},
+		{name: "update fails", execErr: errors.New("lock wait timeout"), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, mock := newMockDb(t)
+
+			exec := mock.ExpectPrepare("UPDATE `discovered_sites_queue` SET `thumbnail_url`").ExpectExec().
+				WithArgs("https://thumbs.example/blog.png", "blog.example")
+
+			if test.execErr != nil {
+				exec.WillReturnError(test.execErr)
+			} else {
+				exec.WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			err := setThumbnailUrl(context.Background(), db, "blog.example", "https://thumbs.example/blog.png")
+
+			if (err != nil) != test.wantErr {
+				t.Errorf("setThumbnailUrl() error = %v, want error %v", err, test.wantErr)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
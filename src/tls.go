@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// The TLS settings of every fetch: certificates are checked against the system roots plus crawler.CaBundleFile,
+// unless crawler.InsecureSkipVerify turns checking off altogether
+func newCrawlerTlsConfig(crawler CrawlerConfig) *tls.Config {
+	tlsConfig := &tls.Config{}
+
+	if crawler.InsecureSkipVerify {
+		slog.Warn("tls certificate verification is disabled, every fetch trusts any certificate")
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	if crawler.CaBundleFile != "" {
+		roots, err := loadCaBundle(crawler.CaBundleFile)
+
+		if err != nil {
+			slog.Error("could not load ca bundle, using the system roots", "error", err)
+			return tlsConfig
+		}
+
+		tlsConfig.RootCAs = roots
+	}
+
+	return tlsConfig
+}
+
+// A crawler client that accepts any certificate, for fetching again the pages whose certificates don't verify
+func newInsecureCrawlerClient(crawler CrawlerConfig) *http.Client {
+	client := newCrawlerClient(crawler)
+	client.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify = true
+
+	return client
+}
+
+// Whether err is a certificate that failed verification, rather than a failed handshake
+func isCertificateError(err error) bool {
+	var verificationErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	return errors.As(err, &verificationErr) ||
+		errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr)
+}
+
+// The system roots along with the PEM certificates in path
+func loadCaBundle(path string) (*x509.CertPool, error) {
+	bundle, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not read ca bundle: %w", err)
+	}
+
+	roots, err := x509.SystemCertPool()
+
+	if err != nil || roots == nil {
+		roots = x509.NewCertPool()
+	}
+
+	if !roots.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no pem certificates in ca bundle %s", path)
+	}
+
+	return roots, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Write the server's certificate as a PEM bundle, returning its path
+func writeCaBundle(t *testing.T, server *httptest.Server) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	if err := os.WriteFile(path, bundle, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestCrawlerClientTls(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	notPem := filepath.Join(t.TempDir(), "not.pem")
+
+	if err := os.WriteFile(notPem, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name               string
+		insecureSkipVerify bool
+		caBundleFile       string
+		wantErr            bool
+	}{
+		{name: "untrusted certificate", wantErr: true},
+		{name: "verification skipped", insecureSkipVerify: true},
+		{name: "certificate in the ca bundle", caBundleFile: writeCaBundle(t, server)},
+		{name: "missing ca bundle falls back to the system roots", caBundleFile: filepath.Join(t.TempDir(), "missing.pem"), wantErr: true},
+		{name: "ca bundle without certificates falls back to the system roots", caBundleFile: notPem, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			crawler := testCrawlerConfig()
+			crawler.InsecureSkipVerify = test.insecureSkipVerify
+			crawler.CaBundleFile = test.caBundleFile
+
+			resp, err := newCrawlerClient(crawler).Get(server.URL)
+
+			if err == nil {
+				_ = resp.Body.Close()
+			}
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Get() error = %v, wantErr %v", err, test.wantErr)
+			}
+
+			if err != nil && !isCertificateError(err) {
+				t.Errorf("error = %v, want a certificate error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Spans are no-ops until setupTracing installs an exporting provider
+var tracer = otel.Tracer("github.com/bateszi/abt-auto-discover")
+
+// Export spans over OTLP/HTTP when an endpoint is configured. The returned function flushes and stops the exporter
+func setupTracing(ctx context.Context, tracing TracingConfig) (func(context.Context) error, error) {
+	if tracing.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(tracing.Endpoint)}
+
+	if tracing.Insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(ctx, options...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", tracing.ServiceName),
+		)),
+	)
+
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
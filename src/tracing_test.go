@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// Record spans in memory for the rest of the test
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	previous := tracer
+	tracer = provider.Tracer("test")
+	t.Cleanup(func() {
+		tracer = previous
+		_ = provider.Shutdown(context.Background())
+	})
+
+	return recorder
+}
+
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attributes := make(map[attribute.Key]attribute.Value)
+
+	for _, kv := range span.Attributes() {
+		attributes[kv.Key] = kv.Value
+	}
+
+	return attributes
+}
+
+func TestRunSpans(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/a", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = fmt.Fprint(w, `<html><head><title>Anime</title></head><body>anime</body></html>`)
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	otherHost := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+	recorder := recordSpans(t)
+
+	store := &fakeStore{posts: []Post{testPost(1, server.URL, "/a"), testPost(2, otherHost, "/missing")}}
+
+	if _, err := NewDiscoverer(testDiscovererConfig(), store, server.Client()).Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	var runSpan sdktrace.ReadOnlySpan
+	fetchSpans := make(map[string]sdktrace.ReadOnlySpan)
+
+	for _, span := range recorder.Ended() {
+		switch span.Name() {
+		case "discovery.run":
+			runSpan = span
+		case "discovery.fetch":
+			fetchSpans[spanAttributes(span)["url"].AsString()] = span
+		}
+	}
+
+	if runSpan == nil {
+		t.Fatalf("no run span in %d spans", len(recorder.Ended()))
+	}
+
+	if runSpan.Parent().IsValid() {
+		t.Errorf("run span has a parent, want it at the root")
+	}
+
+	if got := spanAttributes(runSpan)["fetched"].AsInt64(); got != 1 {
+		t.Errorf("run span fetched = %d, want 1", got)
+	}
+
+	tests := []struct {
+		name        string
+		url         string
+		wantHost    string
+		wantFetched bool
+		wantFailure string
+	}{
+		{name: "fetched", url: server.URL + "/a", wantHost: strings.TrimPrefix(server.URL, "http://"), wantFetched: true},
+		{name: "failed", url: otherHost + "/missing", wantHost: strings.TrimPrefix(otherHost, "http://"), wantFailure: failureHttpStatus},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			span, ok := fetchSpans[test.url]
+
+			if !ok {
+				t.Fatalf("no fetch span for %s", test.url)
+			}
+
+			if span.Parent().SpanID() != runSpan.SpanContext().SpanID() || span.SpanContext().TraceID() != runSpan.SpanContext().TraceID() {
+				t.Errorf("fetch span is not a child of the run span")
+			}
+
+			attributes := spanAttributes(span)
+
+			if attributes["host"].AsString() != test.wantHost || attributes["fetched"].AsBool() != test.wantFetched || attributes["failure"].AsString() != test.wantFailure {
+				t.Errorf("fetch span attributes = %v, want host %s, fetched %v, failure %q", attributes, test.wantHost, test.wantFetched, test.wantFailure)
+			}
+		})
+	}
+}
+
+func TestSetupTracingDisabled(t *testing.T) {
+	shutdown, err := setupTracing(context.Background(), TracingConfig{})
+
+	if err != nil {
+		t.Fatalf("setupTracing() error = %v", err)
+	}
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown() error = %v", err)
+	}
+}